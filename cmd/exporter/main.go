@@ -0,0 +1,113 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/nginx"
+	"github.com/hliangzhao/balancer/pkg/exporter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+var setupLog = ctrl.Log.WithName("exporter")
+
+func main() {
+	var balancer string
+	var configFile string
+	var metricsAddr string
+	var stubStatusURL string
+	var syslogAddr string
+	var resyncPeriod time.Duration
+	flag.StringVar(&balancer, "balancer", "", "The name of the Balancer the proxy belongs to.")
+	flag.StringVar(&configFile, "config-file", "/etc/nginx/nginx.conf",
+		"The nginx config, which maps the listeners and the upstreams to the balancer ports and backends.")
+	flag.StringVar(&metricsAddr, "metrics-bind-address", fmt.Sprintf(":%d", exporter.Port),
+		"The address the metric endpoint binds to.")
+	flag.StringVar(&stubStatusURL, "stub-status-url",
+		fmt.Sprintf("http://127.0.0.1:%d%s", nginx.HealthPort, nginx.StubStatusPath), "The url of the nginx stub_status.")
+	flag.StringVar(&syslogAddr, "syslog-bind-address", nginx.AccessLogAddress,
+		"The address the syslog receiving the access log of nginx binds to.")
+	flag.DurationVar(&resyncPeriod, "resync-period", 30*time.Second,
+		"How often the config is read and the backend services are resolved again.")
+	opts := zap.Options{}
+	opts.BindFlags(flag.CommandLine)
+	flag.Parse()
+
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	registry := prometheus.NewRegistry()
+	e := exporter.New(balancer, registry)
+	registry.MustRegister(exporter.NewStubStatusCollector(balancer, stubStatusURL))
+
+	ctx := ctrl.SetupSignalHandler()
+	load := func() {
+		data, err := ioutil.ReadFile(configFile)
+		if err == nil {
+			err = e.Load(ctx, data)
+		}
+		if err != nil {
+			setupLog.Error(err, "unable to load config", "file", configFile)
+		}
+	}
+	load()
+	go func() {
+		ticker := time.NewTicker(resyncPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				load()
+			}
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle(exporter.MetricsPath, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	go func() {
+		if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+			setupLog.Error(err, "problem serving metrics")
+			os.Exit(1)
+		}
+	}()
+
+	conn, err := net.ListenPacket("udp", syslogAddr)
+	if err != nil {
+		setupLog.Error(err, "unable to listen syslog", "address", syslogAddr)
+		os.Exit(1)
+	}
+	setupLog.Info("starting exporter", "balancer", balancer, "file", configFile)
+	err = e.ServeSyslog(ctx, conn, func(err error) {
+		setupLog.Error(err, "unable to read access log")
+	})
+	if err != nil && err != context.Canceled {
+		setupLog.Error(err, "problem receiving access log")
+		os.Exit(1)
+	}
+}
@@ -20,6 +20,10 @@ import (
 	"flag"
 	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
 	"github.com/hliangzhao/balancer/pkg/controllers"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/envoy"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/native"
+	"net"
 	"os"
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -51,6 +55,18 @@ func main() {
 	var probeAddr string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	flag.StringVar(&balancer.ReloaderImage, "reloader-image", balancer.DefaultReloaderImage,
+		"The image of the reloader sidecar injected into the proxy pods which reload their config in place.")
+	flag.StringVar(&balancer.ExporterImage, "exporter-image", balancer.DefaultReloaderImage,
+		"The image of the exporter sidecar injected into the nginx proxy pods which export their traffic metrics.")
+	flag.StringVar(&native.Image, "native-proxy-image", native.DefaultImage,
+		"The image of the native proxy, which runs the proxy pods of the Balancers using the native data plane.")
+	flag.StringVar(&envoy.Image, "envoy-image", envoy.DefaultImage,
+		"The image of envoy, which runs the proxy pods of the Balancers using the envoy data plane.")
+	flag.StringVar(&balancer.XDSBindAddress, "xds-bind-address", balancer.XDSBindAddress,
+		"The address the xDS server of the envoy data plane binds to. The xDS server is disabled if it is empty.")
+	flag.StringVar(&envoy.XDSAddress, "xds-address", envoy.DefaultXDSAddress,
+		"The address (host:port) of the xDS server which the envoy proxy pods connect to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
@@ -62,6 +78,11 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	if _, _, err := net.SplitHostPort(envoy.XDSAddress); err != nil {
+		setupLog.Error(err, "invalid xDS address", "xds-address", envoy.XDSAddress)
+		os.Exit(1)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
@@ -0,0 +1,95 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/hliangzhao/balancer/pkg/proxy"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+var setupLog = ctrl.Log.WithName("proxy")
+
+func main() {
+	var configFile string
+	var healthAddr string
+	var shutdownTimeout time.Duration
+	flag.StringVar(&configFile, "config-file", "/etc/balancer-proxy/proxy.json", "The proxy config file.")
+	flag.StringVar(&healthAddr, "health-bind-address", fmt.Sprintf(":%d", proxy.HealthPort),
+		"The address the health and the metrics endpoints bind to.")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second,
+		"How long the established connections are waited for on shutdown.")
+	opts := zap.Options{}
+	opts.BindFlags(flag.CommandLine)
+	flag.Parse()
+
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	p := proxy.New()
+	config, err := proxy.LoadConfig(configFile)
+	if err != nil {
+		setupLog.Error(err, "unable to load config", "file", configFile)
+		os.Exit(1)
+	}
+	if err = p.Apply(config); err != nil {
+		setupLog.Error(err, "unable to apply config", "file", configFile)
+		os.Exit(1)
+	}
+
+	go func() {
+		if err := http.ListenAndServe(healthAddr, p.Handler()); err != nil {
+			setupLog.Error(err, "problem serving health and metrics")
+			os.Exit(1)
+		}
+	}()
+
+	// SIGHUP swaps the config in place, e.g., sent by the reloader sidecar
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	stop := ctrl.SetupSignalHandler()
+	setupLog.Info("starting proxy", "file", configFile, "listeners", len(config.Listeners))
+	for {
+		select {
+		case <-reload:
+			config, err := proxy.LoadConfig(configFile)
+			if err == nil {
+				err = p.Apply(config)
+			}
+			if err != nil {
+				// keep serving the last applied config
+				setupLog.Error(err, "unable to reload config", "file", configFile)
+				continue
+			}
+			setupLog.Info("reloaded config", "listeners", len(config.Listeners))
+		case <-stop.Done():
+			setupLog.Info("shutting down, waiting for the established connections")
+			p.Close()
+			if !p.Wait(shutdownTimeout) {
+				setupLog.Info("shutdown timeout expired, dropping the established connections")
+			}
+			return
+		}
+	}
+}
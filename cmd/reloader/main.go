@@ -0,0 +1,92 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/hliangzhao/balancer/pkg/reloader"
+	"net/http"
+	"os"
+	"time"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+var setupLog = ctrl.Log.WithName("reloader")
+
+func main() {
+	var configFile string
+	var statusAddr string
+	var processPrefix string
+	var resyncPeriod time.Duration
+	var format string
+	var signalName string
+	flag.StringVar(&configFile, "config-file", "/etc/nginx/nginx.conf", "The proxy config file to watch.")
+	flag.StringVar(&statusAddr, "status-bind-address", fmt.Sprintf(":%d", reloader.Port),
+		"The address the status endpoint binds to.")
+	flag.StringVar(&processPrefix, "process", "nginx: master process",
+		"The command line prefix of the proxy process which is signaled to reload.")
+	flag.StringVar(&format, "format", "nginx", "The format of the proxy config, which decides how it is validated.")
+	flag.StringVar(&signalName, "signal", "SIGHUP", "The signal which makes the proxy reload its config.")
+	flag.DurationVar(&resyncPeriod, "resync-period", 30*time.Second,
+		"How often the config file is checked in case a change event is missed.")
+	opts := zap.Options{}
+	opts.BindFlags(flag.CommandLine)
+	flag.Parse()
+
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	validate, ok := reloader.Validators[format]
+	if !ok {
+		setupLog.Error(fmt.Errorf("unknown format %q", format), "unable to validate config")
+		os.Exit(1)
+	}
+	sig, err := reloader.ParseSignal(signalName)
+	if err != nil {
+		setupLog.Error(err, "unable to reload proxy")
+		os.Exit(1)
+	}
+
+	r, err := reloader.New(configFile, validate, func() error {
+		return reloader.SignalProcess(processPrefix, sig)
+	})
+	if err != nil {
+		setupLog.Error(err, "unable to read config", "file", configFile)
+		os.Exit(1)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(reloader.StatusPath, r)
+	go func() {
+		if err := http.ListenAndServe(statusAddr, mux); err != nil {
+			setupLog.Error(err, "problem serving status")
+			os.Exit(1)
+		}
+	}()
+
+	setupLog.Info("starting reloader", "file", configFile, "configHash", r.Status().ConfigHash)
+	err = r.Run(ctrl.SetupSignalHandler(), resyncPeriod, func(err error) {
+		setupLog.Error(err, "unable to apply config")
+	})
+	if err != nil && err != context.Canceled {
+		setupLog.Error(err, "problem watching config")
+		os.Exit(1)
+	}
+}
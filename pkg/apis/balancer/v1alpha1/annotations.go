@@ -19,5 +19,27 @@ package v1alpha1
 const (
 	// ConfigMapHashKey is the key of the annotation which is used by the Balancer.
 	// Balancer wraps a Nginx instance, and the value corresponding to key ConfigMapHashKey is a hashing result.
+	// On the proxy configmap, it is the hash of the rendered nginx config, which is reported by the reloader sidecar once applied.
 	ConfigMapHashKey = "balancer.exposer.hliangzhao.io/configmap-hash"
+
+	// WeightsKey is the key of the annotation on the proxy configmap, whose value is the backend weights
+	// rendered into the config, e.g., v1=40,v2=60.
+	WeightsKey = "balancer.exposer.hliangzhao.io/weights"
+
+	// AppliedHashKey is the key of the annotation on the resources managed by Balancer, whose value is the hash of
+	// the fields last applied by the controller. A resource whose fields differ from the ones of the same hash
+	// is changed by others, i.e., it drifts.
+	AppliedHashKey = "balancer.exposer.hliangzhao.io/applied-hash"
+
+	// ManualOverrideKey is the key of the annotation which stops the controller from syncing a resource managed by Balancer,
+	// e.g., the proxy configmap edited by hand in an emergency. It takes effect when the value is "true".
+	ManualOverrideKey = "balancer.exposer.hliangzhao.io/manual-override"
+
+	// RolloutPromoteKey is the key of the annotation which promotes the rollout of a Balancer to the next step.
+	// The annotation is removed by the controller once handled.
+	RolloutPromoteKey = "balancer.exposer.hliangzhao.io/promote"
+
+	// RolloutAbortKey is the key of the annotation which aborts the rollout of a Balancer.
+	// The annotation is removed by the controller once handled.
+	RolloutAbortKey = "balancer.exposer.hliangzhao.io/abort"
 )
@@ -17,18 +17,61 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 type Protocol string
 type Port int32
+type WeightMode string
+type UpstreamMode string
+type ReloadMode string
+type DataPlaneType string
 
 const (
 	TCP Protocol = "TCP"
 	UDP Protocol = "UDP"
 )
 
+const (
+	// WeightModeStatic uses the weight of each backend as it is.
+	WeightModeStatic WeightMode = "static"
+	// WeightModeEndpoints derives the weight of each backend from the number of its ready endpoints,
+	// multiplied by the weight factor of the backend.
+	WeightModeEndpoints WeightMode = "endpoints"
+)
+
+const (
+	// UpstreamModeService forwards the traffic of each backend to its backend service,
+	// which is balanced again among the pods of the backend by kube-proxy.
+	UpstreamModeService UpstreamMode = "service"
+	// UpstreamModeEndpoints forwards the traffic to the ready pod endpoints of each backend directly,
+	// the weight of a backend is split across its endpoints.
+	UpstreamModeEndpoints UpstreamMode = "endpoints"
+)
+
+const (
+	// ReloadModeRestart restarts the proxy pods once the proxy config changes.
+	ReloadModeRestart ReloadMode = "Restart"
+	// ReloadModeHotReload reloads the proxy config in place by the reloader sidecar,
+	// which keeps the established connections.
+	ReloadModeHotReload ReloadMode = "HotReload"
+)
+
+const (
+	// DataPlaneNginx proxies the traffic with nginx.
+	DataPlaneNginx DataPlaneType = "nginx"
+	// DataPlaneHAProxy proxies the traffic with HAProxy, which supports TCP only.
+	DataPlaneHAProxy DataPlaneType = "haproxy"
+	// DataPlaneNative proxies the traffic with the native Go L4 proxy shipped with the balancer-controller.
+	DataPlaneNative DataPlaneType = "native"
+	// DataPlaneEnvoy proxies the traffic with Envoy, which is configured over xDS by the balancer-controller,
+	// thus the weight changes are applied without restarting or reloading the proxy pods.
+	DataPlaneEnvoy DataPlaneType = "envoy"
+)
+
 // ============ balancer example ============
 //  apiVersion: exposer.hliangzhao.io/v1alpha1
 // 	kind: Balancer
@@ -58,6 +101,10 @@ const (
 // 	     weight: 40
 // 	     selector:
 // 	       version: v3
+// 	     # v3 listens on another container port
+// 	     ports:
+// 	       - name: http
+// 	         targetPort: 8080
 // ==========================================
 
 // Balancer is the Schema for the balancers API
@@ -84,6 +131,306 @@ type BalancerSpec struct {
 	Selector map[string]string `json:"selector,omitempty"`
 
 	Ports []BalancerPort `json:"ports"`
+
+	// Frontend configures the front-end service of the balancer.
+	// +optional
+	Frontend *FrontendSpec `json:"frontend,omitempty"`
+
+	// Frontends are the additional front-end services of the balancer, e.g., an external one with a subset of
+	// the ports besides the internal one configured by Frontend. All of them point to the same proxy.
+	// +optional
+	Frontends []NamedFrontendSpec `json:"frontends,omitempty"`
+
+	// Replicas is the number of the proxy pods. Defaults to 1.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// Autoscaling manages a HorizontalPodAutoscaler for the proxy deployment.
+	// Replicas is ignored while Autoscaling is set, the replica count is owned by the HorizontalPodAutoscaler.
+	// +optional
+	Autoscaling *AutoscalingSpec `json:"autoscaling,omitempty"`
+
+	// Availability configures how the proxy pods survive voluntary disruptions and node/zone failures
+	// when there are more than one replica.
+	// +optional
+	Availability *AvailabilitySpec `json:"availability,omitempty"`
+
+	// ProxyTemplate customizes the pods of the proxy deployment.
+	// +optional
+	ProxyTemplate *ProxyTemplate `json:"proxyTemplate,omitempty"`
+
+	// WeightMode decides how the weights of backends are derived.
+	// Defaults to static, which uses the weights of the backends as they are. The endpoints mode changes
+	// the proxy config with the number of ready endpoints, thus it requires ReloadMode HotReload,
+	// except for the envoy data plane, which receives the weights over xDS.
+	// +kubebuilder:validation:Enum=static;endpoints
+	// +optional
+	WeightMode WeightMode `json:"weightMode,omitempty"`
+
+	// UpstreamMode decides where the proxy forwards the traffic of each backend to.
+	// Defaults to service, which forwards it to the backend service. The endpoints mode renders the pod IPs read from
+	// the EndpointSlices of the backend services into the proxy config, which changes with the endpoints,
+	// thus it requires ReloadMode HotReload, except for the envoy data plane, which receives the endpoints over xDS.
+	// A backend without any ready endpoint of a port receives no traffic of the port, which is recorded as
+	// a NoReadyEndpoints event.
+	// +kubebuilder:validation:Enum=service;endpoints
+	// +optional
+	UpstreamMode UpstreamMode `json:"upstreamMode,omitempty"`
+
+	// DrainPeriod is how long the backend service of a backend removed from Backends is kept
+	// after every proxy pod runs the config without the backend, so that in-flight connections can finish.
+	// Defaults to 30s, and must be positive.
+	// +optional
+	DrainPeriod *metav1.Duration `json:"drainPeriod,omitempty"`
+
+	// DataPlane decides which proxy forwards the traffic to the backends.
+	// Defaults to nginx.
+	// +kubebuilder:validation:Enum=nginx;haproxy;native;envoy
+	// +optional
+	DataPlane DataPlaneType `json:"dataPlane,omitempty"`
+
+	// ReloadMode decides how the proxy pods pick up a changed proxy config.
+	// Defaults to Restart. The envoy data plane is configured over xDS, and does not support HotReload.
+	// +kubebuilder:validation:Enum=Restart;HotReload
+	// +optional
+	ReloadMode ReloadMode `json:"reloadMode,omitempty"`
+
+	// Metrics exports the traffic metrics of the proxy pods, split by backend.
+	// The nginx data plane runs an exporter sidecar, and the native data plane exports the metrics by itself.
+	// +optional
+	Metrics *MetricsSpec `json:"metrics,omitempty"`
+
+	// Rollout progressively shifts traffic to a target backend.
+	// While a rollout is in progress, the weights of the current step override the backend weights.
+	// +optional
+	Rollout *RolloutSpec `json:"rollout,omitempty"`
+}
+
+// RolloutSpec describes the steps of a progressive traffic shifting.
+// +k8s:openapi-gen=true
+type RolloutSpec struct {
+	// the name of the backend which traffic is shifted to.
+	// The rollout is aborted if the backend is not found, or drained (i.e., its weight is zero).
+	// +kubebuilder:validation:MinLength=1
+	TargetBackend string `json:"targetBackend"`
+
+	// +kubebuilder:validation:MinItems=1
+	Steps []RolloutStep `json:"steps"`
+}
+
+// RolloutStep is a single step of a rollout.
+// +k8s:openapi-gen=true
+type RolloutStep struct {
+	// the percentage of traffic sent to the target backend in this step,
+	// the rest is shared by the other backends according to their weights
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	Weight int32 `json:"weight"`
+
+	// Pause holds the rollout on this step.
+	// If not set, the rollout advances to the next step immediately.
+	// +optional
+	Pause *RolloutPause `json:"pause,omitempty"`
+}
+
+// RolloutPause describes how long a rollout stays on a step.
+// +k8s:openapi-gen=true
+type RolloutPause struct {
+	// Duration is how long to stay on the step before advancing.
+	// If not set, the rollout waits until it is promoted manually with the promote annotation.
+	// +optional
+	Duration *metav1.Duration `json:"duration,omitempty"`
+}
+
+// FrontendSpec defines the desired state of the front-end service of Balancer
+// +k8s:openapi-gen=true
+type FrontendSpec struct {
+	// Type of the front-end service. Defaults to ClusterIP.
+	// +kubebuilder:validation:Enum=ClusterIP;NodePort;LoadBalancer
+	// +optional
+	Type corev1.ServiceType `json:"type,omitempty"`
+
+	// NodePorts fixes the node ports of the balancer ports when Type is NodePort or LoadBalancer.
+	// Each of them must name a balancer port, the node ports of the balancer ports which are not listed here
+	// are allocated by the cluster.
+	// +optional
+	NodePorts []FrontendNodePort `json:"nodePorts,omitempty"`
+
+	// LoadBalancerSourceRanges restricts the client IPs when Type is LoadBalancer.
+	// +optional
+	LoadBalancerSourceRanges []string `json:"loadBalancerSourceRanges,omitempty"`
+
+	// ExternalTrafficPolicy of the front-end service when Type is NodePort or LoadBalancer.
+	// +kubebuilder:validation:Enum=Cluster;Local
+	// +optional
+	ExternalTrafficPolicy corev1.ServiceExternalTrafficPolicyType `json:"externalTrafficPolicy,omitempty"`
+
+	// extra labels of the front-end service, which must not use the label keys reserved by balancer
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// extra annotations of the front-end service, e.g., the ones used by cloud load balancer controllers or external-dns
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// NamedFrontendSpec defines the desired state of an additional front-end service of Balancer
+// +k8s:openapi-gen=true
+type NamedFrontendSpec struct {
+	// The name of the frontend, the front-end service is named as <balancer name>-<frontend name>.
+	// It must not be <backend name>-backend of any backend, whose backend service has the same name.
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+
+	// the names of the balancer ports exposed by this frontend, all the balancer ports are exposed if not set
+	// +optional
+	Ports []string `json:"ports,omitempty"`
+
+	FrontendSpec `json:",inline"`
+}
+
+// FrontendNodePort fixes the node port of a BalancerPort.
+// +k8s:openapi-gen=true
+type FrontendNodePort struct {
+	// The name of the BalancerPort.
+	// Optional if only one BalancerPort is defined on the balancer.
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	NodePort int32 `json:"nodePort"`
+}
+
+// AutoscalingSpec defines the HorizontalPodAutoscaler of the proxy deployment of Balancer.
+// +k8s:openapi-gen=true
+type AutoscalingSpec struct {
+	// the lower limit of the proxy pods. Defaults to 1.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MinReplicas *int32 `json:"minReplicas,omitempty"`
+
+	// the upper limit of the proxy pods
+	// +kubebuilder:validation:Minimum=1
+	MaxReplicas int32 `json:"maxReplicas"`
+
+	// the target average CPU utilization of the proxy pods, in percentage of the requested CPU.
+	// Defaults to 80 if no custom metric is set.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	TargetCPUUtilizationPercentage *int32 `json:"targetCPUUtilizationPercentage,omitempty"`
+
+	// the custom metrics describing each proxy pod, e.g., the active connections
+	// +optional
+	CustomMetrics []CustomMetric `json:"customMetrics,omitempty"`
+}
+
+// CustomMetric is a metric describing each proxy pod, which is served by the custom metrics API.
+// +k8s:openapi-gen=true
+type CustomMetric struct {
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+
+	// the target value of the metric averaged across all the proxy pods
+	TargetAverageValue resource.Quantity `json:"targetAverageValue"`
+}
+
+// MetricsSpec defines how the traffic metrics of the proxy pods are exported.
+// +k8s:openapi-gen=true
+type MetricsSpec struct {
+	// ServiceMonitor creates a ServiceMonitor of prometheus-operator which scrapes the proxy pods.
+	// +optional
+	ServiceMonitor *ServiceMonitorSpec `json:"serviceMonitor,omitempty"`
+}
+
+// ServiceMonitorSpec defines the ServiceMonitor of the proxy pods.
+// +k8s:openapi-gen=true
+type ServiceMonitorSpec struct {
+	// the extra labels of the ServiceMonitor, e.g., the ones selected by the serviceMonitorSelector of Prometheus
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// the scrape interval, e.g., 30s. Defaults to the global scrape interval of Prometheus.
+	// +kubebuilder:validation:Pattern=`^([0-9]+(ms|s|m|h))+$`
+	// +optional
+	Interval string `json:"interval,omitempty"`
+}
+
+// AvailabilitySpec defines the availability of the proxy pods of Balancer.
+// +k8s:openapi-gen=true
+type AvailabilitySpec struct {
+	// DisablePodDisruptionBudget stops creating the PodDisruptionBudget of the proxy pods.
+	// +optional
+	DisablePodDisruptionBudget bool `json:"disablePodDisruptionBudget,omitempty"`
+
+	// MinAvailable of the PodDisruptionBudget. Mutually exclusive with MaxUnavailable.
+	// +optional
+	MinAvailable *intstr.IntOrString `json:"minAvailable,omitempty"`
+
+	// MaxUnavailable of the PodDisruptionBudget. Defaults to 1 if MinAvailable is not set either.
+	// +optional
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+
+	// DisableTopologySpread stops spreading the proxy pods across nodes and zones.
+	// +optional
+	DisableTopologySpread bool `json:"disableTopologySpread,omitempty"`
+
+	// TopologySpreadConstraints replaces the default constraints, which spread the proxy pods
+	// across nodes and zones with a max skew of 1 on a best-effort basis.
+	// The label selector of each constraint is set to the one of the proxy pods if not set.
+	// +optional
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+}
+
+// ProxyTemplate defines the customization of the proxy pods of Balancer.
+// The fields not set here keep the values generated by the controller.
+// +k8s:openapi-gen=true
+type ProxyTemplate struct {
+	// extra labels of the proxy pods, the ones used by Balancer to select the pods cannot be overridden
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// extra annotations of the proxy pods
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// the image of the proxy container
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// +optional
+	ImagePullPolicy corev1.PullPolicy `json:"imagePullPolicy,omitempty"`
+
+	// the compute resources of the proxy container
+	// +optional
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// the security context of the proxy container
+	// +optional
+	ContainerSecurityContext *corev1.SecurityContext `json:"containerSecurityContext,omitempty"`
+
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// +optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+
+	// +optional
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+
+	// +optional
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+
+	// +optional
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	// +optional
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+
+	// the security context of the proxy pods
+	// +optional
+	SecurityContext *corev1.PodSecurityContext `json:"securityContext,omitempty"`
 }
 
 // BackendSpec defines the desired status of endpoints of Balancer
@@ -92,10 +439,35 @@ type BackendSpec struct {
 	// +kubebuilder:validation:MinLength=1
 	Name string `json:"name"`
 
-	// +kubebuilder:validation:Minimum=1
+	// Weight 0 drains the backend: its backend service is kept, but it receives no new traffic.
+	// At least one backend should have a non-zero weight.
+	// +kubebuilder:validation:Minimum=0
 	Weight int32 `json:"weight"`
 
 	Selector map[string]string `json:"selector,omitempty"`
+
+	// WeightFactor multiplies the number of ready endpoints of this backend
+	// when Spec.WeightMode is endpoints. Defaults to 1.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	WeightFactor *int32 `json:"weightFactor,omitempty"`
+
+	// Ports overrides the targetPort of the balancer ports for this backend only.
+	// Balancer ports which are not listed here keep their own targetPort.
+	// +optional
+	Ports []BackendPort `json:"ports,omitempty"`
+}
+
+// BackendPort overrides the targetPort of a BalancerPort for a specific backend.
+// +k8s:openapi-gen=true
+type BackendPort struct {
+	// The name of the BalancerPort to override.
+	// Optional if only one BalancerPort is defined on the balancer.
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// the port (number or name) that used by the containers of this backend
+	TargetPort intstr.IntOrString `json:"targetPort"`
 }
 
 // BalancerPort contains the endpoints and exposed ports.
@@ -122,11 +494,119 @@ type BalancerPort struct {
 // BalancerStatus defines the observed state of Balancer
 // +k8s:openapi-gen=true
 type BalancerStatus struct {
+	// the number of the proxy pods, which is used by the scale subresource
+	// +optional
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// the label selector of the proxy pods, which is used by the scale subresource
+	// +optional
+	Selector string `json:"selector,omitempty"`
+
 	// +optional
 	ActiveBackendsNum int32 `json:"activeBackendsNum,omitempty"`
 
 	// +optional
 	ObsoleteBackendsNum int32 `json:"obsoleteBackendsNum,omitempty"`
+
+	// +optional
+	Backends []BackendStatus `json:"backends,omitempty"`
+
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// +optional
+	Rollout *RolloutStatus `json:"rollout,omitempty"`
+
+	// the hash of the proxy config rendered currently, or the version of the xDS resources of the envoy data plane
+	// +optional
+	ConfigHash string `json:"configHash,omitempty"`
+
+	// the proxy config applied by each proxy pod, only reported when Spec.ReloadMode is HotReload
+	// or Spec.DataPlane is envoy
+	// +optional
+	// +listType=map
+	// +listMapKey=pod
+	Proxies []ProxyStatus `json:"proxies,omitempty"`
+}
+
+// ProxyStatus defines the observed state of a proxy pod of Balancer
+// +k8s:openapi-gen=true
+type ProxyStatus struct {
+	Pod string `json:"pod"`
+
+	// the hash of the proxy config applied by the pod
+	// +optional
+	ConfigHash string `json:"configHash,omitempty"`
+
+	// why the pod failed to apply the newest proxy config, or why its state is unknown
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+type BackendPhase string
+
+const (
+	// BackendActive means the backend receives traffic according to its rendered weight,
+	// which may be zero for the moment, e.g., it has no ready endpoints when WeightMode is endpoints.
+	BackendActive BackendPhase = "Active"
+	// BackendDrained means the weight of the backend is set to zero in the spec, and it receives no traffic.
+	BackendDrained BackendPhase = "Drained"
+	// BackendDraining means the backend is removed from Balancer.Spec.Backends,
+	// and its backend service is deleted once the drain period expires.
+	BackendDraining BackendPhase = "Draining"
+)
+
+// BackendStatus defines the observed state of a backend of Balancer
+// +k8s:openapi-gen=true
+type BackendStatus struct {
+	Name string `json:"name"`
+
+	Phase BackendPhase `json:"phase"`
+
+	// the weight which is rendered into the proxy config currently
+	Weight int32 `json:"weight"`
+
+	// the number of ready endpoints behind the backend service
+	// +optional
+	ReadyEndpoints int32 `json:"readyEndpoints,omitempty"`
+
+	// when the backend started draining, i.e., every proxy pod runs the config without it.
+	// Only set in phase Draining, unset while the proxy pods are not running the config yet.
+	// +optional
+	DrainingSince *metav1.Time `json:"drainingSince,omitempty"`
+}
+
+type RolloutPhase string
+
+const (
+	// RolloutProgressing means the rollout is waiting for the pause duration of the current step.
+	RolloutProgressing RolloutPhase = "Progressing"
+	// RolloutPaused means the rollout is waiting for a manual promotion.
+	RolloutPaused RolloutPhase = "Paused"
+	// RolloutCompleted means all the steps are done, and the weights of the last step are kept.
+	RolloutCompleted RolloutPhase = "Completed"
+	// RolloutAborted means the rollout is aborted, and the backend weights are restored.
+	RolloutAborted RolloutPhase = "Aborted"
+)
+
+// RolloutStatus defines the observed state of the rollout of Balancer
+// +k8s:openapi-gen=true
+type RolloutStatus struct {
+	Phase RolloutPhase `json:"phase"`
+
+	// the index of the step in Spec.Rollout.Steps whose weights are applied currently
+	CurrentStep int32 `json:"currentStep"`
+
+	// +optional
+	StepStartedAt *metav1.Time `json:"stepStartedAt,omitempty"`
+
+	// the hash of Spec.Rollout, a new rollout is started when it changes
+	RolloutHash string `json:"rolloutHash"`
+
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
 // BalancerList contains a list of Balancer
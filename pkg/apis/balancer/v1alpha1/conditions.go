@@ -0,0 +1,41 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+const (
+	// SpecValidCondition tells whether Balancer.Spec passes the validation of the controller.
+	// An invalid Balancer is not synced until its spec is fixed.
+	SpecValidCondition = "SpecValid"
+
+	// ConfigValidCondition tells whether the rendered proxy config passes the pre-flight check of the controller.
+	// An invalid config is not written to the proxy configmap, the proxy pods keep the last valid one.
+	ConfigValidCondition = "ConfigValid"
+
+	// SyncedCondition tells whether the last reconcile synced every resource of the Balancer.
+	// The reason tells whether a failure is retried (TransientError or Conflict) or not (TerminalError).
+	SyncedCondition = "Synced"
+)
+
+const (
+	ReasonValid   = "Valid"
+	ReasonInvalid = "Invalid"
+
+	ReasonSynced         = "Synced"
+	ReasonTransientError = "TransientError"
+	ReasonConflict       = "Conflict"
+	ReasonTerminalError  = "TerminalError"
+)
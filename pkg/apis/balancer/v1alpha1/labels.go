@@ -19,4 +19,11 @@ package v1alpha1
 const (
 	// BalancerKey is the key of the label which is used to select the Balancer instance.
 	BalancerKey = "balancer.exposer.hliangzhao.io/balancer-name"
+
+	// FrontendKey is the key of the label which is used to select the front-end services of the Balancer instance.
+	// The backend services are selected by BalancerKey, thus the front-end services use another key.
+	FrontendKey = "balancer.exposer.hliangzhao.io/frontend-of"
+
+	// MetricsKey is the key of the label which is used to select the metrics service of the Balancer instance.
+	MetricsKey = "balancer.exposer.hliangzhao.io/metrics-of"
 )
@@ -0,0 +1,197 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"hash/fnv"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	randutil "k8s.io/apimachinery/pkg/util/rand"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sort"
+	"strings"
+)
+
+// FieldManager is the field manager of the resources server-side applied by the balancer-controller.
+const FieldManager = "balancer-controller"
+
+// apply sets balancer as the controller owner-reference of obj and server-side applies obj,
+// which holds only the fields managed by balancer. The fields set by others (e.g., the annotations
+// added by other controllers, the node ports allocated by the cluster) are kept.
+//
+// The fields of obj are compared with the ones in the cluster at first, and nothing is applied if none differs.
+// A resource changed by others is reverted and recorded as a DriftReverted event naming the changed fields,
+// unless it is annotated with ManualOverrideKey.
+// A field owned by another manager is taken over, since balancer is the source of truth of the fields it sets,
+// and the conflict is recorded as a Warning event of balancer.
+func (r *ReconcilerBalancer) apply(balancer *exposerv1alpha1.Balancer, kind string, obj client.Object) error {
+	if err := controllerutil.SetControllerReference(balancer, obj, r.scheme); err != nil {
+		return err
+	}
+	// an apply request carries the apiVersion and kind of the object
+	gvk, err := apiutil.GVKForObject(obj, r.scheme)
+	if err != nil {
+		return err
+	}
+	obj.GetObjectKind().SetGroupVersionKind(gvk)
+	hash, err := appliedHash(obj)
+	if err != nil {
+		return err
+	}
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[exposerv1alpha1.AppliedHashKey] = hash
+	obj.SetAnnotations(annotations)
+
+	current := obj.DeepCopyObject().(client.Object)
+	err = r.client.Get(context.Background(), client.ObjectKeyFromObject(obj), current)
+	found := err == nil
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if found {
+		drifted, err := driftedFields(obj, current)
+		if err != nil {
+			return err
+		}
+		if len(drifted) == 0 {
+			return nil
+		}
+		if manuallyOverridden(current) {
+			log.Info("Sync "+kind, obj.GetName(), "manually overridden", "fields", drifted)
+			r.recorder.Eventf(balancer, corev1.EventTypeWarning, EventReasonManualOverride,
+				"%s %s is manually overridden, not syncing %s", kind, obj.GetName(), strings.Join(drifted, ", "))
+			return nil
+		}
+		if current.GetAnnotations()[exposerv1alpha1.AppliedHashKey] == hash {
+			// balancer applies the same fields as last time, so they are changed by others
+			r.recorder.Eventf(balancer, corev1.EventTypeWarning, EventReasonDriftReverted,
+				"%s %s is changed by others, reverting %s", kind, obj.GetName(), strings.Join(drifted, ", "))
+		}
+	}
+
+	err = r.client.Patch(context.Background(), obj, client.Apply, client.FieldOwner(FieldManager))
+	if errors.IsConflict(err) {
+		r.recorder.Eventf(balancer, corev1.EventTypeWarning, EventReasonFieldConflict,
+			"%s %s is changed by another manager, taking over the fields: %v", kind, obj.GetName(), err)
+		err = r.client.Patch(context.Background(), obj, client.Apply, client.FieldOwner(FieldManager), client.ForceOwnership)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		r.recordChange(balancer, kind, obj.GetName(), "created")
+		return nil
+	}
+	r.recordUpdate(balancer, kind, obj, current.GetResourceVersion())
+	return nil
+}
+
+// manuallyOverridden tells whether obj is annotated with ManualOverrideKey, which is not synced by balancer.
+func manuallyOverridden(obj client.Object) bool {
+	return obj.GetAnnotations()[exposerv1alpha1.ManualOverrideKey] == "true"
+}
+
+// appliedHash returns the hash of the fields of obj, which are applied by balancer.
+func appliedHash(obj client.Object) (string, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	hasher := fnv.New32a()
+	_, _ = hasher.Write(data)
+	return randutil.SafeEncodeString(fmt.Sprint(hasher.Sum32())), nil
+}
+
+// driftedFields returns the paths of the fields set in desired which differ in current, e.g., spec.replicas.
+// Only the labels, annotations and owner-references of the metadata are compared, the status is never compared.
+// The fields not set in desired (e.g., the ones defaulted by the apiserver or added by others) are ignored.
+func driftedFields(desired, current client.Object) ([]string, error) {
+	desiredFields, err := toFields(desired)
+	if err != nil {
+		return nil, err
+	}
+	currentFields, err := toFields(current)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for key, value := range desiredFields {
+		switch key {
+		case "apiVersion", "kind", "status":
+		case "metadata":
+			desiredMeta, _ := value.(map[string]interface{})
+			currentMeta, _ := currentFields["metadata"].(map[string]interface{})
+			for _, metaKey := range []string{"labels", "annotations", "ownerReferences"} {
+				diffFields("metadata."+metaKey, desiredMeta[metaKey], currentMeta[metaKey], &paths)
+			}
+		default:
+			diffFields(key, value, currentFields[key], &paths)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func toFields(obj client.Object) (map[string]interface{}, error) {
+	if u, ok := obj.(runtime.Unstructured); ok {
+		return u.UnstructuredContent(), nil
+	}
+	return runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+}
+
+// diffFields appends the path of the fields in desired which differ in current to paths.
+// A list differs as a whole if its length differs.
+func diffFields(path string, desired, current interface{}, paths *[]string) {
+	switch desiredValue := desired.(type) {
+	case nil:
+	case map[string]interface{}:
+		currentValue, _ := current.(map[string]interface{})
+		if currentValue == nil && len(desiredValue) > 0 {
+			*paths = append(*paths, path)
+			return
+		}
+		for key, value := range desiredValue {
+			diffFields(path+"."+key, value, currentValue[key], paths)
+		}
+	case []interface{}:
+		currentValue, ok := current.([]interface{})
+		if !ok || len(currentValue) != len(desiredValue) {
+			*paths = append(*paths, path)
+			return
+		}
+		for i := range desiredValue {
+			diffFields(fmt.Sprintf("%s[%d]", path, i), desiredValue[i], currentValue[i], paths)
+		}
+	default:
+		if !reflect.DeepEqual(desired, current) {
+			*paths = append(*paths, path)
+		}
+	}
+}
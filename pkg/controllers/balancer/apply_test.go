@@ -0,0 +1,235 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"strings"
+	"testing"
+)
+
+// applyClient emulates the server-side apply, which is not supported by the fake client,
+// with a create or a json merge patch. The fields set by others are kept as the server-side apply does,
+// but a list is replaced as a whole.
+type applyClient struct {
+	client.Client
+}
+
+func (c *applyClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch != client.Apply {
+		return c.Client.Patch(ctx, obj, patch, opts...)
+	}
+	current := obj.DeepCopyObject().(client.Object)
+	if err := c.Client.Get(ctx, client.ObjectKeyFromObject(obj), current); errors.IsNotFound(err) {
+		return c.Client.Create(ctx, obj)
+	} else if err != nil {
+		return err
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return c.Client.Patch(ctx, obj, client.RawPatch(types.MergePatchType, data))
+}
+
+// newTestClient returns a fake client holding objs, which supports the server-side apply.
+func newTestClient(scheme *runtime.Scheme, objs ...client.Object) client.Client {
+	return &applyClient{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()}
+}
+
+func TestApplyKeepsFieldsOfOthers(t *testing.T) {
+	balancer := newTestBalancer()
+	scheme := newTestScheme(t)
+	r := &ReconcilerBalancer{client: newTestClient(scheme, balancer), scheme: scheme, recorder: record.NewFakeRecorder(10)}
+
+	svc, err := NewFrontendService(balancer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.syncFrontendService(balancer, svc.DeepCopy()); err != nil {
+		t.Fatal(err)
+	}
+	found := &corev1.Service{}
+	if err = r.client.Get(context.Background(), client.ObjectKeyFromObject(svc), found); err != nil {
+		t.Fatal(err)
+	}
+	if len(found.OwnerReferences) != 1 || found.OwnerReferences[0].Name != balancer.Name {
+		t.Errorf("expected balancer to be the owner, got %v", found.OwnerReferences)
+	}
+	found.Annotations = map[string]string{"kept": "true"}
+	if err = r.client.Update(context.Background(), found); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.syncFrontendService(balancer, svc.DeepCopy()); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.client.Get(context.Background(), client.ObjectKeyFromObject(svc), found); err != nil {
+		t.Fatal(err)
+	}
+	if found.Annotations["kept"] != "true" {
+		t.Errorf("expected the annotation of others kept, got %v", found.Annotations)
+	}
+}
+
+// conflictingClient refuses the server-side apply which does not force the ownership of the fields.
+type conflictingClient struct {
+	client.Client
+	forced bool
+}
+
+func (c *conflictingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	patchOpts := &client.PatchOptions{}
+	patchOpts.ApplyOptions(opts)
+	if patchOpts.FieldManager != FieldManager {
+		return errors.NewBadRequest("unexpected field manager " + patchOpts.FieldManager)
+	}
+	if patchOpts.Force == nil || !*patchOpts.Force {
+		return errors.NewConflict(schema.GroupResource{Resource: "configmaps"}, obj.GetName(),
+			errors.NewBadRequest(`conflict with "kubectl-edit": .data.nginx.conf`))
+	}
+	c.forced = true
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func TestApplyTakesOverConflicts(t *testing.T) {
+	balancer := newTestBalancer()
+	scheme := newTestScheme(t)
+	conflicting := &conflictingClient{Client: newTestClient(scheme, balancer)}
+	recorder := record.NewFakeRecorder(10)
+	r := &ReconcilerBalancer{client: conflicting, scheme: scheme, recorder: recorder}
+
+	if _, err := r.syncConfigMap(balancer); err != nil {
+		t.Fatal(err)
+	}
+	if !conflicting.forced {
+		t.Errorf("expected the conflicting fields taken over")
+	}
+	events := drainEvents(recorder)
+	if len(events) == 0 || !strings.HasPrefix(events[0], "Warning "+EventReasonFieldConflict) ||
+		!strings.Contains(events[0], "kubectl-edit") {
+		t.Errorf("expected a FieldConflict event naming the other manager, got %v", events)
+	}
+}
+
+func TestApplyRevertsDrift(t *testing.T) {
+	balancer := newTestBalancer()
+	scheme := newTestScheme(t)
+	recorder := record.NewFakeRecorder(100)
+	r := &ReconcilerBalancer{client: newTestClient(scheme, balancer), scheme: scheme, recorder: recorder}
+	if _, err := r.syncConfigMap(balancer); err != nil {
+		t.Fatal(err)
+	}
+	key := types.NamespacedName{Namespace: balancer.Namespace, Name: ConfigMapName(balancer)}
+	found := &corev1.ConfigMap{}
+	if err := r.client.Get(context.Background(), key, found); err != nil {
+		t.Fatal(err)
+	}
+	config := found.Data["nginx.conf"]
+	resourceVersion := found.ResourceVersion
+	drainEvents(recorder)
+
+	// nothing drifts, nothing is applied
+	if _, err := r.syncConfigMap(balancer); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.client.Get(context.Background(), key, found); err != nil {
+		t.Fatal(err)
+	}
+	if events := drainEvents(recorder); len(events) != 0 || found.ResourceVersion != resourceVersion {
+		t.Errorf("expected a no-op sync, got %v and resourceVersion %s", events, found.ResourceVersion)
+	}
+
+	// the config edited by hand is reverted
+	found.Data["nginx.conf"] = "events {}\n"
+	found.Labels = map[string]string{"kept": "true"}
+	if err := r.client.Update(context.Background(), found); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.syncConfigMap(balancer); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.client.Get(context.Background(), key, found); err != nil {
+		t.Fatal(err)
+	}
+	if found.Data["nginx.conf"] != config || found.Labels["kept"] != "true" {
+		t.Errorf("expected the config reverted and the label of others kept, got %v %v", found.Labels, found.Data)
+	}
+	events := drainEvents(recorder)
+	if len(events) == 0 || events[0] != "Warning DriftReverted ConfigMap example-balancer-proxy-configmap "+
+		"is changed by others, reverting data.nginx.conf" {
+		t.Errorf("expected a DriftReverted event naming the changed field, got %v", events)
+	}
+
+	// the config edited by hand is kept while it is manually overridden
+	found.Annotations[exposerv1alpha1.ManualOverrideKey] = "true"
+	found.Data["nginx.conf"] = "events {}\n"
+	if err := r.client.Update(context.Background(), found); err != nil {
+		t.Fatal(err)
+	}
+	balancer.Spec.Backends[0].Weight = 10
+	if _, err := r.syncConfigMap(balancer); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.client.Get(context.Background(), key, found); err != nil {
+		t.Fatal(err)
+	}
+	if found.Data["nginx.conf"] != "events {}\n" {
+		t.Errorf("expected the overridden config kept, got %v", found.Data)
+	}
+	events = drainEvents(recorder)
+	if len(events) != 1 || !strings.HasPrefix(events[0], "Warning "+EventReasonManualOverride) {
+		t.Errorf("expected only a ManualOverride event, got %v", events)
+	}
+}
+
+func TestDriftedFields(t *testing.T) {
+	desired, err := NewDeployment(newTestBalancer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := desired.DeepCopy()
+	// the fields defaulted by the apiserver or added by others are not drifts
+	current.ResourceVersion = "42"
+	current.Annotations = map[string]string{"deployment.kubernetes.io/revision": "3"}
+	current.Spec.RevisionHistoryLimit = new(int32)
+	current.Spec.Template.Spec.Containers[0].TerminationMessagePath = "/dev/termination-log"
+	current.Status.ReadyReplicas = 1
+	if drifted, err := driftedFields(desired, current); err != nil || len(drifted) != 0 {
+		t.Errorf("expected no drift, got %v %v", drifted, err)
+	}
+
+	replicas := int32(5)
+	current.Spec.Replicas = &replicas
+	current.Spec.Template.Spec.Containers[0].Image = "nginx:latest"
+	current.Spec.Template.Spec.Volumes = nil
+	drifted, err := driftedFields(desired, current)
+	expected := []string{"spec.replicas", "spec.template.spec.containers[0].image", "spec.template.spec.volumes"}
+	if err != nil || strings.Join(drifted, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected the drifted fields %v, got %v %v", expected, drifted, err)
+	}
+}
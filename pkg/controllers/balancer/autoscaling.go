@@ -0,0 +1,122 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"context"
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// DefaultTargetCPUUtilizationPercentage is the CPU target of the HorizontalPodAutoscaler
+// if Balancer.Spec.Autoscaling sets neither a CPU target nor a custom metric.
+const DefaultTargetCPUUtilizationPercentage int32 = 80
+
+// syncHorizontalPodAutoscaler creates the HorizontalPodAutoscaler of the proxy deployment
+// when Balancer.Spec.Autoscaling is set, and deletes it otherwise.
+func (r *ReconcilerBalancer) syncHorizontalPodAutoscaler(balancer *exposerv1alpha1.Balancer) error {
+	hpa := NewHorizontalPodAutoscaler(balancer)
+
+	foundHpa := &autoscalingv2beta2.HorizontalPodAutoscaler{}
+	err := r.client.Get(context.Background(), types.NamespacedName{Namespace: balancer.Namespace, Name: HorizontalPodAutoscalerName(balancer)}, foundHpa)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	found := err == nil
+
+	if hpa == nil {
+		// not required (any more), delete the one created by balancer
+		if !found || !metav1.IsControlledBy(foundHpa, balancer) {
+			return nil
+		}
+		if err = r.client.Delete(context.Background(), foundHpa); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		r.recordChange(balancer, "HorizontalPodAutoscaler", foundHpa.Name, "deleted")
+		return nil
+	}
+
+	return r.apply(balancer, "HorizontalPodAutoscaler", hpa)
+}
+
+// NewHorizontalPodAutoscaler creates a new HorizontalPodAutoscaler targeting the proxy deployment of the Balancer.
+// It returns nil if Balancer.Spec.Autoscaling is not set.
+func NewHorizontalPodAutoscaler(balancer *exposerv1alpha1.Balancer) *autoscalingv2beta2.HorizontalPodAutoscaler {
+	autoscaling := balancer.Spec.Autoscaling
+	if autoscaling == nil {
+		return nil
+	}
+
+	var metrics []autoscalingv2beta2.MetricSpec
+	targetCPU := autoscaling.TargetCPUUtilizationPercentage
+	if targetCPU == nil && len(autoscaling.CustomMetrics) == 0 {
+		defaultTargetCPU := DefaultTargetCPUUtilizationPercentage
+		targetCPU = &defaultTargetCPU
+	}
+	if targetCPU != nil {
+		metrics = append(metrics, autoscalingv2beta2.MetricSpec{
+			Type: autoscalingv2beta2.ResourceMetricSourceType,
+			Resource: &autoscalingv2beta2.ResourceMetricSource{
+				Name: corev1.ResourceCPU,
+				Target: autoscalingv2beta2.MetricTarget{
+					Type:               autoscalingv2beta2.UtilizationMetricType,
+					AverageUtilization: targetCPU,
+				},
+			},
+		})
+	}
+	for _, customMetric := range autoscaling.CustomMetrics {
+		targetAverageValue := customMetric.TargetAverageValue.DeepCopy()
+		metrics = append(metrics, autoscalingv2beta2.MetricSpec{
+			Type: autoscalingv2beta2.PodsMetricSourceType,
+			Pods: &autoscalingv2beta2.PodsMetricSource{
+				Metric: autoscalingv2beta2.MetricIdentifier{Name: customMetric.Name},
+				Target: autoscalingv2beta2.MetricTarget{
+					Type:         autoscalingv2beta2.AverageValueMetricType,
+					AverageValue: &targetAverageValue,
+				},
+			},
+		})
+	}
+
+	minReplicas := ProxyReplicas(balancer)
+	return &autoscalingv2beta2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      HorizontalPodAutoscalerName(balancer),
+			Namespace: balancer.Namespace,
+			Labels:    NewPodLabels(balancer),
+		},
+		Spec: autoscalingv2beta2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2beta2.CrossVersionObjectReference{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       DeploymentName(balancer),
+			},
+			MinReplicas: &minReplicas,
+			MaxReplicas: autoscaling.MaxReplicas,
+			Metrics:     metrics,
+		},
+	}
+}
+
+func HorizontalPodAutoscalerName(balancer *exposerv1alpha1.Balancer) string {
+	return DeploymentName(balancer)
+}
@@ -0,0 +1,47 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"testing"
+)
+
+func TestNewHorizontalPodAutoscaler(t *testing.T) {
+	balancer := newTestBalancer()
+	if hpa := NewHorizontalPodAutoscaler(balancer); hpa != nil {
+		t.Errorf("expected no HorizontalPodAutoscaler without autoscaling, got %v", hpa)
+	}
+
+	minReplicas := int32(2)
+	balancer.Spec.Autoscaling = &exposerv1alpha1.AutoscalingSpec{
+		MinReplicas:   &minReplicas,
+		MaxReplicas:   10,
+		CustomMetrics: []exposerv1alpha1.CustomMetric{{Name: "nginx_active_connections", TargetAverageValue: resource.MustParse("100")}},
+	}
+	hpa := NewHorizontalPodAutoscaler(balancer)
+	if hpa == nil || *hpa.Spec.MinReplicas != 2 || hpa.Spec.MaxReplicas != 10 || hpa.Spec.ScaleTargetRef.Name != DeploymentName(balancer) {
+		t.Fatalf("expected a HorizontalPodAutoscaler scaling the proxy between 2 and 10, got %v", hpa)
+	}
+	if len(hpa.Spec.Metrics) != 1 || hpa.Spec.Metrics[0].Pods == nil {
+		t.Errorf("expected the custom metric only, got %v", hpa.Spec.Metrics)
+	}
+	if pdb := NewPodDisruptionBudget(balancer); pdb == nil {
+		t.Errorf("expected a PodDisruptionBudget while autoscaling")
+	}
+}
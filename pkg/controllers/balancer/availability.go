@@ -0,0 +1,149 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"context"
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// syncPodDisruptionBudget creates the PodDisruptionBudget of the proxy pods when there are more than one replica,
+// and deletes it otherwise.
+func (r *ReconcilerBalancer) syncPodDisruptionBudget(balancer *exposerv1alpha1.Balancer) error {
+	pdb := NewPodDisruptionBudget(balancer)
+
+	foundPdb := &policyv1.PodDisruptionBudget{}
+	err := r.client.Get(context.Background(), types.NamespacedName{Namespace: balancer.Namespace, Name: PodDisruptionBudgetName(balancer)}, foundPdb)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	found := err == nil
+
+	if pdb == nil {
+		// not required (any more), delete the one created by balancer
+		if !found || !metav1.IsControlledBy(foundPdb, balancer) {
+			return nil
+		}
+		if err = r.client.Delete(context.Background(), foundPdb); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		r.recordChange(balancer, "PodDisruptionBudget", foundPdb.Name, "deleted")
+		return nil
+	}
+
+	return r.apply(balancer, "PodDisruptionBudget", pdb)
+}
+
+// NewPodDisruptionBudget creates a new PodDisruptionBudget for the proxy pods of the Balancer.
+// It returns nil if no PodDisruptionBudget is required, i.e., there is at most one replica or it is disabled.
+func NewPodDisruptionBudget(balancer *exposerv1alpha1.Balancer) *policyv1.PodDisruptionBudget {
+	availability := balancer.Spec.Availability
+	if availability == nil {
+		availability = &exposerv1alpha1.AvailabilitySpec{}
+	}
+	if !multipleReplicas(balancer) || availability.DisablePodDisruptionBudget {
+		return nil
+	}
+
+	pdb := &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      PodDisruptionBudgetName(balancer),
+			Namespace: balancer.Namespace,
+			Labels:    NewPodLabels(balancer),
+		},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			Selector:       &metav1.LabelSelector{MatchLabels: NewPodLabels(balancer)},
+			MinAvailable:   availability.MinAvailable,
+			MaxUnavailable: availability.MaxUnavailable,
+		},
+	}
+	if pdb.Spec.MinAvailable == nil && pdb.Spec.MaxUnavailable == nil {
+		maxUnavailable := intstr.FromInt(1)
+		pdb.Spec.MaxUnavailable = &maxUnavailable
+	}
+	return pdb
+}
+
+// newTopologySpreadConstraints returns the topology spread constraints of the proxy pods.
+func newTopologySpreadConstraints(balancer *exposerv1alpha1.Balancer) []corev1.TopologySpreadConstraint {
+	availability := balancer.Spec.Availability
+	if availability == nil {
+		availability = &exposerv1alpha1.AvailabilitySpec{}
+	}
+	if !multipleReplicas(balancer) || availability.DisableTopologySpread {
+		return nil
+	}
+
+	selector := &metav1.LabelSelector{MatchLabels: NewPodLabels(balancer)}
+	if len(availability.TopologySpreadConstraints) > 0 {
+		constraints := make([]corev1.TopologySpreadConstraint, len(availability.TopologySpreadConstraints))
+		for i := range availability.TopologySpreadConstraints {
+			availability.TopologySpreadConstraints[i].DeepCopyInto(&constraints[i])
+			if constraints[i].LabelSelector == nil {
+				constraints[i].LabelSelector = selector.DeepCopy()
+			}
+		}
+		return constraints
+	}
+	return []corev1.TopologySpreadConstraint{
+		{
+			MaxSkew:           1,
+			TopologyKey:       corev1.LabelHostname,
+			WhenUnsatisfiable: corev1.ScheduleAnyway,
+			LabelSelector:     selector.DeepCopy(),
+		},
+		{
+			MaxSkew:           1,
+			TopologyKey:       corev1.LabelTopologyZone,
+			WhenUnsatisfiable: corev1.ScheduleAnyway,
+			LabelSelector:     selector.DeepCopy(),
+		},
+	}
+}
+
+// ProxyReplicas returns the desired number of the proxy pods,
+// which is the lower limit of the HorizontalPodAutoscaler while autoscaling.
+func ProxyReplicas(balancer *exposerv1alpha1.Balancer) int32 {
+	if autoscaling := balancer.Spec.Autoscaling; autoscaling != nil {
+		if autoscaling.MinReplicas == nil {
+			return 1
+		}
+		return *autoscaling.MinReplicas
+	}
+	if balancer.Spec.Replicas == nil {
+		return 1
+	}
+	return *balancer.Spec.Replicas
+}
+
+// multipleReplicas tells whether there may be more than one proxy pod.
+func multipleReplicas(balancer *exposerv1alpha1.Balancer) bool {
+	if autoscaling := balancer.Spec.Autoscaling; autoscaling != nil {
+		return autoscaling.MaxReplicas > 1
+	}
+	return ProxyReplicas(balancer) > 1
+}
+
+func PodDisruptionBudgetName(balancer *exposerv1alpha1.Balancer) string {
+	return DeploymentName(balancer)
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"testing"
+)
+
+func TestAvailability(t *testing.T) {
+	balancer := newTestBalancer()
+	if pdb := NewPodDisruptionBudget(balancer); pdb != nil {
+		t.Errorf("expected no PodDisruptionBudget for a single replica, got %v", pdb)
+	}
+	if constraints := newTopologySpreadConstraints(balancer); constraints != nil {
+		t.Errorf("expected no topology spread constraints for a single replica, got %v", constraints)
+	}
+
+	replicas := int32(3)
+	balancer.Spec.Replicas = &replicas
+	pdb := NewPodDisruptionBudget(balancer)
+	if pdb == nil || pdb.Spec.MaxUnavailable == nil || *pdb.Spec.MaxUnavailable != intstr.FromInt(1) {
+		t.Errorf("expected a PodDisruptionBudget with maxUnavailable 1, got %v", pdb)
+	}
+	dp, err := NewDeployment(balancer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *dp.Spec.Replicas != 3 || len(dp.Spec.Template.Spec.TopologySpreadConstraints) != 2 {
+		t.Errorf("expected 3 replicas spread across nodes and zones, got %d %v",
+			*dp.Spec.Replicas, dp.Spec.Template.Spec.TopologySpreadConstraints)
+	}
+
+	balancer.Spec.Availability = &exposerv1alpha1.AvailabilitySpec{DisablePodDisruptionBudget: true}
+	if pdb := NewPodDisruptionBudget(balancer); pdb != nil {
+		t.Errorf("expected no PodDisruptionBudget once disabled, got %v", pdb)
+	}
+}
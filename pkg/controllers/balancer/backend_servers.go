@@ -20,71 +20,108 @@ import (
 	"context"
 	"fmt"
 	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	appv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 	"reflect"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"strings"
 	"sync"
+	"time"
 )
 
+// DefaultDrainPeriod is the drain period of obsolete backend services if Balancer.Spec.DrainPeriod is not set.
+const DefaultDrainPeriod = 30 * time.Second
+
 // syncBalancerStatus sync Balancer.Status.
 func (r *ReconcilerBalancer) syncBalancerStatus(balancer *exposerv1alpha1.Balancer) error {
 	// get current backend services
 	var svcList corev1.ServiceList
-	if err := r.client.List(context.Background(), &svcList, client.MatchingLabels(NewServiceLabels(balancer))); err != nil {
+	if err := r.client.List(context.Background(), &svcList, client.InNamespace(balancer.Namespace),
+		client.MatchingLabels(NewServiceLabels(balancer))); err != nil {
 		return err
 	}
 
 	_, backendServicesToDelete, activeBackendServices := groupBackendServers(balancer, svcList.Items)
 
-	actualStatus := exposerv1alpha1.BalancerStatus{
-		ActiveBackendsNum:   int32(len(activeBackendServices)),
-		ObsoleteBackendsNum: int32(len(backendServicesToDelete)),
+	// fields which are not managed here (e.g. Rollout) are kept
+	actualStatus := balancer.Status.DeepCopy()
+	actualStatus.Selector = labels.SelectorFromSet(NewPodLabels(balancer)).String()
+	actualStatus.Replicas = 0
+	foundDp := &appv1.Deployment{}
+	err := r.client.Get(context.Background(), types.NamespacedName{Namespace: balancer.Namespace, Name: DeploymentName(balancer)}, foundDp)
+	if err == nil {
+		actualStatus.Replicas = foundDp.Status.Replicas
+	} else if !errors.IsNotFound(err) {
+		return err
 	}
+	actualStatus.ActiveBackendsNum = int32(len(activeBackendServices))
+	actualStatus.ObsoleteBackendsNum = int32(len(backendServicesToDelete))
+
+	readyEndpoints, err := r.readyEndpoints(balancer)
+	if err != nil {
+		return err
+	}
+	actualStatus.Backends = nil
+	for i, backend := range EffectiveBalancer(balancer, readyEndpoints).Spec.Backends {
+		// a backend is drained by the spec only, the rendered weight may be 0 for lack of ready endpoints
+		phase := exposerv1alpha1.BackendActive
+		if balancer.Spec.Backends[i].Weight == 0 {
+			phase = exposerv1alpha1.BackendDrained
+		}
+		actualStatus.Backends = append(actualStatus.Backends, exposerv1alpha1.BackendStatus{
+			Name:           backend.Name,
+			Phase:          phase,
+			Weight:         backend.Weight,
+			ReadyEndpoints: readyEndpoints[backend.Name],
+		})
+	}
+	// the obsolete backends keep draining since the proxy pods run the config without them, see startDrain
+	for _, svc := range backendServicesToDelete {
+		name := backendNameOf(balancer, svc.Name)
+		var drainingSince *v1.Time
+		if backendStatus := findBackendStatus(balancer.Status.Backends, name); backendStatus != nil &&
+			backendStatus.Phase == exposerv1alpha1.BackendDraining {
+			drainingSince = backendStatus.DrainingSince
+		}
+		actualStatus.Backends = append(actualStatus.Backends, exposerv1alpha1.BackendStatus{
+			Name:          name,
+			Phase:         exposerv1alpha1.BackendDraining,
+			DrainingSince: drainingSince,
+		})
+	}
+
+	recordBackendMetrics(balancer, actualStatus)
+
 	// nothing to do, return directly
-	if reflect.DeepEqual(balancer.Status, actualStatus) {
+	if reflect.DeepEqual(balancer.Status, *actualStatus) {
 		return nil
 	}
 
 	// status updating is required (note the assignment direction is opposite!)
 	newBalancer := balancer
-	newBalancer.Status = actualStatus
+	newBalancer.Status = *actualStatus
 	return r.client.Status().Update(context.Background(), newBalancer)
 }
 
-// syncBackendServices creates and delete backend services according to groupBackendServers result.
+// syncBackendServices creates (or updates) the backend services of the backends in Balancer.Spec.Backends.
+// The obsolete ones are left to syncObsoleteBackendServices, which deletes them after the proxy stops using them.
 func (r *ReconcilerBalancer) syncBackendServices(balancer *exposerv1alpha1.Balancer) error {
 	// get current backend services
 	var svcList corev1.ServiceList
-	if err := r.client.List(context.Background(), &svcList, client.MatchingLabels(NewServiceLabels(balancer))); err != nil {
+	if err := r.client.List(context.Background(), &svcList, client.InNamespace(balancer.Namespace),
+		client.MatchingLabels(NewServiceLabels(balancer))); err != nil {
 		return err
 	}
 
-	backendServicesToCreate, backendServicesToDelete, _ := groupBackendServers(balancer, svcList.Items)
+	backendServicesToCreate, _, _ := groupBackendServers(balancer, svcList.Items)
 
 	wg := sync.WaitGroup{}
 
-	// start coroutines to delete services-to-be-deleted
-	deleteErrCh := make(chan error, len(backendServicesToDelete))
-	wg.Add(len(backendServicesToDelete))
-	// This will cause error!
-	// for _, svcToDelete := range backendServicesToDelete {
-	// 	...
-	// }
-	for i := range backendServicesToDelete {
-		svcToDelete := backendServicesToDelete[i]
-		go func(svc *corev1.Service) {
-			defer wg.Done()
-			if err := r.client.Delete(context.Background(), svc); err != nil {
-				deleteErrCh <- err
-			}
-		}(&svcToDelete)
-	}
-	wg.Wait()
-
 	// start coroutines to create services-to-be-created
 	createErrCh := make(chan error, len(backendServicesToCreate))
 	wg.Add(len(backendServicesToCreate))
@@ -97,50 +134,131 @@ func (r *ReconcilerBalancer) syncBackendServices(balancer *exposerv1alpha1.Balan
 		go func(svc *corev1.Service) {
 			defer wg.Done()
 
-			// set balancer as the controller owner-reference of svc
-			if err := controllerutil.SetControllerReference(balancer, svc, r.scheme); err != nil {
+			// server-side apply, only the ports and the selector are owned by balancer
+			if err := r.apply(balancer, "Backend Service", svc); err != nil {
 				createErrCh <- err
-				return
 			}
+		}(&svcToCreate)
+	}
+	wg.Wait()
 
-			// create or update
-			foundSvc := &corev1.Service{}
-			err := r.client.Get(context.Background(), types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}, foundSvc)
-			if err != nil && errors.IsNotFound(err) {
-				err = r.client.Create(context.Background(), svc)
-				if err != nil {
-					createErrCh <- err
-				} else {
-					log.Info("Sync Backend Services", svc.Name, "created")
-				}
-				return
-			} else if err != nil {
-				createErrCh <- err
-				return
-			}
+	select {
+	case err := <-createErrCh:
+		return err
+	default:
+		return nil
+	}
+}
 
-			foundSvc.Spec.Ports = svc.Spec.Ports
-			foundSvc.Spec.Selector = svc.Spec.Selector
-			err = r.client.Update(context.Background(), foundSvc)
-			if err != nil {
-				createErrCh <- err
+// syncObsoleteBackendServices drains the backend services of the backends removed from Balancer.Spec.Backends,
+// and deletes them once their drain period expires. The drain of a service starts only after every proxy pod runs
+// the synced proxy configmap cm, which excludes the service, so that the proxy never forwards to a deleted service.
+// The returned result requeues the request until the proxy pods run cm, or the drain period of the next one expires.
+func (r *ReconcilerBalancer) syncObsoleteBackendServices(balancer *exposerv1alpha1.Balancer, cm *corev1.ConfigMap) (reconcile.Result, error) {
+	// get current backend services
+	var svcList corev1.ServiceList
+	if err := r.client.List(context.Background(), &svcList, client.InNamespace(balancer.Namespace),
+		client.MatchingLabels(NewServiceLabels(balancer))); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	_, backendServicesToDelete, _ := groupBackendServers(balancer, svcList.Items)
+	if len(backendServicesToDelete) == 0 {
+		return reconcile.Result{}, nil
+	}
+
+	var result reconcile.Result
+	running, err := r.proxiesRunConfig(balancer, cm)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if !running {
+		result.RequeueAfter = proxyStatusPollPeriod
+	} else if startDrain(balancer, backendServicesToDelete, v1.Now()) {
+		// record when the services started draining before deleting any of them
+		if err = r.client.Status().Update(context.Background(), balancer); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+	expiredServices, requeueAfter := drainExpiredServices(balancer, backendServicesToDelete, time.Now())
+
+	// start coroutines to delete services-to-be-deleted
+	wg := sync.WaitGroup{}
+	deleteErrCh := make(chan error, len(expiredServices))
+	wg.Add(len(expiredServices))
+	// This will cause error!
+	// for _, svcToDelete := range expiredServices {
+	// 	...
+	// }
+	for i := range expiredServices {
+		svcToDelete := expiredServices[i]
+		go func(svc *corev1.Service) {
+			defer wg.Done()
+			if err := r.client.Delete(context.Background(), svc); err != nil {
+				deleteErrCh <- err
 			} else {
-				log.Info("Sync Backend Services", foundSvc.Name, "updated")
+				r.recordChange(balancer, "Backend Service", svc.Name, "deleted")
 			}
-			return
-		}(&svcToCreate)
+		}(&svcToDelete)
 	}
 	wg.Wait()
 
 	// handle error if happened
 	select {
 	case err := <-deleteErrCh:
-		return err
-	case err := <-createErrCh:
-		return err
+		return reconcile.Result{}, err
 	default:
-		return r.syncBalancerStatus(balancer)
+		return earliestResult(result, reconcile.Result{RequeueAfter: requeueAfter}), nil
+	}
+}
+
+// startDrain starts the drain of the obsolete backend services at now in Balancer.Status.Backends,
+// unless they are draining already. It returns whether any drain is started.
+func startDrain(balancer *exposerv1alpha1.Balancer, obsoleteServices []corev1.Service, now v1.Time) bool {
+	started := false
+	for _, svc := range obsoleteServices {
+		name := backendNameOf(balancer, svc.Name)
+		backendStatus := findBackendStatus(balancer.Status.Backends, name)
+		if backendStatus == nil {
+			balancer.Status.Backends = append(balancer.Status.Backends, exposerv1alpha1.BackendStatus{Name: name})
+			backendStatus = &balancer.Status.Backends[len(balancer.Status.Backends)-1]
+		}
+		if backendStatus.Phase == exposerv1alpha1.BackendDraining && backendStatus.DrainingSince != nil {
+			continue
+		}
+		backendStatus.Phase = exposerv1alpha1.BackendDraining
+		backendStatus.Weight = 0
+		backendStatus.ReadyEndpoints = 0
+		backendStatus.DrainingSince = now.DeepCopy()
+		started = true
 	}
+	return started
+}
+
+// drainExpiredServices returns the obsolete backend services whose drain period has expired at now,
+// and how long to wait until the drain period of the next one expires.
+// The draining start time of each obsolete service is read from Balancer.Status.Backends,
+// a service which has not started draining never expires.
+func drainExpiredServices(balancer *exposerv1alpha1.Balancer, obsoleteServices []corev1.Service,
+	now time.Time) (expiredServices []corev1.Service, requeueAfter time.Duration) {
+
+	drainPeriod := DefaultDrainPeriod
+	if balancer.Spec.DrainPeriod != nil {
+		drainPeriod = balancer.Spec.DrainPeriod.Duration
+	}
+	for _, svc := range obsoleteServices {
+		backendStatus := findBackendStatus(balancer.Status.Backends, backendNameOf(balancer, svc.Name))
+		if backendStatus == nil || backendStatus.Phase != exposerv1alpha1.BackendDraining || backendStatus.DrainingSince == nil {
+			continue
+		}
+		remaining := backendStatus.DrainingSince.Time.Add(drainPeriod).Sub(now)
+		if remaining <= 0 {
+			expiredServices = append(expiredServices, svc)
+		} else if requeueAfter == 0 || remaining < requeueAfter {
+			requeueAfter = remaining
+		}
+	}
+	return
 }
 
 // groupBackendServers gets to-be-created backend services, to-be-deleted backend services,
@@ -148,16 +266,6 @@ func (r *ReconcilerBalancer) syncBackendServices(balancer *exposerv1alpha1.Balan
 func groupBackendServers(balancer *exposerv1alpha1.Balancer, currentBackendServices []corev1.Service) (backendServicesToCreate []corev1.Service,
 	backendServicesToDelete []corev1.Service, activeBackendServices []corev1.Service) {
 
-	var balancerPorts []corev1.ServicePort
-	for _, port := range balancer.Spec.Ports {
-		balancerPorts = append(balancerPorts, corev1.ServicePort{
-			Name:       port.Name,
-			Protocol:   corev1.Protocol(port.Protocol),
-			Port:       int32(port.Port), // exposed port of each backend service
-			TargetPort: port.TargetPort,  // exposed port of the outside Pods
-		})
-	}
-
 	// create each backend service
 	for _, backend := range balancer.Spec.Backends {
 		// selector example: {app: test, version: v1}
@@ -171,14 +279,14 @@ func groupBackendServers(balancer *exposerv1alpha1.Balancer, currentBackendServi
 		}
 		backendServicesToCreate = append(backendServicesToCreate, corev1.Service{
 			ObjectMeta: v1.ObjectMeta{
-				Name:      fmt.Sprintf("%s-%s-backend", balancer.Name, backend.Name),
+				Name:      BackendServiceName(balancer, backend.Name),
 				Namespace: balancer.Namespace,
 				Labels:    NewServiceLabels(balancer), // for annotating this is a service belongs to balancer
 			},
 			Spec: corev1.ServiceSpec{
 				Selector: selector,
 				Type:     corev1.ServiceTypeClusterIP,
-				Ports:    balancerPorts,
+				Ports:    backendServicePorts(balancer, backend),
 			},
 		})
 	}
@@ -202,3 +310,44 @@ func groupBackendServers(balancer *exposerv1alpha1.Balancer, currentBackendServi
 	}
 	return
 }
+
+// backendServicePorts returns the ports of the backend service of the given backend.
+// The targetPort of each balancer port is replaced by the one defined in backend.Ports, if any.
+// An unnamed override applies to the only balancer port.
+func backendServicePorts(balancer *exposerv1alpha1.Balancer, backend exposerv1alpha1.BackendSpec) []corev1.ServicePort {
+	var ports []corev1.ServicePort
+	for _, port := range balancer.Spec.Ports {
+		targetPort := port.TargetPort
+		for _, override := range backend.Ports {
+			if override.Name == port.Name || override.Name == "" && len(balancer.Spec.Ports) == 1 {
+				targetPort = override.TargetPort
+				break
+			}
+		}
+		ports = append(ports, corev1.ServicePort{
+			Name:       port.Name,
+			Protocol:   corev1.Protocol(port.Protocol),
+			Port:       int32(port.Port), // exposed port of each backend service
+			TargetPort: targetPort,       // exposed port of the outside Pods
+		})
+	}
+	return ports
+}
+
+func BackendServiceName(balancer *exposerv1alpha1.Balancer, backendName string) string {
+	return fmt.Sprintf("%s-%s-backend", balancer.Name, backendName)
+}
+
+// backendNameOf is the reverse of BackendServiceName.
+func backendNameOf(balancer *exposerv1alpha1.Balancer, serviceName string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(serviceName, balancer.Name+"-"), "-backend")
+}
+
+func findBackendStatus(backends []exposerv1alpha1.BackendStatus, name string) *exposerv1alpha1.BackendStatus {
+	for i := range backends {
+		if backends[i].Name == name {
+			return &backends[i]
+		}
+	}
+	return nil
+}
@@ -16,8 +16,185 @@ limitations under the License.
 
 package balancer
 
-import "testing"
+import (
+	"context"
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	appv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"testing"
+	"time"
+)
+
+func newTestBalancer() *exposerv1alpha1.Balancer {
+	return &exposerv1alpha1.Balancer{
+		ObjectMeta: metav1.ObjectMeta{Name: "example-balancer", Namespace: "default"},
+		Spec: exposerv1alpha1.BalancerSpec{
+			Selector: map[string]string{"app": "test"},
+			Ports: []exposerv1alpha1.BalancerPort{
+				{Name: "http", Protocol: exposerv1alpha1.TCP, Port: 80, TargetPort: intstr.FromInt(5678)},
+				{Name: "dns", Protocol: exposerv1alpha1.UDP, Port: 53, TargetPort: intstr.FromInt(5353)},
+			},
+			Backends: []exposerv1alpha1.BackendSpec{
+				{Name: "v1", Weight: 40, Selector: map[string]string{"version": "v1"}},
+				{
+					Name:     "v2",
+					Weight:   60,
+					Selector: map[string]string{"version": "v2"},
+					Ports: []exposerv1alpha1.BackendPort{
+						{Name: "http", TargetPort: intstr.FromString("web")},
+					},
+				},
+			},
+		},
+	}
+}
+
+func newTestScheme(t *testing.T) *runtime.Scheme {
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := exposerv1alpha1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
 
 func TestGroupServers(t *testing.T) {
-	// TODO
+	balancer := newTestBalancer()
+	current := []corev1.Service{
+		{ObjectMeta: metav1.ObjectMeta{Name: "example-balancer-v1-backend", Namespace: "default"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "example-balancer-v0-backend", Namespace: "default"}},
+	}
+
+	toCreate, toDelete, active := groupBackendServers(balancer, current)
+	if len(toCreate) != 2 {
+		t.Fatalf("expected 2 backend services to create, got %d", len(toCreate))
+	}
+	if len(toDelete) != 1 || toDelete[0].Name != "example-balancer-v0-backend" {
+		t.Errorf("expected example-balancer-v0-backend to be deleted, got %v", toDelete)
+	}
+	if len(active) != 1 || active[0].Name != "example-balancer-v1-backend" {
+		t.Errorf("expected example-balancer-v1-backend to be active, got %v", active)
+	}
+
+	expectedTargetPorts := map[string]map[string]intstr.IntOrString{
+		"example-balancer-v1-backend": {"http": intstr.FromInt(5678), "dns": intstr.FromInt(5353)},
+		"example-balancer-v2-backend": {"http": intstr.FromString("web"), "dns": intstr.FromInt(5353)},
+	}
+	for _, svc := range toCreate {
+		if svc.Spec.Selector["app"] != "test" {
+			t.Errorf("%s: expected selector to contain app=test, got %v", svc.Name, svc.Spec.Selector)
+		}
+		for _, port := range svc.Spec.Ports {
+			if expected := expectedTargetPorts[svc.Name][port.Name]; port.TargetPort != expected {
+				t.Errorf("%s/%s: expected targetPort %s, got %s", svc.Name, port.Name, expected.String(), port.TargetPort.String())
+			}
+		}
+	}
+}
+
+func TestBackendServicePortsUnnamedOverride(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.Ports = balancer.Spec.Ports[:1]
+	backend := exposerv1alpha1.BackendSpec{
+		Name:  "v3",
+		Ports: []exposerv1alpha1.BackendPort{{TargetPort: intstr.FromInt(8080)}},
+	}
+	// the unnamed override applies to the only balancer port
+	ports := backendServicePorts(balancer, backend)
+	if len(ports) != 1 || ports[0].TargetPort != intstr.FromInt(8080) {
+		t.Errorf("expected targetPort 8080, got %v", ports)
+	}
+}
+
+func TestDrainExpiredServices(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.DrainPeriod = &metav1.Duration{Duration: time.Minute}
+	now := time.Now()
+	balancer.Status.Backends = []exposerv1alpha1.BackendStatus{
+		{Name: "v0", Phase: exposerv1alpha1.BackendDraining, DrainingSince: &metav1.Time{Time: now.Add(-2 * time.Minute)}},
+		{Name: "v3", Phase: exposerv1alpha1.BackendDraining, DrainingSince: &metav1.Time{Time: now.Add(-20 * time.Second)}},
+		// the proxy pods are not running the config without v4 yet
+		{Name: "v4", Phase: exposerv1alpha1.BackendDraining},
+	}
+	obsolete := []corev1.Service{
+		{ObjectMeta: metav1.ObjectMeta{Name: "example-balancer-v0-backend", Namespace: "default"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "example-balancer-v3-backend", Namespace: "default"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "example-balancer-v4-backend", Namespace: "default"}},
+	}
+
+	expired, requeueAfter := drainExpiredServices(balancer, obsolete, now)
+	if len(expired) != 1 || expired[0].Name != "example-balancer-v0-backend" {
+		t.Errorf("expected only example-balancer-v0-backend to expire, got %v", expired)
+	}
+	if requeueAfter != 40*time.Second {
+		t.Errorf("expected to requeue after 40s, got %v", requeueAfter)
+	}
+}
+
+func TestSyncObsoleteBackendServices(t *testing.T) {
+	balancer := newTestBalancer()
+	obsolete := &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+		Name:      BackendServiceName(balancer, "v0"),
+		Namespace: balancer.Namespace,
+		Labels:    NewServiceLabels(balancer),
+	}}
+	dp, err := NewDeployment(balancer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp.Generation = 1
+	dp.Status = appv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 1, UpdatedReplicas: 1}
+	scheme := newTestScheme(t)
+	r := &ReconcilerBalancer{
+		client:   newTestClient(scheme, balancer, obsolete, dp),
+		scheme:   scheme,
+		recorder: record.NewFakeRecorder(100),
+	}
+	cm, err := r.syncConfigMap(balancer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the proxy pods run the config of the deployment created before, which may still forward to v0
+	result, err := r.syncObsoleteBackendServices(balancer, cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RequeueAfter != proxyStatusPollPeriod || findBackendStatus(balancer.Status.Backends, "v0") != nil {
+		t.Errorf("expected v0 to wait for the proxy pods, got %v and %v", result, balancer.Status.Backends)
+	}
+
+	// the rollout of the deployment with the new config completes
+	dp.Spec.Template.Annotations = map[string]string{exposerv1alpha1.ConfigMapHashKey: ConfigMapHash(cm)}
+	if err = r.client.Update(context.Background(), dp); err != nil {
+		t.Fatal(err)
+	}
+	if result, err = r.syncObsoleteBackendServices(balancer, cm); err != nil {
+		t.Fatal(err)
+	}
+	backendStatus := findBackendStatus(balancer.Status.Backends, "v0")
+	if backendStatus == nil || backendStatus.Phase != exposerv1alpha1.BackendDraining || backendStatus.DrainingSince == nil ||
+		result.RequeueAfter <= 0 || result.RequeueAfter > DefaultDrainPeriod {
+		t.Fatalf("expected v0 to start draining, got %v and %v", result, backendStatus)
+	}
+	if err = r.client.Get(context.Background(), client.ObjectKeyFromObject(obsolete), &corev1.Service{}); err != nil {
+		t.Errorf("expected v0 to be kept while draining, got %v", err)
+	}
+
+	backendStatus.DrainingSince = &metav1.Time{Time: time.Now().Add(-time.Minute)}
+	if _, err = r.syncObsoleteBackendServices(balancer, cm); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.client.Get(context.Background(), client.ObjectKeyFromObject(obsolete), &corev1.Service{}); !errors.IsNotFound(err) {
+		t.Errorf("expected v0 to be deleted once drained, got %v", err)
+	}
 }
@@ -19,9 +19,18 @@ package balancer
 import (
 	"context"
 	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/envoy"
+	"github.com/hliangzhao/balancer/pkg/xds"
+	appv1 "k8s.io/api/apps/v1"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	policyv1 "k8s.io/api/policy/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
@@ -38,13 +47,18 @@ type ReconcilerBalancer struct {
 	// client reads obj from the cache
 	client client.Client
 	scheme *runtime.Scheme
+	// recorder records the events of Balancer, e.g., the changes of the resources it manages
+	recorder record.EventRecorder
+	// xds serves the config of the envoy data plane, nil if it is disabled
+	xds *xds.Server
 }
 
 // newReconciler creates the ReconcilerBalancer with input controller-manager.
-func newReconciler(manager manager.Manager) reconcile.Reconciler {
+func newReconciler(manager manager.Manager) *ReconcilerBalancer {
 	return &ReconcilerBalancer{
-		client: manager.GetClient(),
-		scheme: manager.GetScheme(),
+		client:   manager.GetClient(),
+		scheme:   manager.GetScheme(),
+		recorder: manager.GetEventRecorderFor("balancer-controller"),
 	}
 }
 
@@ -57,35 +71,56 @@ func addReconciler(manager manager.Manager, r reconcile.Reconciler) error {
 	}
 
 	// takes events provided by a Source and uses the EventHandler to enqueue reconcile.Requests in response to the events.
-	if err = c.Watch(&source.Kind{Type: &exposerv1alpha1.Balancer{}}, &handler.EnqueueRequestForObject{}); err != nil {
+	if err = c.Watch(&source.Kind{Type: &exposerv1alpha1.Balancer{}}, &handler.EnqueueRequestForObject{}, balancerChanged); err != nil {
 		return err
 	}
-	// the changes of the configmap, pod, and svc which are created by balancer will also be enqueued
-	if err = c.Watch(&source.Kind{Type: &corev1.ConfigMap{}}, &handler.EnqueueRequestForOwner{
-		IsController: true,
-		OwnerType:    &exposerv1alpha1.Balancer{}},
-	); err != nil {
-		return err
+	// the changes of the resources created by balancer will also be enqueued, so that a deleted, scaled or
+	// edited one is repaired (the proxy pods are owned by the deployment rather than balancer)
+	for _, owned := range []client.Object{
+		&appv1.Deployment{},
+		&corev1.ConfigMap{},
+		&corev1.Service{},
+		&policyv1.PodDisruptionBudget{},
+		&autoscalingv2beta2.HorizontalPodAutoscaler{},
+	} {
+		if err = c.Watch(&source.Kind{Type: owned}, &handler.EnqueueRequestForOwner{
+			IsController: true,
+			OwnerType:    &exposerv1alpha1.Balancer{}},
+			ownedObjectChanged,
+		); err != nil {
+			return err
+		}
 	}
-	if err = c.Watch(&source.Kind{Type: &corev1.Pod{}}, &handler.EnqueueRequestForOwner{
-		IsController: true,
-		OwnerType:    &exposerv1alpha1.Balancer{}},
-	); err != nil {
+	// the changes of the endpoints behind backend services decide the weights when WeightMode is endpoints,
+	// and the upstream servers when UpstreamMode is endpoints
+	if err = c.Watch(&source.Kind{Type: &discoveryv1.EndpointSlice{}},
+		handler.EnqueueRequestsFromMapFunc(endpointSliceToBalancer), endpointsChanged); err != nil {
 		return err
 	}
-	if err = c.Watch(&source.Kind{Type: &corev1.Service{}}, &handler.EnqueueRequestForOwner{
-		IsController: true,
-		OwnerType:    &exposerv1alpha1.Balancer{}},
-	); err != nil {
+	// the image pull secrets of the proxy pods may be created after the Balancer, only their metadata is watched
+	if err = c.Watch(&source.Kind{Type: newSecretMetadata()},
+		handler.EnqueueRequestsFromMapFunc(secretToBalancers(manager.GetClient())),
+		secretReferenced(manager.GetClient())); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// Add creates a newly registered balancer-controller to controller-manager.
+// Add creates a newly registered balancer-controller to controller-manager,
+// along with the xDS server of the envoy data plane, served by the leader, unless XDSBindAddress is empty.
 func Add(manager manager.Manager) error {
-	return addReconciler(manager, newReconciler(manager))
+	r := newReconciler(manager)
+	if XDSBindAddress != "" {
+		r.xds = xds.NewServer(XDSBindAddress)
+		if err := manager.Add(r.xds); err != nil {
+			return err
+		}
+		if err := manager.Add(newXDSLeaderLabeler(manager)); err != nil {
+			return err
+		}
+	}
+	return addReconciler(manager, r)
 }
 
 // Here we provide a static check that ReconcilerBalancer satisfies reconcile.Reconciler interface.
@@ -99,11 +134,16 @@ var _ reconcile.Reconciler = &ReconcilerBalancer{}
 // +kubebuilder:rbac:groups=exposer.hliangzhao.io,resources=balancers/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get;list;watch;create;update;patch;delete
-// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;create;
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;create;patch
 // +kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
 // +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=replicasets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=autoscaling,resources=horizontalpodautoscalers,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=discovery.k8s.io,resources=endpointslices,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 
 // Reconcile reads the status of the Balancer object and makes changes toward to Balancer.Spec.
 // This func must be implemented to be a legal reconcile.Reconciler!
@@ -117,24 +157,86 @@ func (r *ReconcilerBalancer) Reconcile(context context.Context, request reconcil
 		// balancer not exist
 		if errors.IsNotFound(err) {
 			// the namespaced name in request is not found, return empty result and requeue the request
+			forgetBalancerMetrics(request.Namespace, request.Name)
+			if r.xds != nil {
+				r.xds.ClearResources(envoy.NodeCluster(&exposerv1alpha1.Balancer{ObjectMeta: v1.ObjectMeta{
+					Namespace: request.Namespace, Name: request.Name}}))
+			}
 			return reconcile.Result{}, nil
 		}
+		// never sync an empty Balancer, retry with backoff
+		return reconcile.Result{}, err
 	}
 
-	// Founded. Update SVCs, deployments, etc. according to the expected Balancer.
-	// If any error happens, the request would be requeue
-	if err := r.syncFrontendService(balancer); err != nil {
+	// Founded. Validate it firstly, an invalid Balancer keeps the last synced resources untouched.
+	valid, err := r.syncSpecValidCondition(balancer)
+	if err != nil {
 		return reconcile.Result{}, err
 	}
-	if err := r.syncDeployment(balancer); err != nil {
+	if !valid {
+		reqLogger.Info("Invalid Balancer", "message", meta.FindStatusCondition(balancer.Status.Conditions,
+			exposerv1alpha1.SpecValidCondition).Message)
 		return reconcile.Result{}, nil
 	}
-	if err := r.syncBackendServices(balancer); err != nil {
-		return reconcile.Result{}, nil
+
+	// the errors of the sync phases are aggregated, a failed phase only stops the phases depending on it
+	var errs syncErrors
+	failed := func(phase string, err error) bool {
+		if r.recordSync(balancer, phase, err) == nil {
+			return false
+		}
+		errs = append(errs, phaseError{phase: phase, err: err})
+		return true
 	}
-	if err := r.syncBalancerStatus(balancer); err != nil {
-		return reconcile.Result{}, nil
+
+	// Advance the rollout, which decides the weights to be rendered.
+	result, err := r.syncRollout(balancer)
+	if failed(phaseRollout, err) {
+		return r.finishSync(balancer, errs, reconcile.Result{})
+	}
+
+	// Update SVCs, deployments, etc. according to the expected Balancer.
+	// The backend services are synced before the configmap, so that the proxy never points to a service
+	// which is not created yet. The deployment mounts the synced configmap.
+	failed(phaseFrontendServices, r.syncFrontendServices(balancer))
+	var cm *corev1.ConfigMap
+	if !failed(phaseBackendServices, r.syncBackendServices(balancer)) {
+		cm, err = r.syncConfigMap(balancer)
+		if failed(phaseConfigMap, err) {
+			cm = nil
+		} else {
+			failed(phaseDeployment, r.syncDeployment(balancer, cm))
+			// the envoy proxy pods still run the served resources if they are not synced
+			if failed(phaseXDS, r.syncXDS(balancer)) {
+				cm = nil
+			}
+		}
+	}
+	failed(phasePodDisruptionBudget, r.syncPodDisruptionBudget(balancer))
+	failed(phaseHorizontalPodAutoscaler, r.syncHorizontalPodAutoscaler(balancer))
+	failed(phaseMetrics, r.syncMetrics(balancer))
+	// an obsolete backend service only starts draining after the proxy pods run the config without it
+	var reloadResult, drainResult reconcile.Result
+	if cm != nil {
+		reloadResult, err = r.syncProxyStatus(balancer)
+		if !failed(phaseProxyStatus, err) {
+			drainResult, err = r.syncObsoleteBackendServices(balancer, cm)
+			failed(phaseObsoleteBackendServices, err)
+		}
 	}
+	failed(phaseStatus, r.syncBalancerStatus(balancer))
+
+	return r.finishSync(balancer, errs, earliestResult(result, drainResult, reloadResult))
+}
 
-	return reconcile.Result{}, nil
+// earliestResult merges results into the one which requeues the request earliest.
+func earliestResult(results ...reconcile.Result) reconcile.Result {
+	var merged reconcile.Result
+	for _, result := range results {
+		merged.Requeue = merged.Requeue || result.Requeue
+		if result.RequeueAfter > 0 && (merged.RequeueAfter == 0 || result.RequeueAfter < merged.RequeueAfter) {
+			merged.RequeueAfter = result.RequeueAfter
+		}
+	}
+	return merged
 }
@@ -20,7 +20,9 @@ import (
 	"context"
 	"fmt"
 	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
-	"github.com/hliangzhao/balancer/pkg/controllers/balancer/nginx"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/dataplane"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/upstream"
+	"github.com/hliangzhao/balancer/pkg/reloader"
 	"hash/fnv"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -32,49 +34,74 @@ import (
 )
 
 // NewConfigMap creates a new configmap for the input Balancer instance.
-func NewConfigMap(balancer *exposerv1alpha1.Balancer) (*corev1.ConfigMap, error) {
+// The config is rendered with the backend weights of balancer as they are, see EffectiveBalancer,
+// and forwards the traffic to endpoints directly if it is not nil.
+func NewConfigMap(balancer *exposerv1alpha1.Balancer, endpoints upstream.Endpoints) (*corev1.ConfigMap, error) {
+	dataPlane := dataplane.For(balancer)
+	config := dataPlane.Render(balancer, endpoints)
 	return &corev1.ConfigMap{
 		ObjectMeta: v1.ObjectMeta{
 			Name:      ConfigMapName(balancer),
 			Namespace: balancer.Namespace,
+			// the same hash is reported by the reloader sidecar once the config is applied
+			Annotations: map[string]string{
+				exposerv1alpha1.ConfigMapHashKey: reloader.ConfigHash([]byte(config)),
+				exposerv1alpha1.WeightsKey:       formatWeights(balancer),
+			},
 		},
 		Data: map[string]string{
-			"nginx.conf": nginx.NewConfig(balancer),
+			dataPlane.ConfigFile(): config,
 		},
 	}, nil
 }
 
 // syncConfigMap sync the configmap that created by the deployment of Balancer.
 func (r *ReconcilerBalancer) syncConfigMap(balancer *exposerv1alpha1.Balancer) (*corev1.ConfigMap, error) {
-	cm, err := NewConfigMap(balancer)
+	readyEndpoints, err := r.readyEndpoints(balancer)
 	if err != nil {
 		return nil, err
 	}
+	endpoints, err := r.upstreamEndpoints(balancer)
+	if err != nil {
+		return nil, err
+	}
+	effective := EffectiveBalancer(balancer, readyEndpoints)
+	cm, err := NewConfigMap(effective, endpoints)
+	if err != nil {
+		return nil, err
+	}
+	configRendersTotal.WithLabelValues(balancer.Namespace, balancer.Name).Inc()
+	if err = r.syncConfigValidCondition(balancer, cm); err != nil {
+		return nil, err
+	}
 
-	// set balancer as the controller owner-reference of cm
+	// set balancer as the controller owner-reference of cm, which is a part of the hash of cm
 	if err := controllerutil.SetControllerReference(balancer, cm, r.scheme); err != nil {
 		return nil, err
 	}
 
-	foundCm := &corev1.ConfigMap{}
-	err = r.client.Get(context.Background(), types.NamespacedName{Namespace: cm.Namespace, Name: cm.Name}, foundCm)
-	if err != nil && errors.IsNotFound(err) {
-		// corresponding cm not foundCm in the cluster, create it with the newest cm
-		if err = r.client.Create(context.Background(), cm); err != nil {
-			return nil, err
-		}
-		log.Info("Sync ConfigMap", cm.Name, "created")
-		return cm, nil
-	} else if err != nil {
+	// the applied config is compared with the one in the cluster to tell the config changes
+	var foundCm *corev1.ConfigMap
+	current := &corev1.ConfigMap{}
+	err = r.client.Get(context.Background(), types.NamespacedName{Namespace: cm.Namespace, Name: cm.Name}, current)
+	if err == nil {
+		foundCm = current
+	} else if !errors.IsNotFound(err) {
 		return nil, err
 	}
 
-	// corresponding cm foundCm, update it with the newest cm
-	foundCm.Data = cm.Data
-	if err = r.client.Update(context.Background(), foundCm); err != nil {
+	// the returned cm is the desired one, whose hash changes only with the config
+	if err = r.apply(balancer, "ConfigMap", cm.DeepCopy()); err != nil {
 		return nil, err
 	}
-	log.Info("Sync ConfigMap", foundCm.Name, "updated")
+	if foundCm != nil && manuallyOverridden(foundCm) {
+		return cm, nil
+	}
+	if foundCm == nil || foundCm.Annotations[exposerv1alpha1.ConfigMapHashKey] != cm.Annotations[exposerv1alpha1.ConfigMapHashKey] {
+		configHashChangesTotal.WithLabelValues(balancer.Namespace, balancer.Name).Inc()
+		r.recordConfigChange(balancer, foundCm, cm)
+		r.recordUnservedBackends(balancer, effective, endpoints)
+	}
 	return cm, nil
 }
 
@@ -0,0 +1,74 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package dataplane abstracts the proxy which forwards the traffic of a Balancer to its backends.
+package dataplane
+
+import (
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/envoy"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/haproxy"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/native"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/nginx"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/upstream"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// DataPlane renders the config of a proxy implementation and describes how to run it.
+// The config is stored in the proxy configmap, which is mounted into the proxy container.
+type DataPlane interface {
+	// Render renders the proxy config with the backend weights of balancer as they are.
+	// The traffic is forwarded to the pod endpoints directly if endpoints is not nil, see Balancer.Spec.UpstreamMode.
+	Render(balancer *exposerv1alpha1.Balancer, endpoints upstream.Endpoints) string
+
+	// CheckConfig checks the rendered config before it is written to the proxy configmap,
+	// so that a config rejected by the proxy never reaches the proxy pods.
+	CheckConfig(config []byte) error
+
+	// Validate checks the constraints of balancer which cannot be served by the proxy.
+	Validate(balancer *exposerv1alpha1.Balancer) field.ErrorList
+
+	// ConfigDir is the directory where the proxy configmap is mounted.
+	ConfigDir() string
+
+	// ConfigFile is the name of the rendered config in the proxy configmap.
+	ConfigFile() string
+
+	// Container returns the proxy container without ports, probes and volume mounts,
+	// which are filled in by the balancer-controller.
+	Container() corev1.Container
+
+	// HealthCheck returns the port and the path of the built-in health listener of the rendered config.
+	HealthCheck() (port int32, path string)
+
+	// ReloadArgs returns the arguments of the reloader sidecar to reload the proxy in place.
+	ReloadArgs() []string
+}
+
+// For returns the data plane selected by Balancer.Spec.DataPlane.
+func For(balancer *exposerv1alpha1.Balancer) DataPlane {
+	switch balancer.Spec.DataPlane {
+	case exposerv1alpha1.DataPlaneHAProxy:
+		return haproxy.DataPlane{}
+	case exposerv1alpha1.DataPlaneNative:
+		return native.DataPlane{}
+	case exposerv1alpha1.DataPlaneEnvoy:
+		return envoy.DataPlane{}
+	default:
+		return nginx.DataPlane{}
+	}
+}
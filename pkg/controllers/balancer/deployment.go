@@ -19,76 +19,81 @@ package balancer
 import (
 	"context"
 	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/dataplane"
+	"github.com/hliangzhao/balancer/pkg/reloader"
 	appv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/types"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-func (r *ReconcilerBalancer) syncDeployment(balancer *exposerv1alpha1.Balancer) error {
-	// firstly, we sync configmap
-	cm, err := r.syncConfigMap(balancer)
-	if err != nil {
-		return err
-	}
-
-	// now we sync deployment
+// syncDeployment syncs the proxy deployment of Balancer, which mounts the synced proxy configmap cm.
+func (r *ReconcilerBalancer) syncDeployment(balancer *exposerv1alpha1.Balancer, cm *corev1.ConfigMap) error {
 	dp, err := NewDeployment(balancer)
 	if err != nil {
 		return err
 	}
-	annotations := map[string]string{
-		exposerv1alpha1.ConfigMapHashKey: ConfigMapHash(cm),
-	}
-	// always use the newest annotations
-	dp.Spec.Template.ObjectMeta.Annotations = annotations
-
-	// set balancer as the controller owner-reference of dp
-	if err = controllerutil.SetControllerReference(balancer, dp, r.scheme); err != nil {
+	if err = r.checkSecrets(balancer); err != nil {
 		return err
 	}
+	// always use the newest hash, which restarts the pods once the configmap changes,
+	// unless the reloader sidecar reloads the config in place
+	if balancer.Spec.ReloadMode != exposerv1alpha1.ReloadModeHotReload {
+		if dp.Spec.Template.ObjectMeta.Annotations == nil {
+			dp.Spec.Template.ObjectMeta.Annotations = map[string]string{}
+		}
+		dp.Spec.Template.ObjectMeta.Annotations[exposerv1alpha1.ConfigMapHashKey] = ConfigMapHash(cm)
+	}
 
-	foundDp := &appv1.Deployment{}
-	err = r.client.Get(context.Background(), types.NamespacedName{Namespace: balancer.Namespace, Name: balancer.Name}, foundDp)
-	if err != nil && errors.IsNotFound(err) {
-		// corresponding dp not found in the cluster, create it with the newest dp
-		if err = r.client.Create(context.Background(), dp); err != nil {
+	// the replica count is decided by the HorizontalPodAutoscaler while autoscaling, balancer only sets
+	// the initial one and applies the live one afterwards, since the replicas left out of the applied
+	// config would be reset to the default 1
+	if balancer.Spec.Autoscaling != nil {
+		current := &appv1.Deployment{}
+		err = r.client.Get(context.Background(), client.ObjectKeyFromObject(dp), current)
+		if err == nil {
+			dp.Spec.Replicas = current.Spec.Replicas
+		} else if !errors.IsNotFound(err) {
 			return err
 		}
-		log.Info("Sync Deployment", dp.Name, "created")
-		return nil
-	} else if err != nil {
-		return err
 	}
 
-	// corresponding dp found, update it with the newest dp
-	foundDp.Spec.Template = dp.Spec.Template
-	if err = r.client.Update(context.Background(), foundDp); err != nil {
-		return err
-	}
-	log.Info("Sync Deployment", foundDp.Name, "updated")
-	return nil
+	// server-side apply, the fields added by others (e.g., the restartedAt annotation of kubectl) are kept
+	return r.apply(balancer, "Deployment", dp)
 }
 
-// NewDeployment creates a new deployment (which controls one nginx pod) for the Balancer.
+const (
+	healthPortName   = "healthz"
+	reloaderPortName = "reloader"
+)
+
+// DefaultReloaderImage is the image of the reloader sidecar, which is shipped with the balancer-controller.
+const DefaultReloaderImage = "docker.io/hliangzhao97/balancer:latest"
+
+// ReloaderImage is the image of the reloader sidecar injected when Balancer.Spec.ReloadMode is HotReload.
+var ReloaderImage = DefaultReloaderImage
+
+// NewDeployment creates a new deployment (which controls the proxy pods) for the Balancer.
+// The proxy container is described by the data plane of the Balancer, and customized by Balancer.Spec.ProxyTemplate.
 func NewDeployment(balancer *exposerv1alpha1.Balancer) (*appv1.Deployment, error) {
-	replicas := int32(1)
+	replicas := ProxyReplicas(balancer)
 	labels := NewPodLabels(balancer)
-	nginxContainer := corev1.Container{
-		Name:  "nginx",
-		Image: "nginx:1.15.9",
-		Ports: []corev1.ContainerPort{{ContainerPort: 80}},
-		VolumeMounts: []corev1.VolumeMount{
-			{
-				Name:      ConfigMapName(balancer),
-				MountPath: "/etc/nginx",
-				ReadOnly:  true,
-			},
+	dataPlane := dataplane.For(balancer)
+	proxyContainer := dataPlane.Container()
+	proxyContainer.Ports = newContainerPorts(balancer)
+	proxyContainer.ReadinessProbe = newHealthProbe(balancer, 5, 5)
+	proxyContainer.LivenessProbe = newHealthProbe(balancer, 10, 10)
+	proxyContainer.VolumeMounts = []corev1.VolumeMount{
+		{
+			Name:      ConfigMapName(balancer),
+			MountPath: dataPlane.ConfigDir(),
+			ReadOnly:  true,
 		},
 	}
-	nginxVolume := corev1.Volume{
+	configVolume := corev1.Volume{
 		Name: ConfigMapName(balancer),
 		VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
 			LocalObjectReference: corev1.LocalObjectReference{
@@ -96,7 +101,7 @@ func NewDeployment(balancer *exposerv1alpha1.Balancer) (*appv1.Deployment, error
 			},
 		}},
 	}
-	return &appv1.Deployment{
+	dp := &appv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      DeploymentName(balancer),
 			Namespace: balancer.Namespace,
@@ -112,12 +117,148 @@ func NewDeployment(balancer *exposerv1alpha1.Balancer) (*appv1.Deployment, error
 					Labels:    labels,
 				},
 				Spec: corev1.PodSpec{
-					Containers: []corev1.Container{nginxContainer},
-					Volumes:    []corev1.Volume{nginxVolume},
+					Containers:                []corev1.Container{proxyContainer},
+					Volumes:                   []corev1.Volume{configVolume},
+					TopologySpreadConstraints: newTopologySpreadConstraints(balancer),
 				},
 			},
 		},
-	}, nil
+	}
+	applyProxyTemplate(&dp.Spec.Template, balancer.Spec.ProxyTemplate)
+	if balancer.Spec.ReloadMode == exposerv1alpha1.ReloadModeHotReload {
+		// the reloader signals the proxy master process, which requires a shared process namespace
+		shareProcessNamespace := true
+		dp.Spec.Template.Spec.ShareProcessNamespace = &shareProcessNamespace
+		dp.Spec.Template.Spec.Containers = append(dp.Spec.Template.Spec.Containers, newReloaderContainer(balancer))
+	}
+	if needsExporter(balancer) {
+		dp.Spec.Template.Spec.Containers = append(dp.Spec.Template.Spec.Containers, newExporterContainer(balancer))
+	}
+	return dp, nil
+}
+
+// newReloaderContainer returns the sidecar which reloads the proxy config in place once the configmap changes.
+func newReloaderContainer(balancer *exposerv1alpha1.Balancer) corev1.Container {
+	dataPlane := dataplane.For(balancer)
+	// the proxy master process runs as root, only the capability to signal it is kept
+	rootUser := int64(0)
+	runAsNonRoot := false
+	allowPrivilegeEscalation := false
+	return corev1.Container{
+		Name:    "reloader",
+		Image:   ReloaderImage,
+		Command: []string{"/reloader"},
+		Args:    dataPlane.ReloadArgs(),
+		Ports: []corev1.ContainerPort{
+			{
+				Name:          reloaderPortName,
+				ContainerPort: reloader.Port,
+				Protocol:      corev1.ProtocolTCP,
+			},
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      ConfigMapName(balancer),
+				MountPath: dataPlane.ConfigDir(),
+				ReadOnly:  true,
+			},
+		},
+		SecurityContext: &corev1.SecurityContext{
+			RunAsUser:                &rootUser,
+			RunAsNonRoot:             &runAsNonRoot,
+			AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+			Capabilities: &corev1.Capabilities{
+				Drop: []corev1.Capability{"ALL"},
+				Add:  []corev1.Capability{"KILL"},
+			},
+		},
+	}
+}
+
+// applyProxyTemplate overrides the generated pod template with the fields set in proxyTemplate.
+// The first container of template is the proxy container.
+func applyProxyTemplate(template *corev1.PodTemplateSpec, proxyTemplate *exposerv1alpha1.ProxyTemplate) {
+	if proxyTemplate == nil {
+		return
+	}
+
+	// the labels used by balancer to select the pods always win
+	labels := map[string]string{}
+	for k, v := range proxyTemplate.Labels {
+		labels[k] = v
+	}
+	for k, v := range template.Labels {
+		labels[k] = v
+	}
+	template.Labels = labels
+	if len(proxyTemplate.Annotations) > 0 {
+		if template.Annotations == nil {
+			template.Annotations = map[string]string{}
+		}
+		for k, v := range proxyTemplate.Annotations {
+			template.Annotations[k] = v
+		}
+	}
+
+	proxyContainer := &template.Spec.Containers[0]
+	if proxyTemplate.Image != "" {
+		proxyContainer.Image = proxyTemplate.Image
+	}
+	proxyContainer.ImagePullPolicy = proxyTemplate.ImagePullPolicy
+	proxyContainer.Resources = *proxyTemplate.Resources.DeepCopy()
+	if proxyTemplate.ContainerSecurityContext != nil {
+		proxyContainer.SecurityContext = proxyTemplate.ContainerSecurityContext.DeepCopy()
+	}
+
+	podSpec := &template.Spec
+	podSpec.NodeSelector = proxyTemplate.NodeSelector
+	podSpec.Tolerations = proxyTemplate.Tolerations
+	podSpec.Affinity = proxyTemplate.Affinity.DeepCopy()
+	podSpec.PriorityClassName = proxyTemplate.PriorityClassName
+	podSpec.ServiceAccountName = proxyTemplate.ServiceAccountName
+	podSpec.ImagePullSecrets = proxyTemplate.ImagePullSecrets
+	podSpec.SecurityContext = proxyTemplate.SecurityContext.DeepCopy()
+}
+
+// newContainerPorts returns the ports of the proxy container, i.e., every balancer port and the health port.
+func newContainerPorts(balancer *exposerv1alpha1.Balancer) []corev1.ContainerPort {
+	var ports []corev1.ContainerPort
+	for _, port := range balancer.Spec.Ports {
+		protocol := corev1.Protocol(port.Protocol)
+		if protocol == "" {
+			protocol = corev1.ProtocolTCP
+		}
+		containerPort := corev1.ContainerPort{
+			ContainerPort: int32(port.Port),
+			Protocol:      protocol,
+		}
+		// the name of a container port is more restricted than the one of a service port
+		if port.Name != "" && len(validation.IsValidPortName(port.Name)) == 0 {
+			containerPort.Name = port.Name
+		}
+		ports = append(ports, containerPort)
+	}
+	healthPort, _ := dataplane.For(balancer).HealthCheck()
+	return append(ports, corev1.ContainerPort{
+		Name:          healthPortName,
+		ContainerPort: healthPort,
+		Protocol:      corev1.ProtocolTCP,
+	})
+}
+
+// newHealthProbe returns a probe against the built-in health listener of the proxy config.
+func newHealthProbe(balancer *exposerv1alpha1.Balancer, initialDelaySeconds, periodSeconds int32) *corev1.Probe {
+	_, healthPath := dataplane.For(balancer).HealthCheck()
+	return &corev1.Probe{
+		Handler: corev1.Handler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path: healthPath,
+				Port: intstr.FromString(healthPortName),
+			},
+		},
+		InitialDelaySeconds: initialDelaySeconds,
+		PeriodSeconds:       periodSeconds,
+	}
 }
 
 func DeploymentName(balancer *exposerv1alpha1.Balancer) string {
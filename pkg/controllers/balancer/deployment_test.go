@@ -0,0 +1,190 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"context"
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	appv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/tools/record"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"testing"
+)
+
+func TestNewDeploymentWithProxyTemplate(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.ProxyTemplate = &exposerv1alpha1.ProxyTemplate{
+		Labels: map[string]string{
+			"tier":                      "edge",
+			exposerv1alpha1.BalancerKey: "hijacked",
+		},
+		Image: "nginx:1.21",
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m")},
+		},
+		NodeSelector:      map[string]string{"node-role": "edge"},
+		Tolerations:       []corev1.Toleration{{Key: "edge", Operator: corev1.TolerationOpExists}},
+		PriorityClassName: "system-cluster-critical",
+	}
+
+	dp, err := NewDeployment(balancer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := dp.Spec.Template
+	if template.Labels[exposerv1alpha1.BalancerKey] != balancer.Name || template.Labels["tier"] != "edge" {
+		t.Errorf("expected the selector labels to win over the extra labels, got %v", template.Labels)
+	}
+	for k, v := range dp.Spec.Selector.MatchLabels {
+		if template.Labels[k] != v {
+			t.Errorf("expected the pod template to match the selector, got %v", template.Labels)
+		}
+	}
+	proxy := template.Spec.Containers[0]
+	if proxy.Image != "nginx:1.21" || proxy.Resources.Requests.Cpu().String() != "500m" {
+		t.Errorf("expected the proxy container customized, got %s %v", proxy.Image, proxy.Resources)
+	}
+	if template.Spec.NodeSelector["node-role"] != "edge" || len(template.Spec.Tolerations) != 1 ||
+		template.Spec.PriorityClassName != "system-cluster-critical" {
+		t.Errorf("expected the pod spec customized, got %v", template.Spec)
+	}
+}
+
+func TestNewDeploymentContainerPorts(t *testing.T) {
+	dp, err := NewDeployment(newTestBalancer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := dp.Spec.Template.Spec.Containers[0]
+	expected := []corev1.ContainerPort{
+		{Name: "http", ContainerPort: 80, Protocol: corev1.ProtocolTCP},
+		{Name: "dns", ContainerPort: 53, Protocol: corev1.ProtocolUDP},
+		{Name: "healthz", ContainerPort: 8099, Protocol: corev1.ProtocolTCP},
+	}
+	if !reflect.DeepEqual(proxy.Ports, expected) {
+		t.Errorf("expected container ports %v, got %v", expected, proxy.Ports)
+	}
+	if proxy.ReadinessProbe == nil || proxy.LivenessProbe == nil {
+		t.Errorf("expected the readiness and liveness probes")
+	}
+}
+
+func TestNewDeploymentWithHotReload(t *testing.T) {
+	balancer := newTestBalancer()
+	dp, err := NewDeployment(balancer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dp.Spec.Template.Spec.Containers) != 1 || dp.Spec.Template.Spec.ShareProcessNamespace != nil {
+		t.Errorf("expected no reloader sidecar by default, got %v", dp.Spec.Template.Spec)
+	}
+
+	balancer.Spec.ReloadMode = exposerv1alpha1.ReloadModeHotReload
+	balancer.Spec.ProxyTemplate = &exposerv1alpha1.ProxyTemplate{Image: "nginx:1.21"}
+	dp, err = NewDeployment(balancer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	podSpec := dp.Spec.Template.Spec
+	if len(podSpec.Containers) != 2 || podSpec.ShareProcessNamespace == nil || !*podSpec.ShareProcessNamespace {
+		t.Fatalf("expected the reloader sidecar sharing the process namespace, got %v", podSpec)
+	}
+	if podSpec.Containers[0].Image != "nginx:1.21" || podSpec.Containers[1].Image != ReloaderImage {
+		t.Errorf("expected the proxy template applied to the proxy container only, got %s and %s",
+			podSpec.Containers[0].Image, podSpec.Containers[1].Image)
+	}
+}
+
+func TestNewDeploymentWithMetrics(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.Metrics = &exposerv1alpha1.MetricsSpec{}
+	dp, err := NewDeployment(balancer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	containers := dp.Spec.Template.Spec.Containers
+	if len(containers) != 2 || containers[1].Name != "exporter" || containers[1].Image != ExporterImage {
+		t.Fatalf("expected the exporter sidecar, got %v", containers)
+	}
+	if containers[1].Ports[0].Name != metricsPortName {
+		t.Errorf("expected the exporter to serve the metrics port, got %v", containers[1].Ports)
+	}
+
+	// the native proxy exports its own metrics
+	balancer.Spec.DataPlane = exposerv1alpha1.DataPlaneNative
+	if dp, err = NewDeployment(balancer); err != nil {
+		t.Fatal(err)
+	}
+	if len(dp.Spec.Template.Spec.Containers) != 1 {
+		t.Errorf("expected no exporter sidecar for the native proxy, got %v", dp.Spec.Template.Spec.Containers)
+	}
+}
+
+// recordingClient records the deployments applied by balancer.
+type recordingClient struct {
+	client.Client
+	applied []*appv1.Deployment
+}
+
+func (c *recordingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if dp, ok := obj.(*appv1.Deployment); ok && patch == client.Apply {
+		c.applied = append(c.applied, dp.DeepCopy())
+	}
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func TestSyncDeploymentKeepsAutoscaledReplicas(t *testing.T) {
+	balancer := newTestBalancer()
+	minReplicas := int32(2)
+	balancer.Spec.Autoscaling = &exposerv1alpha1.AutoscalingSpec{MinReplicas: &minReplicas, MaxReplicas: 5}
+	scheme := newTestScheme(t)
+	recording := &recordingClient{Client: newTestClient(scheme, balancer)}
+	r := &ReconcilerBalancer{client: recording, scheme: scheme, recorder: record.NewFakeRecorder(10)}
+
+	cm, err := r.syncConfigMap(balancer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.syncDeployment(balancer, cm); err != nil {
+		t.Fatal(err)
+	}
+	if replicas := recording.applied[0].Spec.Replicas; replicas == nil || *replicas != minReplicas {
+		t.Fatalf("expected the initial replicas %d, got %v", minReplicas, replicas)
+	}
+
+	// the HorizontalPodAutoscaler scales the deployment out
+	found := &appv1.Deployment{}
+	if err = r.client.Get(context.Background(), client.ObjectKeyFromObject(recording.applied[0]), found); err != nil {
+		t.Fatal(err)
+	}
+	scaled := int32(4)
+	found.Spec.Replicas = &scaled
+	if err = r.client.Update(context.Background(), found); err != nil {
+		t.Fatal(err)
+	}
+
+	// the live replicas are applied, which would be reset to 1 if they were left out
+	if err = r.syncDeployment(balancer, cm); err != nil {
+		t.Fatal(err)
+	}
+	if replicas := recording.applied[1].Spec.Replicas; replicas == nil || *replicas != scaled {
+		t.Errorf("expected the live replicas %d applied, got %v", scaled, replicas)
+	}
+}
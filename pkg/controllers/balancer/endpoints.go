@@ -0,0 +1,144 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"context"
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/upstream"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"net"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sort"
+	"strconv"
+)
+
+// readyEndpoints returns the number of ready endpoints behind the backend service of each backend.
+func (r *ReconcilerBalancer) readyEndpoints(balancer *exposerv1alpha1.Balancer) (map[string]int32, error) {
+	counts := map[string]int32{}
+	for _, backend := range balancer.Spec.Backends {
+		slices, err := r.backendEndpointSlices(balancer, backend.Name)
+		if err != nil {
+			return nil, err
+		}
+		counts[backend.Name] = countReadyEndpoints(slices)
+	}
+	return counts, nil
+}
+
+// upstreamEndpoints returns the addresses of the ready endpoints behind the backend service of each backend,
+// which the proxy forwards the traffic to directly. It returns nil unless Spec.UpstreamMode is endpoints.
+func (r *ReconcilerBalancer) upstreamEndpoints(balancer *exposerv1alpha1.Balancer) (upstream.Endpoints, error) {
+	if balancer.Spec.UpstreamMode != exposerv1alpha1.UpstreamModeEndpoints {
+		return nil, nil
+	}
+	endpoints := upstream.Endpoints{}
+	for _, backend := range balancer.Spec.Backends {
+		slices, err := r.backendEndpointSlices(balancer, backend.Name)
+		if err != nil {
+			return nil, err
+		}
+		endpoints[backend.Name] = readyAddresses(slices)
+	}
+	return endpoints, nil
+}
+
+func (r *ReconcilerBalancer) backendEndpointSlices(balancer *exposerv1alpha1.Balancer, backendName string) ([]discoveryv1.EndpointSlice, error) {
+	var sliceList discoveryv1.EndpointSliceList
+	if err := r.client.List(context.Background(), &sliceList, client.InNamespace(balancer.Namespace),
+		client.MatchingLabels{discoveryv1.LabelServiceName: BackendServiceName(balancer, backendName)}); err != nil {
+		return nil, err
+	}
+	return sliceList.Items, nil
+}
+
+// readyAddresses returns the sorted addresses (ip:port) of the ready endpoints in slices, by the name of the port.
+// The port of an endpoint is the targetPort of the backend service resolved for its pod.
+// The IPv4 endpoints are preferred to the IPv6 ones of the same pods (dual-stack), and the FQDN ones are skipped.
+func readyAddresses(slices []discoveryv1.EndpointSlice) map[string][]string {
+	byAddressType := map[discoveryv1.AddressType]map[string][]string{}
+	for _, slice := range slices {
+		if slice.AddressType != discoveryv1.AddressTypeIPv4 && slice.AddressType != discoveryv1.AddressTypeIPv6 {
+			continue
+		}
+		addresses := byAddressType[slice.AddressType]
+		if addresses == nil {
+			addresses = map[string][]string{}
+			byAddressType[slice.AddressType] = addresses
+		}
+		for _, endpoint := range slice.Endpoints {
+			// a nil ready condition should be interpreted as ready
+			if len(endpoint.Addresses) == 0 || endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			for _, port := range slice.Ports {
+				// the unnamed ports are skipped, since every port of a backend service is named after a balancer port
+				if port.Name == nil || *port.Name == "" || port.Port == nil {
+					continue
+				}
+				addresses[*port.Name] = append(addresses[*port.Name],
+					net.JoinHostPort(endpoint.Addresses[0], strconv.Itoa(int(*port.Port))))
+			}
+		}
+	}
+
+	addresses := byAddressType[discoveryv1.AddressTypeIPv4]
+	if len(addresses) == 0 {
+		addresses = byAddressType[discoveryv1.AddressTypeIPv6]
+	}
+	for _, portAddresses := range addresses {
+		sort.Strings(portAddresses)
+	}
+	return addresses
+}
+
+// countReadyEndpoints counts the ready endpoints in slices.
+// An endpoint which appears in the slices of different address types (dual-stack) is counted once,
+// and the one with neither a target reference nor an address is skipped since it cannot be told apart.
+func countReadyEndpoints(slices []discoveryv1.EndpointSlice) int32 {
+	ready := map[string]struct{}{}
+	for _, slice := range slices {
+		for _, endpoint := range slice.Endpoints {
+			// a nil ready condition should be interpreted as ready
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			var key string
+			if endpoint.TargetRef != nil {
+				key = string(endpoint.TargetRef.UID)
+			} else if len(endpoint.Addresses) > 0 {
+				key = endpoint.Addresses[0]
+			} else {
+				continue
+			}
+			ready[key] = struct{}{}
+		}
+	}
+	return int32(len(ready))
+}
+
+// endpointSliceToBalancer maps an EndpointSlice of a backend service to the Balancer it belongs to.
+// The EndpointSlice controller copies the labels of the backend service (which includes the name of Balancer)
+// to the EndpointSlices.
+func endpointSliceToBalancer(obj client.Object) []reconcile.Request {
+	name, ok := obj.GetLabels()[exposerv1alpha1.BalancerKey]
+	if !ok {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{Namespace: obj.GetNamespace(), Name: name}}}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/nginx"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestEndpointSlice(name, serviceName string, addressType discoveryv1.AddressType, port int32,
+	ready bool, addresses ...string) *discoveryv1.EndpointSlice {
+
+	portName := "http"
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: serviceName},
+		},
+		AddressType: addressType,
+		Ports:       []discoveryv1.EndpointPort{{Name: &portName, Port: &port}},
+	}
+	for _, address := range addresses {
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+			Addresses:  []string{address},
+			Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+		})
+	}
+	return slice
+}
+
+func TestReadyAddresses(t *testing.T) {
+	slices := []discoveryv1.EndpointSlice{
+		*newTestEndpointSlice("v1-ipv6", "v1", discoveryv1.AddressTypeIPv6, 5678, true, "fd00::1"),
+		*newTestEndpointSlice("v1-b", "v1", discoveryv1.AddressTypeIPv4, 5678, true, "10.0.0.2"),
+		*newTestEndpointSlice("v1-a", "v1", discoveryv1.AddressTypeIPv4, 5678, true, "10.0.0.1"),
+		*newTestEndpointSlice("v1-c", "v1", discoveryv1.AddressTypeIPv4, 5678, false, "10.0.0.3"),
+	}
+	// the IPv4 endpoints are preferred, and the not ready ones are skipped
+	expected := map[string][]string{"http": {"10.0.0.1:5678", "10.0.0.2:5678"}}
+	if addresses := readyAddresses(slices); !reflect.DeepEqual(addresses, expected) {
+		t.Errorf("expected %v, got %v", expected, addresses)
+	}
+
+	expected = map[string][]string{"http": {"[fd00::1]:5678"}}
+	if addresses := readyAddresses(slices[:1]); !reflect.DeepEqual(addresses, expected) {
+		t.Errorf("expected %v, got %v", expected, addresses)
+	}
+
+	// the unnamed ports are skipped
+	unnamed := newTestEndpointSlice("v1-d", "v1", discoveryv1.AddressTypeIPv4, 5678, true, "10.0.0.4")
+	portName, port := "", int32(8080)
+	unnamed.Ports = append(unnamed.Ports, discoveryv1.EndpointPort{Name: &portName, Port: &port})
+	expected = map[string][]string{"http": {"10.0.0.4:5678"}}
+	if addresses := readyAddresses([]discoveryv1.EndpointSlice{*unnamed}); !reflect.DeepEqual(addresses, expected) {
+		t.Errorf("expected %v, got %v", expected, addresses)
+	}
+}
+
+func TestCountReadyEndpoints(t *testing.T) {
+	slices := []discoveryv1.EndpointSlice{
+		*newTestEndpointSlice("v1-a", "v1", discoveryv1.AddressTypeIPv4, 5678, true, "10.0.0.1", "10.0.0.2"),
+		*newTestEndpointSlice("v1-b", "v1", discoveryv1.AddressTypeIPv4, 5678, false, "10.0.0.3"),
+	}
+	// the endpoints with neither a target reference nor an address are skipped rather than counted as one
+	slices[0].Endpoints = append(slices[0].Endpoints, discoveryv1.Endpoint{}, discoveryv1.Endpoint{})
+	if count := countReadyEndpoints(slices); count != 2 {
+		t.Errorf("expected 2 ready endpoints, got %d", count)
+	}
+}
+
+func TestSyncConfigMapWithEndpointsUpstream(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.UpstreamMode = exposerv1alpha1.UpstreamModeEndpoints
+	balancer.Spec.ReloadMode = exposerv1alpha1.ReloadModeHotReload
+	scheme := newTestScheme(t)
+	r := &ReconcilerBalancer{
+		client: newTestClient(scheme, balancer,
+			newTestEndpointSlice("v1", BackendServiceName(balancer, "v1"), discoveryv1.AddressTypeIPv4, 5678, true,
+				"10.0.0.1", "10.0.0.2"),
+			newTestEndpointSlice("v2", BackendServiceName(balancer, "v2"), discoveryv1.AddressTypeIPv4, 8080, true,
+				"10.0.1.1"),
+		),
+		scheme:   scheme,
+		recorder: record.NewFakeRecorder(100),
+	}
+
+	cm, err := r.syncConfigMap(balancer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := cm.Data[nginx.ConfigFile]
+	// the weights 40:60 of v1 and v2 are kept by 2 endpoints of 40 and 1 endpoint of 120
+	for _, server := range []string{
+		"server 10.0.0.1:5678 weight=40;",
+		"server 10.0.0.2:5678 weight=40;",
+		"server 10.0.1.1:8080 weight=120;",
+		// the dns port has no endpoints, which falls back to the backend services
+		"server example-balancer-v1-backend:53 weight=40;",
+	} {
+		if !strings.Contains(config, server) {
+			t.Errorf("expected %q in the config, got:\n%s", server, config)
+		}
+	}
+}
+
+func TestSyncConfigMapWithEmptyBackend(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.UpstreamMode = exposerv1alpha1.UpstreamModeEndpoints
+	balancer.Spec.ReloadMode = exposerv1alpha1.ReloadModeHotReload
+	scheme := newTestScheme(t)
+	recorder := record.NewFakeRecorder(100)
+	r := &ReconcilerBalancer{
+		client: newTestClient(scheme, balancer,
+			newTestEndpointSlice("v1", BackendServiceName(balancer, "v1"), discoveryv1.AddressTypeIPv4, 5678, true,
+				"10.0.0.1"),
+			newTestEndpointSlice("v2", BackendServiceName(balancer, "v2"), discoveryv1.AddressTypeIPv4, 8080, false,
+				"10.0.1.1"),
+		),
+		scheme:   scheme,
+		recorder: recorder,
+	}
+
+	cm, err := r.syncConfigMap(balancer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// v2 has no ready endpoints, which receives no traffic of the http port instead of falling back to its service
+	config := cm.Data[nginx.ConfigFile]
+	if !strings.Contains(config, "server 10.0.0.1:5678 weight=40;") || strings.Contains(config, "example-balancer-v2-backend:80") {
+		t.Errorf("expected only the endpoint of v1 for the http port, got:\n%s", config)
+	}
+	found := false
+	for _, event := range drainEvents(recorder) {
+		if strings.HasPrefix(event, "Warning "+EventReasonNoReadyEndpoints) && strings.Contains(event, "Backend v2") &&
+			strings.Contains(event, "port http") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected a NoReadyEndpoints event of v2")
+	}
+}
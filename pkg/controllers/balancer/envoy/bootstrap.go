@@ -0,0 +1,188 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package envoy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	bootstrapv3 "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	routerv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
+	hcmv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	httpv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	balancerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"net"
+	"strconv"
+)
+
+const (
+	// HealthPort is the port of the built-in health listener, which is used by the probes of the proxy container.
+	HealthPort int32 = 8099
+	// HealthPath is the path of the built-in health listener.
+	HealthPath = "/healthz"
+	// XDSCluster is the name of the static cluster of the xDS server in the bootstrap config.
+	XDSCluster = "xds_cluster"
+	// DefaultXDSAddress is the address of the xDS server deployed with the balancer-controller (see config/manager).
+	DefaultXDSAddress = "balancer-controller-manager-xds-service.balancer-system.svc:18000"
+)
+
+var (
+	// Image is the image of the proxy container if Balancer.Spec.ProxyTemplate does not specify one.
+	Image = DefaultImage
+	// XDSAddress is the address (host:port) of the xDS server which the proxy pods are bootstrapped to.
+	XDSAddress = DefaultXDSAddress
+)
+
+// NodeCluster returns the cluster of the envoy nodes of balancer, by which the xDS server picks the resources
+// served to a node. The ID of a node is the name of its proxy pod.
+func NodeCluster(balancer *balancerv1alpha1.Balancer) string {
+	return balancer.Namespace + "/" + balancer.Name
+}
+
+// NewBootstrap generates the `envoy.json` with the given Balancer instance.
+// The listeners and the clusters of the balancer ports are fetched from the xDS server over ADS,
+// the bootstrap config only holds the cluster of the xDS server and the health listener, e.g.:
+// ===================== envoy.json =====================
+// {
+//   "node": {"cluster": "default/example-balancer"},
+//   "static_resources": {
+//     "listeners": [{"name": "healthz", ...}],
+//     "clusters": [{"name": "xds_cluster", ...}]
+//   },
+//   "dynamic_resources": {
+//     "lds_config": {"ads": {}, "resource_api_version": "V3"},
+//     "cds_config": {"ads": {}, "resource_api_version": "V3"},
+//     "ads_config": {"api_type": "GRPC", "transport_api_version": "V3", ...}
+//   }
+// }
+// ======================================================
+// Envoy starts the health listener only after the initial listeners and clusters are fetched,
+// thus a proxy pod is not ready until it receives its config from the xDS server.
+func NewBootstrap(balancer *balancerv1alpha1.Balancer) string {
+	ads := &corev3.ConfigSource{
+		ConfigSourceSpecifier: &corev3.ConfigSource_Ads{Ads: &corev3.AggregatedConfigSource{}},
+		ResourceApiVersion:    corev3.ApiVersion_V3,
+	}
+	bootstrap := &bootstrapv3.Bootstrap{
+		Node: &corev3.Node{Cluster: NodeCluster(balancer)},
+		StaticResources: &bootstrapv3.Bootstrap_StaticResources{
+			Listeners: []*listenerv3.Listener{newHealthListener()},
+			Clusters:  []*clusterv3.Cluster{newXDSCluster()},
+		},
+		DynamicResources: &bootstrapv3.Bootstrap_DynamicResources{
+			LdsConfig: ads,
+			CdsConfig: ads,
+			AdsConfig: &corev3.ApiConfigSource{
+				ApiType:             corev3.ApiConfigSource_GRPC,
+				TransportApiVersion: corev3.ApiVersion_V3,
+				GrpcServices: []*corev3.GrpcService{{
+					TargetSpecifier: &corev3.GrpcService_EnvoyGrpc_{
+						EnvoyGrpc: &corev3.GrpcService_EnvoyGrpc{ClusterName: XDSCluster},
+					},
+				}},
+			},
+		},
+	}
+
+	data, _ := protojson.MarshalOptions{UseProtoNames: true}.Marshal(bootstrap)
+	// protojson varies its whitespace on purpose, which is normalized to keep the config hash stable
+	var compacted, indented bytes.Buffer
+	_ = json.Compact(&compacted, data)
+	_ = json.Indent(&indented, compacted.Bytes(), "", "  ")
+	return indented.String() + "\n"
+}
+
+// CheckBootstrap parses and validates the bootstrap config.
+func CheckBootstrap(config []byte) error {
+	bootstrap := &bootstrapv3.Bootstrap{}
+	if err := protojson.Unmarshal(config, bootstrap); err != nil {
+		return fmt.Errorf("invalid bootstrap config: %v", err)
+	}
+	return bootstrap.Validate()
+}
+
+// newHealthListener answers the probes of the proxy container on HealthPort.
+func newHealthListener() *listenerv3.Listener {
+	manager := &hcmv3.HttpConnectionManager{
+		StatPrefix: "healthz",
+		RouteSpecifier: &hcmv3.HttpConnectionManager_RouteConfig{RouteConfig: &routev3.RouteConfiguration{
+			Name: "healthz",
+			VirtualHosts: []*routev3.VirtualHost{{
+				Name:    "healthz",
+				Domains: []string{"*"},
+				Routes: []*routev3.Route{{
+					Match:  &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_Path{Path: HealthPath}},
+					Action: &routev3.Route_DirectResponse{DirectResponse: &routev3.DirectResponseAction{Status: 200}},
+				}},
+			}},
+		}},
+		HttpFilters: []*hcmv3.HttpFilter{{
+			Name:       wellknown.Router,
+			ConfigType: &hcmv3.HttpFilter_TypedConfig{TypedConfig: mustMarshalAny(&routerv3.Router{})},
+		}},
+	}
+	return &listenerv3.Listener{
+		Name: "healthz",
+		Address: &corev3.Address{Address: &corev3.Address_SocketAddress{SocketAddress: &corev3.SocketAddress{
+			Address:       "0.0.0.0",
+			PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: uint32(HealthPort)},
+		}}},
+		FilterChains: []*listenerv3.FilterChain{{
+			Filters: []*listenerv3.Filter{{
+				Name:       wellknown.HTTPConnectionManager,
+				ConfigType: &listenerv3.Filter_TypedConfig{TypedConfig: mustMarshalAny(manager)},
+			}},
+		}},
+	}
+}
+
+// newXDSCluster connects to the xDS server at XDSAddress over HTTP/2, which is required by gRPC.
+func newXDSCluster() *clusterv3.Cluster {
+	host, port, _ := net.SplitHostPort(XDSAddress)
+	portValue, _ := strconv.ParseUint(port, 10, 32)
+	return &clusterv3.Cluster{
+		Name:                 XDSCluster,
+		ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterv3.Cluster_STRICT_DNS},
+		ConnectTimeout:       durationpb.New(connectTimeout),
+		TypedExtensionProtocolOptions: map[string]*anypb.Any{
+			"envoy.extensions.upstreams.http.v3.HttpProtocolOptions": mustMarshalAny(&httpv3.HttpProtocolOptions{
+				UpstreamProtocolOptions: &httpv3.HttpProtocolOptions_ExplicitHttpConfig_{
+					ExplicitHttpConfig: &httpv3.HttpProtocolOptions_ExplicitHttpConfig{
+						ProtocolConfig: &httpv3.HttpProtocolOptions_ExplicitHttpConfig_Http2ProtocolOptions{
+							Http2ProtocolOptions: &corev3.Http2ProtocolOptions{},
+						},
+					},
+				},
+			}),
+		},
+		LoadAssignment: &endpointv3.ClusterLoadAssignment{
+			ClusterName: XDSCluster,
+			Endpoints: []*endpointv3.LocalityLbEndpoints{{
+				LbEndpoints: []*endpointv3.LbEndpoint{newLbEndpoint(host, uint32(portValue), 1)},
+			}},
+		},
+	}
+}
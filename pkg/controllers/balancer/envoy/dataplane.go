@@ -0,0 +1,115 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package envoy runs Envoy as the proxy of Balancer. The proxy pods are bootstrapped to the xDS server hosted by
+// the balancer-controller, which serves the listeners and the weighted clusters translated from the Balancer.
+package envoy
+
+import (
+	balancerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/upstream"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"path"
+)
+
+const (
+	// DefaultImage is the image of the envoy container if Balancer.Spec.ProxyTemplate does not specify one.
+	DefaultImage = "envoyproxy/envoy:v1.20.0"
+	// ConfigDir is where the envoy container reads the bootstrap config.
+	ConfigDir = "/etc/envoy"
+	// ConfigFile is the name of the bootstrap config.
+	ConfigFile = "envoy.json"
+)
+
+// DataPlane runs Envoy as the proxy of Balancer. The proxy configmap holds the bootstrap config only,
+// which does not change with the weights or the endpoints, those are pushed over xDS instead.
+type DataPlane struct{}
+
+// Render renders the bootstrap config, the backends and the pod endpoints are served over xDS, see NewResources.
+func (DataPlane) Render(balancer *balancerv1alpha1.Balancer, _ upstream.Endpoints) string {
+	return NewBootstrap(balancer)
+}
+
+// Validate rejects the HotReload mode, since the config is updated over xDS without any reload,
+// and the metrics, which are not exported yet.
+func (DataPlane) Validate(balancer *balancerv1alpha1.Balancer) field.ErrorList {
+	var allErrs field.ErrorList
+	if balancer.Spec.Metrics != nil {
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "metrics"),
+			"the metrics are not supported by the envoy data plane"))
+	}
+	if balancer.Spec.ReloadMode == balancerv1alpha1.ReloadModeHotReload {
+		allErrs = append(allErrs, field.NotSupported(field.NewPath("spec", "reloadMode"),
+			balancer.Spec.ReloadMode, []string{string(balancerv1alpha1.ReloadModeRestart)}))
+	}
+	return allErrs
+}
+
+func (DataPlane) CheckConfig(config []byte) error {
+	return CheckBootstrap(config)
+}
+
+func (DataPlane) ConfigDir() string {
+	return ConfigDir
+}
+
+func (DataPlane) ConfigFile() string {
+	return ConfigFile
+}
+
+// Container runs envoy as root to bind the privileged ports, with the other capabilities dropped.
+// The pod name is the ID of the envoy node, by which the xDS server tells which proxy pod applied which config.
+func (DataPlane) Container() corev1.Container {
+	rootUser := int64(0)
+	runAsNonRoot := false
+	allowPrivilegeEscalation := false
+	return corev1.Container{
+		Name:    "proxy",
+		Image:   Image,
+		Command: []string{"envoy"},
+		Args: []string{
+			"--config-path", path.Join(ConfigDir, ConfigFile),
+			"--service-node", "$(POD_NAME)",
+		},
+		Env: []corev1.EnvVar{
+			{
+				Name: "POD_NAME",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+				},
+			},
+		},
+		SecurityContext: &corev1.SecurityContext{
+			RunAsUser:                &rootUser,
+			RunAsNonRoot:             &runAsNonRoot,
+			AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+			Capabilities: &corev1.Capabilities{
+				Drop: []corev1.Capability{"ALL"},
+				Add:  []corev1.Capability{"NET_BIND_SERVICE"},
+			},
+		},
+	}
+}
+
+func (DataPlane) HealthCheck() (int32, string) {
+	return HealthPort, HealthPath
+}
+
+// ReloadArgs is never used, since the HotReload mode is rejected by Validate.
+func (DataPlane) ReloadArgs() []string {
+	return nil
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package envoy
+
+import (
+	"fmt"
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	tcpproxyv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+	udpproxyv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/udp/udp_proxy/v3"
+	balancerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/upstream"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestBalancer() *balancerv1alpha1.Balancer {
+	return &balancerv1alpha1.Balancer{
+		ObjectMeta: v1.ObjectMeta{Name: "example-balancer", Namespace: "default"},
+		Spec: balancerv1alpha1.BalancerSpec{
+			Ports: []balancerv1alpha1.BalancerPort{
+				{Name: "http", Protocol: balancerv1alpha1.TCP, Port: 80},
+				{Name: "dns", Protocol: balancerv1alpha1.UDP, Port: 53},
+			},
+			Backends: []balancerv1alpha1.BackendSpec{
+				{Name: "v1", Weight: 20},
+				{Name: "v2", Weight: 80},
+				{Name: "v3", Weight: 0},
+			},
+			DataPlane: balancerv1alpha1.DataPlaneEnvoy,
+		},
+	}
+}
+
+// clusterWeights returns the weight of each endpoint (address:port) of each cluster.
+func clusterWeights(clusters []*clusterv3.Cluster) map[string]map[string]uint32 {
+	weights := map[string]map[string]uint32{}
+	for _, cluster := range clusters {
+		weights[cluster.Name] = map[string]uint32{}
+		for _, locality := range cluster.LoadAssignment.Endpoints {
+			for _, lbEndpoint := range locality.LbEndpoints {
+				address := lbEndpoint.GetEndpoint().GetAddress().GetSocketAddress()
+				endpoint := fmt.Sprintf("%s:%d", address.Address, address.GetPortValue())
+				weights[cluster.Name][endpoint] = lbEndpoint.LoadBalancingWeight.GetValue()
+			}
+		}
+	}
+	return weights
+}
+
+func TestNewClusters(t *testing.T) {
+	clusters := NewClusters(newTestBalancer(), nil)
+	for _, cluster := range clusters {
+		if cluster.GetType() != clusterv3.Cluster_STRICT_DNS {
+			t.Errorf("cluster %s should resolve the backend services by DNS, got %v", cluster.Name, cluster.GetType())
+		}
+		if err := cluster.Validate(); err != nil {
+			t.Errorf("cluster %s is invalid: %v", cluster.Name, err)
+		}
+	}
+	// the drained backend v3 is left out, which is rejected by envoy with weight 0
+	expected := map[string]map[string]uint32{
+		"tcp-80": {"example-balancer-v1-backend:80": 20, "example-balancer-v2-backend:80": 80},
+		"udp-53": {"example-balancer-v1-backend:53": 20, "example-balancer-v2-backend:53": 80},
+	}
+	if weights := clusterWeights(clusters); !reflect.DeepEqual(weights, expected) {
+		t.Errorf("expected weights %v, got %v", expected, weights)
+	}
+}
+
+func TestNewClustersEndpoints(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.Ports = balancer.Spec.Ports[:1]
+	endpoints := upstream.Endpoints{
+		"v1": {"http": {"10.0.0.1:8080", "10.0.0.2:8080"}},
+		"v2": {"http": {"10.0.1.1:8080"}},
+		"v3": {"http": {"10.0.2.1:8080"}},
+	}
+
+	clusters := NewClusters(balancer, endpoints)
+	if clusters[0].GetType() != clusterv3.Cluster_STATIC {
+		t.Errorf("the cluster of the pod endpoints should be static, got %v", clusters[0].GetType())
+	}
+	// the weight of a backend is split across its endpoints, and the endpoints of v3 are left out
+	expected := map[string]map[string]uint32{
+		"tcp-80": {"10.0.0.1:8080": 20, "10.0.0.2:8080": 20, "10.0.1.1:8080": 160},
+	}
+	if weights := clusterWeights(clusters); !reflect.DeepEqual(weights, expected) {
+		t.Errorf("expected weights %v, got %v", expected, weights)
+	}
+}
+
+func TestNewListeners(t *testing.T) {
+	listeners := NewListeners(newTestBalancer())
+	if len(listeners) != 2 {
+		t.Fatalf("expected a listener for each port, got %d", len(listeners))
+	}
+	for _, listener := range listeners {
+		if err := listener.Validate(); err != nil {
+			t.Errorf("listener %s is invalid: %v", listener.Name, err)
+		}
+	}
+
+	tcp := listeners[0]
+	tcpProxy := &tcpproxyv3.TcpProxy{}
+	if err := tcp.FilterChains[0].Filters[0].GetTypedConfig().UnmarshalTo(tcpProxy); err != nil {
+		t.Fatal(err)
+	}
+	if tcp.Name != "tcp-80" || tcp.Address.GetSocketAddress().GetPortValue() != 80 || tcpProxy.GetCluster() != "tcp-80" {
+		t.Errorf("the TCP port should be proxied to its cluster, got %v with %v", tcp, tcpProxy)
+	}
+
+	udp := listeners[1]
+	udpProxy := &udpproxyv3.UdpProxyConfig{}
+	if err := udp.ListenerFilters[0].GetTypedConfig().UnmarshalTo(udpProxy); err != nil {
+		t.Fatal(err)
+	}
+	if udp.Name != "udp-53" || udp.UdpListenerConfig == nil || udpProxy.GetCluster() != "udp-53" {
+		t.Errorf("the UDP port should be proxied to its cluster, got %v with %v", udp, udpProxy)
+	}
+}
+
+func TestNewBootstrap(t *testing.T) {
+	config := NewBootstrap(newTestBalancer())
+	if err := CheckBootstrap([]byte(config)); err != nil {
+		t.Fatalf("the bootstrap config is invalid: %v\n%s", err, config)
+	}
+	for _, expected := range []string{
+		`"cluster": "default/example-balancer"`,
+		`"address": "balancer-controller-manager-xds-service.balancer-system.svc"`,
+		`"port_value": 18000`,
+		`"cluster_name": "xds_cluster"`,
+		`"path": "/healthz"`,
+	} {
+		if !strings.Contains(config, expected) {
+			t.Errorf("expected %s in the bootstrap config:\n%s", expected, config)
+		}
+	}
+	if NewBootstrap(newTestBalancer()) != config {
+		t.Errorf("the bootstrap config should be rendered stably")
+	}
+
+	if err := CheckBootstrap([]byte(`{"node": {"unknown": true}}`)); err == nil {
+		t.Errorf("expected an error for an unknown field")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	balancer := newTestBalancer()
+	if errs := (DataPlane{}).Validate(balancer); len(errs) != 0 {
+		t.Errorf("expected no error, got %v", errs)
+	}
+
+	balancer.Spec.ReloadMode = balancerv1alpha1.ReloadModeHotReload
+	balancer.Spec.Metrics = &balancerv1alpha1.MetricsSpec{}
+	if errs := (DataPlane{}).Validate(balancer); len(errs) != 2 {
+		t.Errorf("expected the HotReload mode and the metrics to be rejected, got %v", errs)
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package envoy
+
+import (
+	"fmt"
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	tcpproxyv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+	udpproxyv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/udp/udp_proxy/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	balancerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/upstream"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UDPProxy is the name of the udp_proxy listener filter, which is not listed in wellknown.
+const UDPProxy = "envoy.filters.udp_listener.udp_proxy"
+
+// connectTimeout bounds the time spent on connecting to an upstream server.
+const connectTimeout = 5 * time.Second
+
+// NewResources translates balancer into the xDS resources served to its proxy pods, by their type URL.
+// Each balancer port is served by a listener, which forwards the traffic to the cluster of the same name.
+// The cluster holds an endpoint for each backend, weighted by the weight of the backend, see NewClusters.
+// The listeners are L4 proxies, which forward to a cluster directly instead of routing by a route configuration.
+func NewResources(balancer *balancerv1alpha1.Balancer, endpoints upstream.Endpoints) map[resource.Type][]types.Resource {
+	var listeners, clusters []types.Resource
+	for _, listener := range NewListeners(balancer) {
+		listeners = append(listeners, listener)
+	}
+	for _, cluster := range NewClusters(balancer, endpoints) {
+		clusters = append(clusters, cluster)
+	}
+	return map[resource.Type][]types.Resource{
+		resource.ListenerType: listeners,
+		resource.ClusterType:  clusters,
+	}
+}
+
+// NewListeners returns a listener for each balancer port, e.g., tcp-80 proxies the TCP port 80 with tcp_proxy,
+// and udp-53 proxies the UDP port 53 with udp_proxy.
+func NewListeners(balancer *balancerv1alpha1.Balancer) []*listenerv3.Listener {
+	var listeners []*listenerv3.Listener
+	for _, port := range balancer.Spec.Ports {
+		name := portName(port)
+		listener := &listenerv3.Listener{
+			Name: name,
+			Address: &corev3.Address{Address: &corev3.Address_SocketAddress{SocketAddress: &corev3.SocketAddress{
+				Protocol:      corev3.SocketAddress_TCP,
+				Address:       "0.0.0.0",
+				PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: uint32(port.Port)},
+			}}},
+		}
+		if port.Protocol == balancerv1alpha1.UDP {
+			listener.Address.GetSocketAddress().Protocol = corev3.SocketAddress_UDP
+			listener.UdpListenerConfig = &listenerv3.UdpListenerConfig{}
+			listener.ListenerFilters = []*listenerv3.ListenerFilter{{
+				Name: UDPProxy,
+				ConfigType: &listenerv3.ListenerFilter_TypedConfig{TypedConfig: mustMarshalAny(&udpproxyv3.UdpProxyConfig{
+					StatPrefix:     name,
+					RouteSpecifier: &udpproxyv3.UdpProxyConfig_Cluster{Cluster: name},
+				})},
+			}}
+		} else {
+			listener.FilterChains = []*listenerv3.FilterChain{{
+				Filters: []*listenerv3.Filter{{
+					Name: wellknown.TCPProxy,
+					ConfigType: &listenerv3.Filter_TypedConfig{TypedConfig: mustMarshalAny(&tcpproxyv3.TcpProxy{
+						StatPrefix:       name,
+						ClusterSpecifier: &tcpproxyv3.TcpProxy_Cluster{Cluster: name},
+					})},
+				}},
+			}}
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners
+}
+
+// NewClusters returns a cluster for each balancer port, whose endpoints are the backend services resolved by DNS,
+// weighted by the weights of the backends. If endpoints is not nil, the endpoints of a cluster are the pod endpoints
+// instead, each of which gets its share of the weight of its backend, see upstream.Endpoints.Servers.
+// The endpoints of weight 0 (e.g., of a drained backend) are left out, since Envoy rejects a zero weight.
+func NewClusters(balancer *balancerv1alpha1.Balancer, endpoints upstream.Endpoints) []*clusterv3.Cluster {
+	var clusters []*clusterv3.Cluster
+	for _, port := range balancer.Spec.Ports {
+		name := portName(port)
+		cluster := &clusterv3.Cluster{
+			Name:           name,
+			ConnectTimeout: durationpb.New(connectTimeout),
+			LbPolicy:       clusterv3.Cluster_ROUND_ROBIN,
+			LoadAssignment: &endpointv3.ClusterLoadAssignment{ClusterName: name},
+		}
+		var lbEndpoints []*endpointv3.LbEndpoint
+		if servers := endpoints.Servers(balancer, port.Name); servers != nil {
+			cluster.ClusterDiscoveryType = &clusterv3.Cluster_Type{Type: clusterv3.Cluster_STATIC}
+			for _, server := range servers {
+				host, portValue, err := net.SplitHostPort(server.Address)
+				if err != nil || server.Weight == 0 {
+					continue
+				}
+				targetPort, _ := strconv.ParseUint(portValue, 10, 32)
+				lbEndpoints = append(lbEndpoints, newLbEndpoint(host, uint32(targetPort), server.Weight))
+			}
+		} else {
+			cluster.ClusterDiscoveryType = &clusterv3.Cluster_Type{Type: clusterv3.Cluster_STRICT_DNS}
+			cluster.DnsLookupFamily = clusterv3.Cluster_V4_ONLY
+			for _, backend := range balancer.Spec.Backends {
+				if backend.Weight == 0 {
+					continue
+				}
+				// the backend service exposes the balancer port, which is mapped to the targetPort of each backend
+				lbEndpoints = append(lbEndpoints, newLbEndpoint(
+					fmt.Sprintf("%s-%s-backend", balancer.Name, backend.Name), uint32(port.Port), backend.Weight))
+			}
+		}
+		if lbEndpoints != nil {
+			cluster.LoadAssignment.Endpoints = []*endpointv3.LocalityLbEndpoints{{LbEndpoints: lbEndpoints}}
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters
+}
+
+func newLbEndpoint(address string, port uint32, weight int32) *endpointv3.LbEndpoint {
+	return &endpointv3.LbEndpoint{
+		HostIdentifier: &endpointv3.LbEndpoint_Endpoint{Endpoint: &endpointv3.Endpoint{
+			Address: &corev3.Address{Address: &corev3.Address_SocketAddress{SocketAddress: &corev3.SocketAddress{
+				Address:       address,
+				PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: port},
+			}}},
+		}},
+		LoadBalancingWeight: wrapperspb.UInt32(uint32(weight)),
+	}
+}
+
+// portName names the listener and the cluster of port after its protocol and number, which are unique in a Balancer.
+func portName(port balancerv1alpha1.BalancerPort) string {
+	protocol := port.Protocol
+	if protocol == "" {
+		protocol = balancerv1alpha1.TCP
+	}
+	return fmt.Sprintf("%s-%d", strings.ToLower(string(protocol)), port.Port)
+}
+
+func mustMarshalAny(message proto.Message) *anypb.Any {
+	any, err := anypb.New(message)
+	if err != nil {
+		panic(err)
+	}
+	return any
+}
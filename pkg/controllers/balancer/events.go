@@ -0,0 +1,108 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"fmt"
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/upstream"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+)
+
+// the reasons of the events recorded on Balancer, which are shown by `kubectl describe balancer`
+const (
+	EventReasonCreated          = "Created"
+	EventReasonUpdated          = "Updated"
+	EventReasonDeleted          = "Deleted"
+	EventReasonConfigChanged    = "ConfigChanged"
+	EventReasonInvalidSpec      = "InvalidSpec"
+	EventReasonInvalidConfig    = "InvalidConfig"
+	EventReasonSyncFailed       = "SyncFailed"
+	EventReasonFieldConflict    = "FieldConflict"
+	EventReasonDriftReverted    = "DriftReverted"
+	EventReasonManualOverride   = "ManualOverride"
+	EventReasonSecretNotFound   = "SecretNotFound"
+	EventReasonNoReadyEndpoints = "NoReadyEndpoints"
+)
+
+var eventReasons = map[string]string{
+	"created": EventReasonCreated,
+	"updated": EventReasonUpdated,
+	"deleted": EventReasonDeleted,
+}
+
+// recordChange logs the change (created, updated or deleted) of a resource managed by balancer,
+// and records it as a Normal event of balancer.
+func (r *ReconcilerBalancer) recordChange(balancer *exposerv1alpha1.Balancer, kind, name, action string) {
+	log.Info("Sync "+kind, name, action)
+	r.recorder.Eventf(balancer, corev1.EventTypeNormal, eventReasons[action], "%s %s %s", kind, name, action)
+}
+
+// recordUpdate logs the update of obj, which had resourceVersion before.
+// The event is only recorded if obj is changed, the apiserver keeps the resourceVersion of a no-op update.
+func (r *ReconcilerBalancer) recordUpdate(balancer *exposerv1alpha1.Balancer, kind string, obj client.Object, resourceVersion string) {
+	if obj.GetResourceVersion() == resourceVersion {
+		log.Info("Sync "+kind, obj.GetName(), "updated")
+		return
+	}
+	r.recordChange(balancer, kind, obj.GetName(), "updated")
+}
+
+// recordConfigChange records the change of the proxy config from the found configmap to the desired cm,
+// with the hashes and the backend weights of both. found is nil if the configmap is created.
+func (r *ReconcilerBalancer) recordConfigChange(balancer *exposerv1alpha1.Balancer, found, cm *corev1.ConfigMap) {
+	newHash, newWeights := cm.Annotations[exposerv1alpha1.ConfigMapHashKey], cm.Annotations[exposerv1alpha1.WeightsKey]
+	if found == nil {
+		r.recorder.Eventf(balancer, corev1.EventTypeNormal, EventReasonConfigChanged,
+			"Proxy config %s rendered with weights %s", newHash, newWeights)
+		return
+	}
+	oldHash, oldWeights := found.Annotations[exposerv1alpha1.ConfigMapHashKey], found.Annotations[exposerv1alpha1.WeightsKey]
+	if oldHash == newHash {
+		return
+	}
+	if oldWeights == newWeights {
+		r.recorder.Eventf(balancer, corev1.EventTypeNormal, EventReasonConfigChanged,
+			"Proxy config changed from %s to %s, weights %s", oldHash, newHash, newWeights)
+		return
+	}
+	r.recorder.Eventf(balancer, corev1.EventTypeNormal, EventReasonConfigChanged,
+		"Proxy config changed from %s to %s, weights %s -> %s", oldHash, newHash, oldWeights, newWeights)
+}
+
+// recordUnservedBackends records a Warning event of balancer for each backend which receives no traffic of a port,
+// since it has no ready endpoint of the port, see upstream.Endpoints.Unserved.
+// effective is balancer with the weights rendered into the proxy config, see EffectiveBalancer.
+func (r *ReconcilerBalancer) recordUnservedBackends(balancer, effective *exposerv1alpha1.Balancer, endpoints upstream.Endpoints) {
+	for _, port := range effective.Spec.Ports {
+		for _, name := range endpoints.Unserved(effective, port.Name) {
+			r.recorder.Eventf(balancer, corev1.EventTypeWarning, EventReasonNoReadyEndpoints,
+				"Backend %s has no ready endpoints of port %s, thus it receives no traffic of the port", name, port.Name)
+		}
+	}
+}
+
+// formatWeights returns the backend weights of balancer in the order of Spec.Backends, e.g., v1=40,v2=60.
+func formatWeights(balancer *exposerv1alpha1.Balancer) string {
+	weights := make([]string, len(balancer.Spec.Backends))
+	for i, backend := range balancer.Spec.Backends {
+		weights[i] = fmt.Sprintf("%s=%d", backend.Name, backend.Weight)
+	}
+	return strings.Join(weights, ",")
+}
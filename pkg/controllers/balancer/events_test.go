@@ -0,0 +1,134 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"strings"
+	"testing"
+)
+
+// drainEvents returns the events recorded by recorder so far.
+func drainEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestSyncConfigMapEvents(t *testing.T) {
+	balancer := newTestBalancer()
+	scheme := newTestScheme(t)
+	recorder := record.NewFakeRecorder(100)
+	r := &ReconcilerBalancer{
+		client:   newTestClient(scheme, balancer),
+		scheme:   scheme,
+		recorder: recorder,
+	}
+
+	if _, err := r.syncConfigMap(balancer); err != nil {
+		t.Fatal(err)
+	}
+	events := drainEvents(recorder)
+	if len(events) != 2 || !strings.HasPrefix(events[0], "Normal Created ConfigMap example-balancer-proxy-configmap created") ||
+		!strings.HasSuffix(events[1], "rendered with weights v1=40,v2=60") {
+		t.Errorf("expected the configmap created with weights v1=40,v2=60, got %v", events)
+	}
+
+	balancer.Spec.Backends[0].Weight = 20
+	balancer.Spec.Backends[1].Weight = 80
+	if _, err := r.syncConfigMap(balancer); err != nil {
+		t.Fatal(err)
+	}
+	events = drainEvents(recorder)
+	found := false
+	for _, event := range events {
+		if strings.HasPrefix(event, "Normal ConfigChanged") && strings.HasSuffix(event, "weights v1=40,v2=60 -> v1=20,v2=80") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected the config change with the old and new weights, got %v", events)
+	}
+
+	// the same config changes nothing
+	if _, err := r.syncConfigMap(balancer); err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range drainEvents(recorder) {
+		if strings.Contains(event, EventReasonConfigChanged) {
+			t.Errorf("expected no config change, got %s", event)
+		}
+	}
+}
+
+func TestRecordSyncEvents(t *testing.T) {
+	balancer := newTestBalancer()
+	recorder := record.NewFakeRecorder(10)
+	r := &ReconcilerBalancer{recorder: recorder}
+
+	if err := r.recordSync(balancer, phaseDeployment, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.recordSync(balancer, phaseDeployment, fmt.Errorf("boom")); err == nil {
+		t.Fatal("expected the error returned as it is")
+	}
+	events := drainEvents(recorder)
+	if len(events) != 1 || events[0] != "Warning SyncFailed Failed to sync deployment: boom" {
+		t.Errorf("expected a single SyncFailed event, got %v", events)
+	}
+
+	// the apiserver keeps the resourceVersion of a no-op update
+	svc := &corev1.Service{}
+	svc.Name, svc.ResourceVersion = "example-balancer-v1-backend", "1"
+	r.recordUpdate(balancer, "Backend Service", svc, "1")
+	if events = drainEvents(recorder); len(events) != 0 {
+		t.Errorf("expected no event of a no-op update, got %v", events)
+	}
+	r.recordUpdate(balancer, "Backend Service", svc, "0")
+	if events = drainEvents(recorder); len(events) != 1 || !strings.HasPrefix(events[0], "Normal Updated") {
+		t.Errorf("expected an Updated event, got %v", events)
+	}
+}
+
+func TestSyncSpecValidConditionEvents(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.Backends[0].Weight = 0
+	balancer.Spec.Backends[1].Weight = 0
+	scheme := newTestScheme(t)
+	recorder := record.NewFakeRecorder(10)
+	r := &ReconcilerBalancer{
+		client:   newTestClient(scheme, balancer),
+		scheme:   scheme,
+		recorder: recorder,
+	}
+
+	if valid, err := r.syncSpecValidCondition(balancer); err != nil || valid {
+		t.Fatalf("expected the balancer to be invalid, got %v %v", valid, err)
+	}
+	events := drainEvents(recorder)
+	if len(events) != 1 || !strings.HasPrefix(events[0], "Warning "+EventReasonInvalidSpec) {
+		t.Errorf("expected an InvalidSpec event, got %v", events)
+	}
+}
@@ -22,66 +22,167 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/types"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-// syncFrontendService sync the front-end service that created by balancer.
-func (r *ReconcilerBalancer) syncFrontendService(balancer *exposerv1alpha1.Balancer) error {
-	svc, err := NewFrontendService(balancer)
+// syncFrontendServices sync the front-end services that created by balancer,
+// and deletes the ones which are removed from Balancer.Spec.Frontends.
+func (r *ReconcilerBalancer) syncFrontendServices(balancer *exposerv1alpha1.Balancer) error {
+	svcs, err := NewFrontendServices(balancer)
 	if err != nil {
 		return err
 	}
+	for _, svc := range svcs {
+		if err = r.syncFrontendService(balancer, svc); err != nil {
+			return err
+		}
+	}
 
-	// set balancer as the controller owner-reference of svc
-	if err := controllerutil.SetControllerReference(balancer, svc, r.scheme); err != nil {
+	// get current front-end services
+	var svcList corev1.ServiceList
+	if err = r.client.List(context.Background(), &svcList, client.InNamespace(balancer.Namespace),
+		client.MatchingLabels(NewFrontendServiceLabels(balancer))); err != nil {
 		return err
 	}
-
-	foundSvc := &corev1.Service{}
-	err = r.client.Get(context.Background(), types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}, foundSvc)
-	if err != nil && errors.IsNotFound(err) {
-		// corresponding service not found in the cluster, create it with the newest svc
-		if err = r.client.Create(context.Background(), svc); err != nil {
+	for _, svcToDelete := range groupFrontendServices(balancer, svcs, svcList.Items) {
+		if err = r.client.Delete(context.Background(), &svcToDelete); err != nil && !errors.IsNotFound(err) {
 			return err
 		}
-		log.Info("Sync Frontend Service", svc.Name, "created")
-		return nil
-	} else if err != nil {
-		return err
+		r.recordChange(balancer, "Frontend Service", svcToDelete.Name, "deleted")
 	}
+	return nil
+}
 
-	// corresponding service found, update it with the newest svc
-	foundSvc.Spec.Ports = svc.Spec.Ports
-	foundSvc.Spec.Selector = svc.Spec.Selector
-	if err = r.client.Update(context.Background(), foundSvc); err != nil {
-		return err
+// syncFrontendService server-side applies a front-end service that created by balancer.
+// The node ports allocated by the cluster are kept, since they are not set by balancer.
+func (r *ReconcilerBalancer) syncFrontendService(balancer *exposerv1alpha1.Balancer, svc *corev1.Service) error {
+	return r.apply(balancer, "Frontend Service", svc)
+}
+
+// groupFrontendServices gets the front-end services to be deleted,
+// which are the ones in currentFrontendServices controlled by balancer but not desired any more.
+func groupFrontendServices(balancer *exposerv1alpha1.Balancer, desiredFrontendServices []*corev1.Service,
+	currentFrontendServices []corev1.Service) (frontendServicesToDelete []corev1.Service) {
+
+	for _, svc := range currentFrontendServices {
+		if !metav1.IsControlledBy(&svc, balancer) {
+			continue
+		}
+		desired := false
+		for _, desiredSvc := range desiredFrontendServices {
+			if svc.Name == desiredSvc.Name && svc.Namespace == desiredSvc.Namespace {
+				desired = true
+				break
+			}
+		}
+		if !desired {
+			frontendServicesToDelete = append(frontendServicesToDelete, svc)
+		}
 	}
-	log.Info("Sync Frontend Service", foundSvc.Name, "updated")
-	return nil
+	return
+}
+
+// NewFrontendServices creates all the front-end Services of the balancer,
+// i.e., the one returned by NewFrontendService and one for each of Balancer.Spec.Frontends.
+func NewFrontendServices(balancer *exposerv1alpha1.Balancer) ([]*corev1.Service, error) {
+	svc, err := NewFrontendService(balancer)
+	if err != nil {
+		return nil, err
+	}
+	svcs := []*corev1.Service{svc}
+	for i := range balancer.Spec.Frontends {
+		frontend := &balancer.Spec.Frontends[i]
+		svcs = append(svcs, newFrontendService(balancer, FrontendServiceName(balancer, frontend.Name),
+			frontend.Ports, &frontend.FrontendSpec))
+	}
+	return svcs, nil
 }
 
 // NewFrontendService creates a new front-end Service for handling all requests incoming.
 // All the incoming requests will be forwarded to backend services by the nginx instance.
 func NewFrontendService(balancer *exposerv1alpha1.Balancer) (*corev1.Service, error) {
+	frontend := balancer.Spec.Frontend
+	if frontend == nil {
+		frontend = &exposerv1alpha1.FrontendSpec{}
+	}
+	return newFrontendService(balancer, balancer.Name, nil, frontend), nil
+}
+
+// newFrontendService creates a front-end Service named name, which exposes the balancer ports in portNames
+// (or all the balancer ports if portNames is empty) as frontend describes.
+func newFrontendService(balancer *exposerv1alpha1.Balancer, name string, portNames []string,
+	frontend *exposerv1alpha1.FrontendSpec) *corev1.Service {
+
+	svcType := frontend.Type
+	if svcType == "" {
+		svcType = corev1.ServiceTypeClusterIP
+	}
+
 	var balancerPorts []corev1.ServicePort
 	for _, port := range balancer.Spec.Ports {
-		balancerPorts = append(balancerPorts, corev1.ServicePort{
-			// TODO: the mapping from Port to TargetPort has bug! After successfully built, fix this
+		if len(portNames) > 0 && !containsString(portNames, port.Name) {
+			continue
+		}
+		svcPort := corev1.ServicePort{
 			Name:     port.Name,
 			Protocol: corev1.Protocol(port.Protocol),
 			Port:     int32(port.Port),
-		})
+			// the nginx instance listens on the exposed port of the balancer
+			TargetPort: intstr.FromInt(int(port.Port)),
+		}
+		if svcType != corev1.ServiceTypeClusterIP {
+			for _, nodePort := range frontend.NodePorts {
+				// an unnamed node port applies to the only balancer port
+				if nodePort.Name == port.Name || nodePort.Name == "" && len(balancer.Spec.Ports) == 1 {
+					svcPort.NodePort = nodePort.NodePort
+					break
+				}
+			}
+		}
+		balancerPorts = append(balancerPorts, svcPort)
+	}
+
+	// the extra labels never override the ones used by Balancer, and the reserved keys are rejected by ValidateBalancer
+	labels := map[string]string{}
+	for k, v := range frontend.Labels {
+		labels[k] = v
 	}
-	return &corev1.Service{
+	for k, v := range NewFrontendServiceLabels(balancer) {
+		labels[k] = v
+	}
+
+	svc := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      balancer.Name,
-			Namespace: balancer.Namespace,
+			Name:        name,
+			Namespace:   balancer.Namespace,
+			Labels:      labels,
+			Annotations: frontend.Annotations,
 		},
 		Spec: corev1.ServiceSpec{
 			Selector: NewPodLabels(balancer),
-			Type:     corev1.ServiceTypeClusterIP,
+			Type:     svcType,
 			Ports:    balancerPorts,
 		},
-	}, nil
+	}
+	if svcType == corev1.ServiceTypeLoadBalancer {
+		svc.Spec.LoadBalancerSourceRanges = frontend.LoadBalancerSourceRanges
+	}
+	if svcType != corev1.ServiceTypeClusterIP {
+		svc.Spec.ExternalTrafficPolicy = frontend.ExternalTrafficPolicy
+	}
+	return svc
+}
+
+func FrontendServiceName(balancer *exposerv1alpha1.Balancer, frontendName string) string {
+	return balancer.Name + "-" + frontendName
+}
+
+func containsString(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
 }
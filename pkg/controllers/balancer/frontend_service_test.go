@@ -0,0 +1,95 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"testing"
+)
+
+func TestNewFrontendService(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.Frontend = &exposerv1alpha1.FrontendSpec{
+		Type:                     corev1.ServiceTypeLoadBalancer,
+		NodePorts:                []exposerv1alpha1.FrontendNodePort{{Name: "http", NodePort: 30080}},
+		LoadBalancerSourceRanges: []string{"10.0.0.0/8"},
+		ExternalTrafficPolicy:    corev1.ServiceExternalTrafficPolicyTypeLocal,
+		Annotations:              map[string]string{"external-dns.alpha.kubernetes.io/hostname": "example.com"},
+	}
+	svc, err := NewFrontendService(balancer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer || svc.Spec.ExternalTrafficPolicy != corev1.ServiceExternalTrafficPolicyTypeLocal {
+		t.Errorf("expected a LoadBalancer service with Local policy, got %s %s", svc.Spec.Type, svc.Spec.ExternalTrafficPolicy)
+	}
+	// the node port which is not fixed is left to the cluster, and is kept by the server-side apply
+	if svc.Spec.Ports[0].NodePort != 30080 || svc.Spec.Ports[1].NodePort != 0 {
+		t.Errorf("expected only the fixed node port set, got %v", svc.Spec.Ports)
+	}
+	if svc.Annotations["external-dns.alpha.kubernetes.io/hostname"] != "example.com" {
+		t.Errorf("expected the annotations set, got %v", svc.Annotations)
+	}
+	if svc.Spec.Ports[0].TargetPort.IntValue() != 80 {
+		t.Errorf("expected the targetPort to be the port of the proxy, got %s", svc.Spec.Ports[0].TargetPort.String())
+	}
+
+	// an unnamed node port applies to the only balancer port
+	balancer.Spec.Ports = balancer.Spec.Ports[:1]
+	balancer.Spec.Frontend.NodePorts[0].Name = ""
+	if svc, err = NewFrontendService(balancer); err != nil {
+		t.Fatal(err)
+	}
+	if svc.Spec.Ports[0].NodePort != 30080 {
+		t.Errorf("expected the unnamed node port set, got %v", svc.Spec.Ports)
+	}
+}
+
+func TestGroupFrontendServices(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.UID = "balancer-uid"
+	balancer.Spec.Frontends = []exposerv1alpha1.NamedFrontendSpec{
+		{Name: "public", Ports: []string{"http"}, FrontendSpec: exposerv1alpha1.FrontendSpec{Type: corev1.ServiceTypeLoadBalancer}},
+	}
+	desired, err := NewFrontendServices(balancer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(desired) != 2 || desired[1].Name != "example-balancer-public" || len(desired[1].Spec.Ports) != 1 {
+		t.Fatalf("expected the default and the public front-end services, got %v", desired)
+	}
+
+	// the stale frontend is deleted, while the one not controlled by balancer is kept
+	stale := newFrontendService(balancer, "example-balancer-internal", nil, &exposerv1alpha1.FrontendSpec{})
+	other := newFrontendService(balancer, "example-balancer-other", nil, &exposerv1alpha1.FrontendSpec{})
+	var current []corev1.Service
+	for _, svc := range []*corev1.Service{desired[0], desired[1], stale} {
+		if err := controllerutil.SetControllerReference(balancer, svc, newTestScheme(t)); err != nil {
+			t.Fatal(err)
+		}
+		current = append(current, *svc)
+	}
+	current = append(current, *other)
+
+	toDelete := groupFrontendServices(balancer, desired, current)
+	if len(toDelete) != 1 || toDelete[0].Name != "example-balancer-internal" {
+		t.Errorf("expected example-balancer-internal to be deleted, got %v", toDelete)
+	}
+}
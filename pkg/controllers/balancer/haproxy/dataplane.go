@@ -0,0 +1,111 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package haproxy
+
+import (
+	balancerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/upstream"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"path"
+)
+
+const (
+	// DefaultImage is the image of the haproxy container if Balancer.Spec.ProxyTemplate does not specify one.
+	DefaultImage = "haproxy:2.4"
+	// ConfigDir is where the haproxy image reads haproxy.cfg.
+	ConfigDir = "/usr/local/etc/haproxy"
+	// ConfigFile is the name of the haproxy config.
+	ConfigFile = "haproxy.cfg"
+)
+
+// DataPlane runs HAProxy as the proxy of Balancer.
+type DataPlane struct{}
+
+// Render renders the backend services only, the pod endpoints are rejected by Validate.
+func (DataPlane) Render(balancer *balancerv1alpha1.Balancer, _ upstream.Endpoints) string {
+	return NewConfig(balancer)
+}
+
+// Validate rejects the UDP ports, which are not proxied by HAProxy, the metrics, which are not exported yet,
+// and the pod endpoint upstreams.
+func (DataPlane) Validate(balancer *balancerv1alpha1.Balancer) field.ErrorList {
+	var allErrs field.ErrorList
+	if balancer.Spec.Metrics != nil {
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "metrics"),
+			"the metrics are not supported by the haproxy data plane"))
+	}
+	if balancer.Spec.UpstreamMode == balancerv1alpha1.UpstreamModeEndpoints {
+		allErrs = append(allErrs, field.NotSupported(field.NewPath("spec", "upstreamMode"),
+			balancer.Spec.UpstreamMode, []string{string(balancerv1alpha1.UpstreamModeService)}))
+	}
+	for i, port := range balancer.Spec.Ports {
+		if port.Protocol == balancerv1alpha1.UDP {
+			allErrs = append(allErrs, field.NotSupported(field.NewPath("spec", "ports").Index(i).Child("protocol"),
+				port.Protocol, []string{string(balancerv1alpha1.TCP)}))
+		}
+	}
+	return allErrs
+}
+
+func (DataPlane) CheckConfig(config []byte) error {
+	return CheckConfig(config)
+}
+
+func (DataPlane) ConfigDir() string {
+	return ConfigDir
+}
+
+func (DataPlane) ConfigFile() string {
+	return ConfigFile
+}
+
+// Container runs haproxy as root to bind the privileged ports, with the other capabilities dropped.
+// The haproxy image runs as the haproxy user since 2.4, which cannot bind a port below 1024 (e.g., 80).
+func (DataPlane) Container() corev1.Container {
+	rootUser := int64(0)
+	runAsNonRoot := false
+	allowPrivilegeEscalation := false
+	return corev1.Container{
+		Name:  "haproxy",
+		Image: DefaultImage,
+		SecurityContext: &corev1.SecurityContext{
+			RunAsUser:                &rootUser,
+			RunAsNonRoot:             &runAsNonRoot,
+			AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+			Capabilities: &corev1.Capabilities{
+				Drop: []corev1.Capability{"ALL"},
+				Add:  []corev1.Capability{"NET_BIND_SERVICE"},
+			},
+		},
+	}
+}
+
+func (DataPlane) HealthCheck() (int32, string) {
+	return HealthPort, HealthPath
+}
+
+// ReloadArgs signals the haproxy master process with SIGUSR2, which starts new workers with the new config
+// and lets the old workers finish their connections. The haproxy image runs in master-worker mode (-W).
+func (DataPlane) ReloadArgs() []string {
+	return []string{
+		"--config-file=" + path.Join(ConfigDir, ConfigFile),
+		"--format=haproxy",
+		"--process=haproxy -W",
+		"--signal=SIGUSR2",
+	}
+}
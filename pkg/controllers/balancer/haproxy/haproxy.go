@@ -0,0 +1,125 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package haproxy renders the config of HAProxy, which acts as the proxy of Balancer in TCP mode.
+package haproxy
+
+import (
+	"fmt"
+	balancerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"strings"
+)
+
+const (
+	// HealthPort is the port of the built-in health listener, which is used by the probes of the proxy container.
+	HealthPort int32 = 8099
+	// HealthPath is the path of the built-in health listener.
+	HealthPath = "/healthz"
+	// MaxWeight is the largest weight accepted by HAProxy.
+	MaxWeight int32 = 256
+)
+
+// NewConfig generates the `haproxy.cfg` with the given Balancer instance.
+// Example:
+// ===================== haproxy.cfg =====================
+// global
+//     maxconn 4096
+//
+// defaults
+//     mode tcp
+//     timeout connect 5s
+//     timeout client 1m
+//     timeout server 1m
+//     default-server init-addr last,libc,none
+//
+// frontend fe_http
+//     bind :80
+//     default_backend be_http
+//
+// backend be_http
+//     balance roundrobin
+//     server v1 example-balancer-v1-backend:80 weight 20
+//     server v2 example-balancer-v2-backend:80 weight 80
+//
+// frontend healthz
+//     mode http
+//     bind :8099
+//     http-request return status 200 content-type text/plain string ok if { path /healthz }
+//     http-request deny
+// =======================================================
+// The weights are scaled down proportionally if any of them exceeds MaxWeight.
+// A backend with weight 0 receives no new connections.
+func NewConfig(balancer *balancerv1alpha1.Balancer) string {
+	weights := scaleWeights(balancer.Spec.Backends)
+
+	var b strings.Builder
+	b.WriteString("global\n")
+	b.WriteString("    maxconn 4096\n")
+	b.WriteString("\n")
+	b.WriteString("defaults\n")
+	b.WriteString("    mode tcp\n")
+	b.WriteString("    timeout connect 5s\n")
+	b.WriteString("    timeout client 1m\n")
+	b.WriteString("    timeout server 1m\n")
+	// a backend service which cannot be resolved does not prevent HAProxy from starting
+	b.WriteString("    default-server init-addr last,libc,none\n")
+
+	for _, port := range balancer.Spec.Ports {
+		b.WriteString("\n")
+		fmt.Fprintf(&b, "frontend fe_%s\n", port.Name)
+		fmt.Fprintf(&b, "    bind :%d\n", port.Port)
+		fmt.Fprintf(&b, "    default_backend be_%s\n", port.Name)
+		b.WriteString("\n")
+		fmt.Fprintf(&b, "backend be_%s\n", port.Name)
+		b.WriteString("    balance roundrobin\n")
+		for i, backend := range balancer.Spec.Backends {
+			// the backend service exposes the balancer port, which is mapped to the targetPort of each backend
+			fmt.Fprintf(&b, "    server %s %s-%s-backend:%d weight %d\n",
+				backend.Name, balancer.Name, backend.Name, port.Port, weights[i])
+		}
+	}
+
+	b.WriteString("\n")
+	b.WriteString("frontend healthz\n")
+	b.WriteString("    mode http\n")
+	fmt.Fprintf(&b, "    bind :%d\n", HealthPort)
+	fmt.Fprintf(&b, "    http-request return status 200 content-type text/plain string ok if { path %s }\n", HealthPath)
+	b.WriteString("    http-request deny\n")
+	return b.String()
+}
+
+// scaleWeights returns the weights of backends, scaled down proportionally to fit in MaxWeight.
+// A non-zero weight never becomes zero.
+func scaleWeights(backends []balancerv1alpha1.BackendSpec) []int32 {
+	var max int32
+	for _, backend := range backends {
+		if backend.Weight > max {
+			max = backend.Weight
+		}
+	}
+
+	weights := make([]int32, len(backends))
+	for i, backend := range backends {
+		weights[i] = backend.Weight
+		if max > MaxWeight {
+			weights[i] = int32(int64(backend.Weight) * int64(MaxWeight) / int64(max))
+			if weights[i] == 0 && backend.Weight > 0 {
+				weights[i] = 1
+			}
+		}
+	}
+	return weights
+}
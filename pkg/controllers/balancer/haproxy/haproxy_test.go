@@ -0,0 +1,84 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package haproxy
+
+import (
+	balancerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"testing"
+)
+
+func TestNewConfig(t *testing.T) {
+	balancer := &balancerv1alpha1.Balancer{
+		ObjectMeta: v1.ObjectMeta{Name: "example-balancer", Namespace: "default"},
+		Spec: balancerv1alpha1.BalancerSpec{
+			Ports: []balancerv1alpha1.BalancerPort{{Name: "http", Protocol: balancerv1alpha1.TCP, Port: 80}},
+			Backends: []balancerv1alpha1.BackendSpec{
+				{Name: "v1", Weight: 20},
+				{Name: "v2", Weight: 80},
+				{Name: "v3", Weight: 0},
+			},
+		},
+	}
+
+	config := NewConfig(balancer)
+	for _, expected := range []string{
+		"frontend fe_http\n    bind :80\n    default_backend be_http\n",
+		"    server v1 example-balancer-v1-backend:80 weight 20\n",
+		"    server v2 example-balancer-v2-backend:80 weight 80\n",
+		"    server v3 example-balancer-v3-backend:80 weight 0\n",
+		"    bind :8099\n",
+	} {
+		if !strings.Contains(config, expected) {
+			t.Errorf("expected %q in config:\n%s", expected, config)
+		}
+	}
+}
+
+func TestScaleWeights(t *testing.T) {
+	weights := scaleWeights([]balancerv1alpha1.BackendSpec{
+		{Name: "v1", Weight: 1},
+		{Name: "v2", Weight: 512},
+		{Name: "v3", Weight: 0},
+	})
+	if weights[0] != 1 || weights[1] != MaxWeight || weights[2] != 0 {
+		t.Errorf("expected weights [1 %d 0], got %v", MaxWeight, weights)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	valid := "global\n    maxconn 4096\n\n# the proxies\nfrontend fe_http\n    bind :80\n    default_backend be_http\n"
+	if err := CheckConfig([]byte(valid)); err != nil {
+		t.Errorf("expected valid, got %v", err)
+	}
+	if err := CheckConfig([]byte("bind :80\nfrontend fe_http\n")); err == nil {
+		t.Errorf("expected a keyword out of section to be invalid")
+	}
+	if err := CheckConfig([]byte("backend\n    balance roundrobin\n")); err == nil {
+		t.Errorf("expected an unnamed backend to be invalid")
+	}
+}
+
+func TestContainerBindsPrivilegedPorts(t *testing.T) {
+	securityContext := DataPlane{}.Container().SecurityContext
+	if securityContext == nil || securityContext.RunAsUser == nil || *securityContext.RunAsUser != 0 ||
+		securityContext.Capabilities == nil || len(securityContext.Capabilities.Add) != 1 ||
+		securityContext.Capabilities.Add[0] != "NET_BIND_SERVICE" {
+		t.Errorf("expected haproxy to run as root with NET_BIND_SERVICE only, got %v", securityContext)
+	}
+}
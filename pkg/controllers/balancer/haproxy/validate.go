@@ -0,0 +1,67 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package haproxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// haproxySections are the keywords which start a section of a haproxy config.
+var haproxySections = map[string]bool{
+	"global":    true,
+	"defaults":  true,
+	"frontend":  true,
+	"backend":   true,
+	"listen":    true,
+	"resolvers": true,
+	"peers":     true,
+	"userlist":  true,
+}
+
+// CheckConfig checks that config is well-formed as a haproxy config:
+// every keyword belongs to a section, and every proxy section is named.
+// Comments and blank lines are skipped.
+func CheckConfig(config []byte) error {
+	inSection := false
+	for i, line := range strings.Split(string(config), "\n") {
+		if j := strings.IndexByte(line, '#'); j >= 0 {
+			line = line[:j]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if !haproxySections[fields[0]] {
+			if !inSection {
+				return fmt.Errorf("line %d: unknown keyword %q out of section", i+1, fields[0])
+			}
+			continue
+		}
+		switch fields[0] {
+		case "frontend", "backend", "listen", "resolvers", "peers", "userlist":
+			if len(fields) < 2 {
+				return fmt.Errorf("line %d: %s section requires a name", i+1, fields[0])
+			}
+		}
+		inSection = true
+	}
+	if !inSection {
+		return fmt.Errorf("no section found")
+	}
+	return nil
+}
@@ -31,3 +31,15 @@ func NewServiceLabels(balancer *exposerv1alpha1.Balancer) map[string]string {
 		exposerv1alpha1.BalancerKey: balancer.Name,
 	}
 }
+
+func NewFrontendServiceLabels(balancer *exposerv1alpha1.Balancer) map[string]string {
+	return map[string]string{
+		exposerv1alpha1.FrontendKey: balancer.Name,
+	}
+}
+
+func NewMetricsServiceLabels(balancer *exposerv1alpha1.Balancer) map[string]string {
+	return map[string]string{
+		exposerv1alpha1.MetricsKey: balancer.Name,
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sync"
+	"time"
+)
+
+// the sync phases of Reconcile, which label balancer_sync_total
+const (
+	phaseRollout                 = "rollout"
+	phaseFrontendServices        = "frontend_services"
+	phaseBackendServices         = "backend_services"
+	phaseObsoleteBackendServices = "obsolete_backend_services"
+	phaseConfigMap               = "configmap"
+	phaseDeployment              = "deployment"
+	phaseXDS                     = "xds"
+	phasePodDisruptionBudget     = "pod_disruption_budget"
+	phaseHorizontalPodAutoscaler = "horizontal_pod_autoscaler"
+	phaseMetrics                 = "metrics"
+	phaseStatus                  = "status"
+	phaseProxyStatus             = "proxy_status"
+)
+
+var (
+	syncTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "balancer_sync_total",
+		Help: "Total number of the sync phases of Balancers, result is either success or error.",
+	}, []string{"phase", "result"})
+	configRendersTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "balancer_config_renders_total",
+		Help: "Total number of the proxy configs rendered for a Balancer.",
+	}, []string{"namespace", "balancer"})
+	configHashChangesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "balancer_config_hash_changes_total",
+		Help: "Total number of the proxy config changes written to the proxy configmap of a Balancer.",
+	}, []string{"namespace", "balancer"})
+	activeBackends = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "balancer_active_backends",
+		Help: "Number of the backend services of a Balancer which are in its spec.",
+	}, []string{"namespace", "balancer"})
+	obsoleteBackends = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "balancer_obsolete_backends",
+		Help: "Number of the backend services of a Balancer which are removed from its spec but not deleted yet.",
+	}, []string{"namespace", "balancer"})
+	backendWeight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "balancer_backend_weight",
+		Help: "The weight of a backend rendered into the proxy config of a Balancer.",
+	}, []string{"namespace", "balancer", "backend"})
+	lastSuccessfulSync = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "balancer_last_successful_sync_timestamp_seconds",
+		Help: "The unix time of the last successful reconcile of a Balancer, " +
+			"use time() - balancer_last_successful_sync_timestamp_seconds for the time since then.",
+	}, []string{"namespace", "balancer"})
+)
+
+func init() {
+	// served by the metrics endpoint of controller-manager
+	metrics.Registry.MustRegister(syncTotal, configRendersTotal, configHashChangesTotal,
+		activeBackends, obsoleteBackends, backendWeight, lastSuccessfulSync)
+}
+
+// recordSync counts the result of a sync phase, and returns err as it is.
+// A failed phase is also recorded as a Warning event of balancer.
+func (r *ReconcilerBalancer) recordSync(balancer *exposerv1alpha1.Balancer, phase string, err error) error {
+	result := "success"
+	if err != nil {
+		result = "error"
+		r.recorder.Eventf(balancer, corev1.EventTypeWarning, EventReasonSyncFailed, "Failed to sync %s: %v", phase, err)
+	}
+	syncTotal.WithLabelValues(phase, result).Inc()
+	return err
+}
+
+// weightedBackends remembers the backends whose weight is exported for each Balancer,
+// so that the series of a removed backend (or Balancer) can be deleted.
+var weightedBackends = struct {
+	sync.Mutex
+	names map[string]map[string]bool
+}{names: map[string]map[string]bool{}}
+
+// recordBackendMetrics exports the backend gauges of balancer from its status.
+func recordBackendMetrics(balancer *exposerv1alpha1.Balancer, status *exposerv1alpha1.BalancerStatus) {
+	activeBackends.WithLabelValues(balancer.Namespace, balancer.Name).Set(float64(status.ActiveBackendsNum))
+	obsoleteBackends.WithLabelValues(balancer.Namespace, balancer.Name).Set(float64(status.ObsoleteBackendsNum))
+
+	weightedBackends.Lock()
+	defer weightedBackends.Unlock()
+	key := balancer.Namespace + "/" + balancer.Name
+	current := map[string]bool{}
+	for _, backend := range status.Backends {
+		if backend.Phase == exposerv1alpha1.BackendDraining {
+			continue
+		}
+		current[backend.Name] = true
+		backendWeight.WithLabelValues(balancer.Namespace, balancer.Name, backend.Name).Set(float64(backend.Weight))
+	}
+	for name := range weightedBackends.names[key] {
+		if !current[name] {
+			backendWeight.DeleteLabelValues(balancer.Namespace, balancer.Name, name)
+		}
+	}
+	weightedBackends.names[key] = current
+}
+
+// recordSuccessfulSync records the time of a successful reconcile of balancer.
+func recordSuccessfulSync(balancer *exposerv1alpha1.Balancer) {
+	lastSuccessfulSync.WithLabelValues(balancer.Namespace, balancer.Name).Set(float64(time.Now().Unix()))
+}
+
+// forgetBalancerMetrics deletes the series of a deleted Balancer.
+func forgetBalancerMetrics(namespace, name string) {
+	configRendersTotal.DeleteLabelValues(namespace, name)
+	configHashChangesTotal.DeleteLabelValues(namespace, name)
+	activeBackends.DeleteLabelValues(namespace, name)
+	obsoleteBackends.DeleteLabelValues(namespace, name)
+	lastSuccessfulSync.DeleteLabelValues(namespace, name)
+
+	weightedBackends.Lock()
+	defer weightedBackends.Unlock()
+	key := namespace + "/" + name
+	for backend := range weightedBackends.names[key] {
+		backendWeight.DeleteLabelValues(namespace, name, backend)
+	}
+	delete(weightedBackends.names, key)
+}
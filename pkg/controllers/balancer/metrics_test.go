@@ -0,0 +1,59 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+)
+
+func TestRecordBackendMetrics(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Name = "metrics-balancer"
+	status := &exposerv1alpha1.BalancerStatus{
+		ActiveBackendsNum:   2,
+		ObsoleteBackendsNum: 1,
+		Backends: []exposerv1alpha1.BackendStatus{
+			{Name: "v1", Phase: exposerv1alpha1.BackendActive, Weight: 40},
+			{Name: "v2", Phase: exposerv1alpha1.BackendDrained, Weight: 0},
+			{Name: "v0", Phase: exposerv1alpha1.BackendDraining},
+		},
+	}
+	recordBackendMetrics(balancer, status)
+	if active := testutil.ToFloat64(activeBackends.WithLabelValues(balancer.Namespace, balancer.Name)); active != 2 {
+		t.Errorf("expected 2 active backends, got %v", active)
+	}
+	if weight := testutil.ToFloat64(backendWeight.WithLabelValues(balancer.Namespace, balancer.Name, "v1")); weight != 40 {
+		t.Errorf("expected weight 40 of v1, got %v", weight)
+	}
+	if series := testutil.CollectAndCount(backendWeight); series != 2 {
+		t.Errorf("expected the weights of v1 and v2 only, got %d series", series)
+	}
+
+	// the weight of a removed backend is deleted
+	status.Backends = status.Backends[:1]
+	recordBackendMetrics(balancer, status)
+	if series := testutil.CollectAndCount(backendWeight); series != 1 {
+		t.Errorf("expected the weight of v1 only, got %d series", series)
+	}
+
+	forgetBalancerMetrics(balancer.Namespace, balancer.Name)
+	if series := testutil.CollectAndCount(backendWeight); series != 0 {
+		t.Errorf("expected no weight of a deleted balancer, got %d series", series)
+	}
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"context"
+	"fmt"
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/dataplane"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/nginx"
+	"github.com/hliangzhao/balancer/pkg/exporter"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"path"
+)
+
+const metricsPortName = "metrics"
+
+// ExporterImage is the image of the exporter sidecar injected when Balancer.Spec.Metrics is set for the nginx data plane.
+var ExporterImage = DefaultReloaderImage
+
+// ServiceMonitorGVK is the kind of the ServiceMonitor of the prometheus-operator.
+var ServiceMonitorGVK = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "ServiceMonitor"}
+
+// +kubebuilder:rbac:groups=monitoring.coreos.com,resources=servicemonitors,verbs=get;list;watch;create;update;patch;delete
+
+// syncMetrics syncs the metrics service and the ServiceMonitor of the proxy pods when Balancer.Spec.Metrics is set,
+// and deletes them otherwise. The ServiceMonitor is skipped if the prometheus-operator is not installed.
+func (r *ReconcilerBalancer) syncMetrics(balancer *exposerv1alpha1.Balancer) error {
+	if err := r.syncMetricsService(balancer); err != nil {
+		return err
+	}
+	err := r.syncServiceMonitor(balancer)
+	if meta.IsNoMatchError(err) {
+		if NewServiceMonitor(balancer) != nil {
+			log.Info("Sync ServiceMonitor", ServiceMonitorName(balancer), "skipped, the prometheus-operator is not installed")
+		}
+		return nil
+	}
+	return err
+}
+
+// syncMetricsService syncs the service which exposes the metrics of the proxy pods.
+func (r *ReconcilerBalancer) syncMetricsService(balancer *exposerv1alpha1.Balancer) error {
+	svc := NewMetricsService(balancer)
+
+	foundSvc := &corev1.Service{}
+	err := r.client.Get(context.Background(), types.NamespacedName{Namespace: balancer.Namespace, Name: MetricsServiceName(balancer)}, foundSvc)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	found := err == nil
+
+	if svc == nil {
+		// not required (any more), delete the one created by balancer
+		if !found || !metav1.IsControlledBy(foundSvc, balancer) {
+			return nil
+		}
+		if err = r.client.Delete(context.Background(), foundSvc); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		r.recordChange(balancer, "Metrics Service", foundSvc.Name, "deleted")
+		return nil
+	}
+
+	return r.apply(balancer, "Metrics Service", svc)
+}
+
+// syncServiceMonitor syncs the ServiceMonitor which tells prometheus to scrape the metrics service.
+func (r *ReconcilerBalancer) syncServiceMonitor(balancer *exposerv1alpha1.Balancer) error {
+	sm := NewServiceMonitor(balancer)
+
+	foundSm := &unstructured.Unstructured{}
+	foundSm.SetGroupVersionKind(ServiceMonitorGVK)
+	err := r.client.Get(context.Background(), types.NamespacedName{Namespace: balancer.Namespace, Name: ServiceMonitorName(balancer)}, foundSm)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	found := err == nil
+
+	if sm == nil {
+		// not required (any more), delete the one created by balancer
+		if !found || !metav1.IsControlledBy(foundSm, balancer) {
+			return nil
+		}
+		if err = r.client.Delete(context.Background(), foundSm); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		r.recordChange(balancer, "ServiceMonitor", foundSm.GetName(), "deleted")
+		return nil
+	}
+
+	return r.apply(balancer, "ServiceMonitor", sm)
+}
+
+// NewMetricsService creates the service which exposes the metrics of the proxy pods of the Balancer.
+// It returns nil if Balancer.Spec.Metrics is not set.
+func NewMetricsService(balancer *exposerv1alpha1.Balancer) *corev1.Service {
+	if balancer.Spec.Metrics == nil {
+		return nil
+	}
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      MetricsServiceName(balancer),
+			Namespace: balancer.Namespace,
+			Labels:    NewMetricsServiceLabels(balancer),
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: NewPodLabels(balancer),
+			Ports: []corev1.ServicePort{
+				{
+					Name:       metricsPortName,
+					Protocol:   corev1.ProtocolTCP,
+					Port:       exporter.Port,
+					TargetPort: metricsTargetPort(balancer),
+				},
+			},
+		},
+	}
+}
+
+// NewServiceMonitor creates the ServiceMonitor which selects the metrics service of the Balancer.
+// It returns nil if Balancer.Spec.Metrics.ServiceMonitor is not set.
+func NewServiceMonitor(balancer *exposerv1alpha1.Balancer) *unstructured.Unstructured {
+	if balancer.Spec.Metrics == nil || balancer.Spec.Metrics.ServiceMonitor == nil {
+		return nil
+	}
+	spec := balancer.Spec.Metrics.ServiceMonitor
+
+	endpoint := map[string]interface{}{
+		"port": metricsPortName,
+		"path": exporter.MetricsPath,
+	}
+	if spec.Interval != "" {
+		endpoint["interval"] = spec.Interval
+	}
+	matchLabels := map[string]interface{}{}
+	for k, v := range NewMetricsServiceLabels(balancer) {
+		matchLabels[k] = v
+	}
+
+	sm := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"selector":  map[string]interface{}{"matchLabels": matchLabels},
+			"endpoints": []interface{}{endpoint},
+		},
+	}}
+	sm.SetGroupVersionKind(ServiceMonitorGVK)
+	sm.SetName(ServiceMonitorName(balancer))
+	sm.SetNamespace(balancer.Namespace)
+	// the labels are usually matched by the serviceMonitorSelector of prometheus
+	labels := map[string]string{}
+	for k, v := range spec.Labels {
+		labels[k] = v
+	}
+	for k, v := range NewMetricsServiceLabels(balancer) {
+		labels[k] = v
+	}
+	sm.SetLabels(labels)
+	return sm
+}
+
+// needsExporter tells whether the exporter sidecar is injected, which exports the metrics of nginx.
+// The native proxy serves its own metrics on the health listener.
+func needsExporter(balancer *exposerv1alpha1.Balancer) bool {
+	_, isNginx := dataplane.For(balancer).(nginx.DataPlane)
+	return balancer.Spec.Metrics != nil && isNginx
+}
+
+// metricsTargetPort returns the container port of the proxy pods which serves the metrics.
+func metricsTargetPort(balancer *exposerv1alpha1.Balancer) intstr.IntOrString {
+	if needsExporter(balancer) {
+		return intstr.FromString(metricsPortName)
+	}
+	return intstr.FromString(healthPortName)
+}
+
+// newExporterContainer returns the sidecar which exports the traffic metrics of nginx per backend.
+func newExporterContainer(balancer *exposerv1alpha1.Balancer) corev1.Container {
+	dataPlane := dataplane.For(balancer)
+	runAsNonRoot := true
+	nobody := int64(65534)
+	allowPrivilegeEscalation := false
+	return corev1.Container{
+		Name:    "exporter",
+		Image:   ExporterImage,
+		Command: []string{"/exporter"},
+		Args: []string{
+			"--balancer=" + balancer.Name,
+			"--config-file=" + path.Join(dataPlane.ConfigDir(), dataPlane.ConfigFile()),
+			"--stub-status-url=" + fmt.Sprintf("http://127.0.0.1:%d%s", nginx.HealthPort, nginx.StubStatusPath),
+			"--syslog-bind-address=" + nginx.AccessLogAddress,
+		},
+		Ports: []corev1.ContainerPort{
+			{
+				Name:          metricsPortName,
+				ContainerPort: exporter.Port,
+				Protocol:      corev1.ProtocolTCP,
+			},
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      ConfigMapName(balancer),
+				MountPath: dataPlane.ConfigDir(),
+				ReadOnly:  true,
+			},
+		},
+		SecurityContext: &corev1.SecurityContext{
+			RunAsUser:                &nobody,
+			RunAsNonRoot:             &runAsNonRoot,
+			AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+			Capabilities: &corev1.Capabilities{
+				Drop: []corev1.Capability{"ALL"},
+			},
+		},
+	}
+}
+
+func MetricsServiceName(balancer *exposerv1alpha1.Balancer) string {
+	return balancer.Name + "-proxy-metrics"
+}
+
+func ServiceMonitorName(balancer *exposerv1alpha1.Balancer) string {
+	return balancer.Name + "-proxy"
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"context"
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"testing"
+)
+
+func TestSyncMetrics(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.Metrics = &exposerv1alpha1.MetricsSpec{
+		ServiceMonitor: &exposerv1alpha1.ServiceMonitorSpec{
+			Labels:   map[string]string{"release": "prometheus"},
+			Interval: "15s",
+		},
+	}
+	scheme := newTestScheme(t)
+	r := &ReconcilerBalancer{
+		client:   newTestClient(scheme, balancer),
+		scheme:   scheme,
+		recorder: record.NewFakeRecorder(100),
+	}
+	if err := r.syncMetrics(balancer); err != nil {
+		t.Fatal(err)
+	}
+
+	svc := &corev1.Service{}
+	svcKey := types.NamespacedName{Namespace: balancer.Namespace, Name: MetricsServiceName(balancer)}
+	if err := r.client.Get(context.Background(), svcKey, svc); err != nil {
+		t.Fatal(err)
+	}
+	if svc.Labels[exposerv1alpha1.MetricsKey] != balancer.Name || svc.Labels[exposerv1alpha1.BalancerKey] != "" {
+		t.Errorf("expected the metrics service not to be selected as a backend service, got labels %v", svc.Labels)
+	}
+	if len(svc.Spec.Ports) != 1 || svc.Spec.Ports[0].TargetPort.String() != metricsPortName {
+		t.Errorf("expected the metrics service to target the exporter, got %v", svc.Spec.Ports)
+	}
+
+	sm := &unstructured.Unstructured{}
+	sm.SetGroupVersionKind(ServiceMonitorGVK)
+	smKey := types.NamespacedName{Namespace: balancer.Namespace, Name: ServiceMonitorName(balancer)}
+	if err := r.client.Get(context.Background(), smKey, sm); err != nil {
+		t.Fatal(err)
+	}
+	if sm.GetLabels()["release"] != "prometheus" {
+		t.Errorf("expected the extra labels of the ServiceMonitor, got %v", sm.GetLabels())
+	}
+	endpoints, _, _ := unstructured.NestedSlice(sm.Object, "spec", "endpoints")
+	if len(endpoints) != 1 || endpoints[0].(map[string]interface{})["interval"] != "15s" {
+		t.Errorf("expected the endpoint scraped every 15s, got %v", endpoints)
+	}
+
+	// both are deleted once the metrics are disabled
+	balancer.Spec.Metrics = nil
+	if err := r.syncMetrics(balancer); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.client.Get(context.Background(), svcKey, &corev1.Service{}); !errors.IsNotFound(err) {
+		t.Errorf("expected the metrics service deleted, got %v", err)
+	}
+	if err := r.client.Get(context.Background(), smKey, sm); !errors.IsNotFound(err) {
+		t.Errorf("expected the ServiceMonitor deleted, got %v", err)
+	}
+}
+
+func TestNewMetricsServiceWithNativeProxy(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.DataPlane = exposerv1alpha1.DataPlaneNative
+	balancer.Spec.Metrics = &exposerv1alpha1.MetricsSpec{}
+	// the native proxy serves its metrics on the health listener, no exporter is injected
+	if svc := NewMetricsService(balancer); svc.Spec.Ports[0].TargetPort.String() != healthPortName {
+		t.Errorf("expected the metrics service to target the health port, got %v", svc.Spec.Ports)
+	}
+	if NewServiceMonitor(balancer) != nil {
+		t.Errorf("expected no ServiceMonitor by default")
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package native renders the config of the native Go L4 proxy (cmd/proxy), which acts as the proxy of Balancer.
+package native
+
+import (
+	"encoding/json"
+	"fmt"
+	balancerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/upstream"
+	"github.com/hliangzhao/balancer/pkg/proxy"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"path"
+	"strings"
+)
+
+const (
+	// DefaultImage is the image of the native proxy, which is shipped with the balancer-controller.
+	DefaultImage = "docker.io/hliangzhao97/balancer:latest"
+	// ConfigDir is where the native proxy reads proxy.json.
+	ConfigDir = "/etc/balancer-proxy"
+	// ConfigFile is the name of the native proxy config.
+	ConfigFile = "proxy.json"
+)
+
+// Image is the image of the proxy container if Balancer.Spec.ProxyTemplate does not specify one.
+var Image = DefaultImage
+
+// NewConfig generates the `proxy.json` with the given Balancer instance.
+// Example:
+// ===================== proxy.json =====================
+// {
+//   "listeners": [
+//     {
+//       "name": "http",
+//       "protocol": "TCP",
+//       "port": 80,
+//       "backends": [
+//         {"name": "v1", "address": "example-balancer-v1-backend:80", "weight": 20},
+//         {"name": "v2", "address": "example-balancer-v2-backend:80", "weight": 80}
+//       ]
+//     }
+//   ]
+// }
+// ======================================================
+// If endpoints is not nil, the backends of a listener are the pod endpoints instead of the backend services,
+// each of which is named after its backend.
+func NewConfig(balancer *balancerv1alpha1.Balancer, endpoints upstream.Endpoints) string {
+	config := proxy.Config{Listeners: []proxy.Listener{}}
+	for _, port := range balancer.Spec.Ports {
+		protocol := strings.ToUpper(string(port.Protocol))
+		if protocol == "" {
+			protocol = string(balancerv1alpha1.TCP)
+		}
+		listener := proxy.Listener{
+			Name:     port.Name,
+			Protocol: protocol,
+			Port:     int32(port.Port),
+			Backends: []proxy.Backend{},
+		}
+		if servers := endpoints.Servers(balancer, port.Name); servers != nil {
+			for _, server := range servers {
+				listener.Backends = append(listener.Backends, proxy.Backend{
+					Name:    server.Backend,
+					Address: server.Address,
+					Weight:  server.Weight,
+				})
+			}
+			config.Listeners = append(config.Listeners, listener)
+			continue
+		}
+		for _, backend := range balancer.Spec.Backends {
+			// the backend service exposes the balancer port, which is mapped to the targetPort of each backend
+			listener.Backends = append(listener.Backends, proxy.Backend{
+				Name:    backend.Name,
+				Address: fmt.Sprintf("%s-%s-backend:%d", balancer.Name, backend.Name, port.Port),
+				Weight:  backend.Weight,
+			})
+		}
+		config.Listeners = append(config.Listeners, listener)
+	}
+
+	data, _ := json.MarshalIndent(config, "", "  ")
+	return string(data) + "\n"
+}
+
+// CheckConfig parses and validates the native proxy config.
+func CheckConfig(config []byte) error {
+	_, err := proxy.ParseConfig(config)
+	return err
+}
+
+// DataPlane runs the native Go L4 proxy as the proxy of Balancer.
+type DataPlane struct{}
+
+func (DataPlane) Render(balancer *balancerv1alpha1.Balancer, endpoints upstream.Endpoints) string {
+	return NewConfig(balancer, endpoints)
+}
+
+// Validate accepts any Balancer, the native proxy proxies both TCP and UDP.
+func (DataPlane) Validate(*balancerv1alpha1.Balancer) field.ErrorList {
+	return nil
+}
+
+func (DataPlane) CheckConfig(config []byte) error {
+	return CheckConfig(config)
+}
+
+func (DataPlane) ConfigDir() string {
+	return ConfigDir
+}
+
+func (DataPlane) ConfigFile() string {
+	return ConfigFile
+}
+
+// Container runs the proxy as root to bind the privileged ports, with the other capabilities dropped.
+func (DataPlane) Container() corev1.Container {
+	rootUser := int64(0)
+	runAsNonRoot := false
+	allowPrivilegeEscalation := false
+	return corev1.Container{
+		Name:    "proxy",
+		Image:   Image,
+		Command: []string{"/proxy"},
+		Args:    []string{"--config-file=" + path.Join(ConfigDir, ConfigFile)},
+		SecurityContext: &corev1.SecurityContext{
+			RunAsUser:                &rootUser,
+			RunAsNonRoot:             &runAsNonRoot,
+			AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+			Capabilities: &corev1.Capabilities{
+				Drop: []corev1.Capability{"ALL"},
+				Add:  []corev1.Capability{"NET_BIND_SERVICE"},
+			},
+		},
+	}
+}
+
+func (DataPlane) HealthCheck() (int32, string) {
+	return proxy.HealthPort, proxy.HealthPath
+}
+
+// ReloadArgs signals the proxy with SIGHUP, which swaps the config without dropping the established connections.
+func (DataPlane) ReloadArgs() []string {
+	return []string{
+		"--config-file=" + path.Join(ConfigDir, ConfigFile),
+		"--format=native",
+		"--process=/proxy",
+		"--signal=SIGHUP",
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package native
+
+import (
+	balancerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/upstream"
+	"github.com/hliangzhao/balancer/pkg/proxy"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"testing"
+)
+
+func TestNewConfig(t *testing.T) {
+	balancer := &balancerv1alpha1.Balancer{
+		ObjectMeta: v1.ObjectMeta{Name: "example-balancer", Namespace: "default"},
+		Spec: balancerv1alpha1.BalancerSpec{
+			Ports: []balancerv1alpha1.BalancerPort{
+				{Name: "http", Protocol: balancerv1alpha1.TCP, Port: 80},
+				{Name: "dns", Protocol: balancerv1alpha1.UDP, Port: 53},
+			},
+			Backends: []balancerv1alpha1.BackendSpec{{Name: "v1", Weight: 20}, {Name: "v2", Weight: 80}},
+		},
+	}
+
+	config, err := proxy.ParseConfig([]byte(NewConfig(balancer, nil)))
+	if err != nil {
+		t.Fatalf("expected the rendered config to be valid, got %v", err)
+	}
+	if len(config.Listeners) != 2 || config.Listeners[1].Protocol != "UDP" || config.Listeners[1].Port != 53 {
+		t.Fatalf("expected a listener per balancer port, got %v", config.Listeners)
+	}
+	expected := proxy.Backend{Name: "v2", Address: "example-balancer-v2-backend:53", Weight: 80}
+	if backend := config.Listeners[1].Backends[1]; backend != expected {
+		t.Errorf("expected backend %v, got %v", expected, backend)
+	}
+}
+
+func TestNewConfigEndpoints(t *testing.T) {
+	balancer := &balancerv1alpha1.Balancer{
+		ObjectMeta: v1.ObjectMeta{Name: "example-balancer", Namespace: "default"},
+		Spec: balancerv1alpha1.BalancerSpec{
+			Ports: []balancerv1alpha1.BalancerPort{
+				{Name: "http", Protocol: balancerv1alpha1.TCP, Port: 80},
+				{Name: "dns", Protocol: balancerv1alpha1.UDP, Port: 53},
+			},
+			Backends: []balancerv1alpha1.BackendSpec{{Name: "v1", Weight: 20}, {Name: "v2", Weight: 80}},
+		},
+	}
+	endpoints := upstream.Endpoints{
+		"v1": {"http": {"10.0.0.1:5678", "10.0.0.2:5678"}},
+		"v2": {"http": {"10.0.1.1:8080"}},
+	}
+
+	config, err := proxy.ParseConfig([]byte(NewConfig(balancer, endpoints)))
+	if err != nil {
+		t.Fatalf("expected the rendered config to be valid, got %v", err)
+	}
+	expected := []proxy.Backend{
+		{Name: "v1", Address: "10.0.0.1:5678", Weight: 20},
+		{Name: "v1", Address: "10.0.0.2:5678", Weight: 20},
+		{Name: "v2", Address: "10.0.1.1:8080", Weight: 160},
+	}
+	if backends := config.Listeners[0].Backends; !reflect.DeepEqual(backends, expected) {
+		t.Errorf("expected backends %v, got %v", expected, backends)
+	}
+	// the port without endpoints falls back to the backend services
+	if backend := config.Listeners[1].Backends[0]; backend.Address != "example-balancer-v1-backend:53" {
+		t.Errorf("expected the backend service, got %v", backend)
+	}
+}
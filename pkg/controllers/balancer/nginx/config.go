@@ -0,0 +1,102 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nginx
+
+import (
+	"strings"
+)
+
+// Directive is a directive of nginx config, e.g., `listen 80;` or `upstream name { ... }`.
+type Directive struct {
+	Name   string
+	Params []string
+	// Block tells whether the directive is a block directive, whose Children are enclosed in braces.
+	Block    bool
+	Children []Directive
+	// Line is the line of the directive in the parsed config, zero for a generated directive.
+	Line int
+}
+
+// Config is a whole nginx config, i.e., the directives in the main context.
+type Config []Directive
+
+// NewDirective creates a simple directive.
+func NewDirective(name string, params ...string) Directive {
+	return Directive{Name: name, Params: params}
+}
+
+// NewBlock creates a block directive.
+func NewBlock(name string, params []string, children ...Directive) Directive {
+	return Directive{Name: name, Params: params, Block: true, Children: children}
+}
+
+// String prints the config with 4-space indentation. The output is deterministic for the same Config.
+func (c Config) String() string {
+	var b strings.Builder
+	for _, d := range c {
+		d.print(&b, 0)
+	}
+	return b.String()
+}
+
+func (d Directive) print(b *strings.Builder, depth int) {
+	indent := strings.Repeat("    ", depth)
+	b.WriteString(indent)
+	b.WriteString(d.Name)
+	for _, param := range d.Params {
+		b.WriteByte(' ')
+		b.WriteString(Quote(param))
+	}
+	if !d.Block {
+		b.WriteString(";\n")
+		return
+	}
+	b.WriteString(" {\n")
+	for _, child := range d.Children {
+		child.print(b, depth+1)
+	}
+	b.WriteString(indent)
+	b.WriteString("}\n")
+}
+
+// Quote quotes param if it cannot be a bare word of nginx config,
+// i.e., it is empty, or contains spaces, quotes, braces, ';', '#' or '\'. A bare word is printed as it is.
+// Note that nginx has no escape for '$', the variables in param are always interpolated.
+func Quote(param string) string {
+	if param != "" && !strings.ContainsAny(param, " \t\r\n\"'{};#\\") {
+		return param
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range param {
+		switch c {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nginx
+
+import (
+	balancerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/upstream"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"path"
+)
+
+const (
+	// DefaultImage is the image of the nginx container if Balancer.Spec.ProxyTemplate does not specify one.
+	DefaultImage = "nginx:1.15.9"
+	// ConfigDir is where nginx reads nginx.conf.
+	ConfigDir = "/etc/nginx"
+	// ConfigFile is the name of the nginx config.
+	ConfigFile = "nginx.conf"
+)
+
+// DataPlane runs nginx as the proxy of Balancer.
+type DataPlane struct{}
+
+func (DataPlane) Render(balancer *balancerv1alpha1.Balancer, endpoints upstream.Endpoints) string {
+	return NewConfig(balancer, endpoints)
+}
+
+// Validate rejects the metrics of the pod endpoint upstreams, since the exporter sidecar tells the backend of
+// an upstream server by the backend service. nginx proxies both TCP and UDP.
+func (DataPlane) Validate(balancer *balancerv1alpha1.Balancer) field.ErrorList {
+	var allErrs field.ErrorList
+	if balancer.Spec.Metrics != nil && balancer.Spec.UpstreamMode == balancerv1alpha1.UpstreamModeEndpoints {
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "metrics"),
+			"the metrics are not supported by the nginx data plane when upstreamMode is endpoints"))
+	}
+	return allErrs
+}
+
+func (DataPlane) CheckConfig(config []byte) error {
+	return CheckConfig(config)
+}
+
+func (DataPlane) ConfigDir() string {
+	return ConfigDir
+}
+
+func (DataPlane) ConfigFile() string {
+	return ConfigFile
+}
+
+func (DataPlane) Container() corev1.Container {
+	return corev1.Container{
+		Name:  "nginx",
+		Image: DefaultImage,
+	}
+}
+
+func (DataPlane) HealthCheck() (int32, string) {
+	return HealthPort, HealthPath
+}
+
+// ReloadArgs signals the nginx master process with SIGHUP, which starts new workers with the new config
+// and shuts down the old workers gracefully.
+func (DataPlane) ReloadArgs() []string {
+	return []string{
+		"--config-file=" + path.Join(ConfigDir, ConfigFile),
+		"--format=nginx",
+		"--process=nginx: master process",
+		"--signal=SIGHUP",
+	}
+}
@@ -19,67 +19,27 @@ package nginx
 import (
 	"fmt"
 	balancerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
-	"strings"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/upstream"
+	"regexp"
+	"strconv"
 )
 
-// server serves for a typical port with a specific reverse proxy.
-type server struct {
-	name     string
-	protocol string
-	port     int32
-	upstream string // server.upstream will be processed exactly by an upstream
-}
-
-// conf returns the config segment for the key `server` in nginx.conf.
-// Example:
-// server {
-//     listen 80 tcp;
-//     proxy_pass upstream_http;
-// }
-func (s *server) conf() string {
-	var protocol string
-	if s.protocol == "udp" {
-		protocol = "udp"
-	}
-	return fmt.Sprintf(`
-server {
-    listen %d %s;
-    proxy_pass %s;
-}
-`, s.port, protocol, s.upstream)
-}
-
-// backend is a backend service.
-type backend struct {
-	name   string
-	weight int32
-}
+const (
+	// HealthPort is the port of the built-in health listener, which is used by the probes of the proxy container.
+	HealthPort int32 = 8099
+	// HealthPath is the path of the built-in health listener.
+	HealthPath = "/healthz"
+	// StubStatusPath is the path of the stub_status on the health listener, which is only allowed from localhost.
+	StubStatusPath = "/stub_status"
+	// AccessLogAddress is the syslog address the access log of the stream sessions is sent to in json.
+	AccessLogAddress = "127.0.0.1:5140"
+)
 
-// upstream acts as the value of the key `proxy_pass` in nginx.conf.
-type upstream struct {
-	name     string
-	backends []backend
-	port     int32
-}
-
-// conf returns the config segment for the key `upstream` in nginx.conf.
-// Example：
-// upstream upstream_http {
-//     server example-balancer-v1-backend:80 weight=40;
-//     server example-balancer-v2-backend:80 weight=20;
-//     server example-balancer-v3-backend:80 weight=40;
-// }
-func (us *upstream) conf() string {
-	backendStr := ""
-	for _, b := range us.backends {
-		backendStr += fmt.Sprintf("    server %s:%d weight=%d;\n", b.name, us.port, b.weight)
-	}
-	return fmt.Sprintf(`
-upstream %s {
-%s
-}
-`, us.name, backendStr)
-}
+// AccessLogFormat is the json access log of a stream session, which is read by the exporter sidecar.
+// $upstream_addr lists all the tried upstreams, e.g., "10.96.0.10:80, 10.96.0.11:80".
+const AccessLogFormat = `{"port":"$server_port","protocol":"$protocol","status":"$status",` +
+	`"upstream":"$upstream_addr","bytes_sent":"$bytes_sent","bytes_received":"$bytes_received",` +
+	`"session_time":"$session_time"}`
 
 // NewConfig generates the `nginx.conf` with the given Balancer instance.
 // Example:
@@ -89,58 +49,116 @@ upstream %s {
 // }
 // stream {
 //     server {
-//         listen 80 tcp;
+//         listen 80;
 //         proxy_pass upstream_http;
 //     }
 //     upstream upstream_http {
 //         server example-balancer-v1-backend:80 weight=20;
 //         server example-balancer-v2-backend:80 weight=80;
+//         server example-balancer-v3-backend:80 down;
+//     }
+// }
+// http {
+//     server {
+//         listen 8099;
+//         location /healthz {
+//             return 200 ok;
+//         }
 //     }
 // }
 // ======================================================
-func NewConfig(balancer *balancerv1alpha1.Balancer) string {
-	var servers []server
-	for _, balancerPort := range balancer.Spec.Ports {
-		servers = append(servers, server{
-			name:     balancerPort.Name,
-			protocol: strings.ToLower(string(balancerPort.Protocol)),
-			port:     int32(balancerPort.Port),
-			upstream: fmt.Sprintf("upstream_%s", balancerPort.Name),
-		})
+// The http block is the built-in health listener. It answers only after the whole config is loaded,
+// thus it tells the readiness and liveness of the nginx instance.
+// If endpoints is not nil, the upstream servers are the pod endpoints of the backends instead of the backend services,
+// e.g., `server 10.244.0.12:5678 weight=40;`.
+func NewConfig(balancer *balancerv1alpha1.Balancer, endpoints upstream.Endpoints) string {
+	return NewConfigModel(balancer, endpoints).String()
+}
+
+// NewConfigModel generates the structured `nginx.conf` with the given Balancer instance, see NewConfig.
+func NewConfigModel(balancer *balancerv1alpha1.Balancer, endpoints upstream.Endpoints) Config {
+	var servers, upstreams []Directive
+	for _, port := range balancer.Spec.Ports {
+		upstreamName := UpstreamName(port.Name)
+		servers = append(servers, newServer(port, upstreamName))
+		upstreams = append(upstreams, newUpstream(balancer, endpoints, port, upstreamName))
 	}
 
-	var backends []backend
-	for _, balancerBackend := range balancer.Spec.Backends {
-		backends = append(backends, backend{
-			name:   fmt.Sprintf("%s-%s-backend", balancer.Name, balancerBackend.Name),
-			weight: balancerBackend.Weight,
-		})
+	stream := NewBlock("stream", nil, append(servers, upstreams...)...)
+	healthServer := NewBlock("server", nil,
+		NewDirective("listen", strconv.Itoa(int(HealthPort))),
+		NewBlock("location", []string{HealthPath},
+			NewDirective("return", "200", "ok"),
+		),
+	)
+	if balancer.Spec.Metrics != nil {
+		// the exporter sidecar reads the access log and the stub_status
+		stream.Children = append([]Directive{
+			NewDirective("log_format", "balancer", "escape=json", AccessLogFormat),
+			NewDirective("access_log", "syslog:server="+AccessLogAddress+",tag=balancer", "balancer"),
+		}, stream.Children...)
+		healthServer.Children = append(healthServer.Children,
+			NewBlock("location", []string{StubStatusPath},
+				NewDirective("stub_status"),
+				NewDirective("allow", "127.0.0.1"),
+				NewDirective("deny", "all"),
+			),
+		)
 	}
 
-	var upstreams []upstream
-	for _, s := range servers {
-		upstreams = append(upstreams, upstream{
-			name:     s.upstream,
-			backends: backends,
-			port:     s.port,
-		})
+	return Config{
+		NewBlock("events", nil,
+			NewDirective("worker_connections", "1024"),
+		),
+		stream,
+		NewBlock("http", nil, healthServer),
 	}
+}
 
-	conf := ""
-	conf += "events {\n"
-	conf += "    worker_connections 1024;\n"
-	conf += "}\n"
-	conf += "stream {\n"
+// newServer returns the `server` block which proxies a balancer port to the upstream.
+func newServer(port balancerv1alpha1.BalancerPort, upstreamName string) Directive {
+	listen := NewDirective("listen", strconv.Itoa(int(port.Port)))
+	if port.Protocol == balancerv1alpha1.UDP {
+		listen.Params = append(listen.Params, "udp")
+	}
+	return NewBlock("server", nil,
+		listen,
+		NewDirective("proxy_pass", upstreamName),
+	)
+}
 
-	for _, s := range servers {
-		conf += s.conf()
+// newUpstream returns the `upstream` block of the backend services of a balancer port.
+// The backend service exposes the balancer port, which is mapped to the (possibly overridden) targetPort of each backend.
+// The pod endpoints of the backends are used instead if there are any of the port.
+func newUpstream(balancer *balancerv1alpha1.Balancer, endpoints upstream.Endpoints,
+	port balancerv1alpha1.BalancerPort, upstreamName string) Directive {
+
+	block := NewBlock("upstream", []string{upstreamName})
+	if servers := endpoints.Servers(balancer, port.Name); servers != nil {
+		for _, server := range servers {
+			block.Children = append(block.Children, newUpstreamServer(server.Address, server.Weight))
+		}
+		return block
 	}
+	for _, backend := range balancer.Spec.Backends {
+		address := fmt.Sprintf("%s-%s-backend:%d", balancer.Name, backend.Name, port.Port)
+		block.Children = append(block.Children, newUpstreamServer(address, backend.Weight))
+	}
+	return block
+}
 
-	for _, us := range upstreams {
-		conf += us.conf()
+func newUpstreamServer(address string, weight int32) Directive {
+	if weight == 0 {
+		// nginx does not accept weight=0, mark the drained backend as down instead
+		return NewDirective("server", address, "down")
 	}
+	return NewDirective("server", address, fmt.Sprintf("weight=%d", weight))
+}
 
-	conf += "}\n"
+var invalidUpstreamNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
 
-	return conf
+// UpstreamName returns the name of the upstream of a balancer port.
+// The characters which may be interpreted by nginx (e.g., '$') are replaced with '_'.
+func UpstreamName(portName string) string {
+	return "upstream_" + invalidUpstreamNameChars.ReplaceAllString(portName, "_")
 }
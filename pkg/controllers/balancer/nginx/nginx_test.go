@@ -0,0 +1,127 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nginx
+
+import (
+	"flag"
+	balancerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/upstream"
+	"io/ioutil"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+func newTestBalancer(ports []balancerv1alpha1.BalancerPort, backends ...balancerv1alpha1.BackendSpec) *balancerv1alpha1.Balancer {
+	return &balancerv1alpha1.Balancer{
+		ObjectMeta: v1.ObjectMeta{Name: "example-balancer", Namespace: "default"},
+		Spec: balancerv1alpha1.BalancerSpec{
+			Ports:    ports,
+			Backends: backends,
+		},
+	}
+}
+
+var (
+	httpPort  = balancerv1alpha1.BalancerPort{Name: "http", Protocol: balancerv1alpha1.TCP, Port: 80}
+	dnsPort   = balancerv1alpha1.BalancerPort{Name: "dns", Protocol: balancerv1alpha1.UDP, Port: 53}
+	backendV1 = balancerv1alpha1.BackendSpec{Name: "v1", Weight: 20}
+	backendV2 = balancerv1alpha1.BackendSpec{Name: "v2", Weight: 80}
+)
+
+func TestNewConfigGolden(t *testing.T) {
+	cases := []struct {
+		name     string
+		balancer *balancerv1alpha1.Balancer
+	}{
+		{"tcp", newTestBalancer([]balancerv1alpha1.BalancerPort{httpPort}, backendV1, backendV2)},
+		{"udp", newTestBalancer([]balancerv1alpha1.BalancerPort{dnsPort}, backendV1, backendV2)},
+		{"multiple-ports", newTestBalancer([]balancerv1alpha1.BalancerPort{httpPort, dnsPort}, backendV1, backendV2)},
+		{"drained-backend", newTestBalancer([]balancerv1alpha1.BalancerPort{httpPort}, backendV1, backendV2,
+			balancerv1alpha1.BackendSpec{Name: "v3", Weight: 0})},
+		{"single-backend", newTestBalancer([]balancerv1alpha1.BalancerPort{httpPort}, backendV1)},
+		{"no-ports", newTestBalancer(nil, backendV1, backendV2)},
+		{"metrics", func() *balancerv1alpha1.Balancer {
+			balancer := newTestBalancer([]balancerv1alpha1.BalancerPort{httpPort, dnsPort}, backendV1, backendV2)
+			balancer.Spec.Metrics = &balancerv1alpha1.MetricsSpec{}
+			return balancer
+		}()},
+		{"unsafe-port-name", newTestBalancer([]balancerv1alpha1.BalancerPort{
+			{Name: "web$host;", Protocol: balancerv1alpha1.TCP, Port: 8080},
+		}, backendV1)},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			checkGolden(t, c.name, NewConfig(c.balancer, nil))
+		})
+	}
+}
+
+func TestNewConfigEndpoints(t *testing.T) {
+	balancer := newTestBalancer([]balancerv1alpha1.BalancerPort{httpPort, dnsPort}, backendV1, backendV2,
+		balancerv1alpha1.BackendSpec{Name: "v3", Weight: 0})
+	endpoints := upstream.Endpoints{
+		"v1": {"http": {"10.0.0.1:5678", "10.0.0.2:5678"}},
+		"v2": {"http": {"10.0.1.1:8080"}},
+		"v3": {"http": {"10.0.2.1:5678"}},
+	}
+	// the dns port without endpoints falls back to the backend services
+	checkGolden(t, "pod-endpoints", NewConfig(balancer, endpoints))
+}
+
+// checkGolden compares actual with testdata/<name>.conf, which is overwritten by actual with -update.
+func checkGolden(t *testing.T, name, actual string) {
+	golden := filepath.Join("testdata", name+".conf")
+	if *update {
+		if err := ioutil.WriteFile(golden, []byte(actual), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != string(expected) {
+		t.Errorf("config differs from %s, run go test with -update if it is expected:\n%s", golden, actual)
+	}
+}
+
+func TestConfigString(t *testing.T) {
+	config := Config{
+		NewDirective("worker_processes", "auto"),
+		NewBlock("http", nil,
+			NewDirective("log_format", "main", `$remote_addr "$request"`),
+			NewBlock("location", []string{"~", "^/api/{v1}"},
+				NewDirective("return", "200", ""),
+			),
+		),
+	}
+	expected := `worker_processes auto;
+http {
+    log_format main "$remote_addr \"$request\"";
+    location ~ "^/api/{v1}" {
+        return 200 "";
+    }
+}
+`
+	if actual := config.String(); actual != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, actual)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nginx
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	wordToken tokenKind = iota
+	semicolonToken
+	openBraceToken
+	closeBraceToken
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	line int
+}
+
+// tokenize splits data into words and the special characters ';', '{' and '}'.
+// Comments are skipped, and a quoted string is a single word with the escapes resolved.
+func tokenize(data []byte) ([]token, error) {
+	var tokens []token
+	line := 1
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '\n':
+			line++
+		case c == ' ' || c == '\t' || c == '\r':
+		case c == '#':
+			for i+1 < len(data) && data[i+1] != '\n' {
+				i++
+			}
+		case c == ';':
+			tokens = append(tokens, token{kind: semicolonToken, text: ";", line: line})
+		case c == '{':
+			tokens = append(tokens, token{kind: openBraceToken, text: "{", line: line})
+		case c == '}':
+			tokens = append(tokens, token{kind: closeBraceToken, text: "}", line: line})
+		case c == '"' || c == '\'':
+			start := line
+			var b strings.Builder
+			for i++; ; i++ {
+				if i == len(data) {
+					return nil, fmt.Errorf("line %d: unterminated quoted string", start)
+				}
+				if data[i] == c {
+					break
+				}
+				if data[i] == '\\' && i+1 < len(data) {
+					i++
+					switch data[i] {
+					case 'n':
+						b.WriteByte('\n')
+					case 'r':
+						b.WriteByte('\r')
+					case 't':
+						b.WriteByte('\t')
+					case '"', '\'', '\\':
+						b.WriteByte(data[i])
+					default:
+						// nginx keeps the unknown escapes as they are
+						b.WriteByte('\\')
+						b.WriteByte(data[i])
+					}
+					continue
+				}
+				if data[i] == '\n' {
+					line++
+				}
+				b.WriteByte(data[i])
+			}
+			tokens = append(tokens, token{kind: wordToken, text: b.String(), line: start})
+		default:
+			start := i
+			for i+1 < len(data) && !strings.ContainsRune(" \t\r\n;{}#\"'", rune(data[i+1])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: wordToken, text: string(data[start : i+1]), line: line})
+		}
+	}
+	return tokens, nil
+}
+
+// Parse parses the syntax of nginx config into a Config.
+// It checks that every directive is terminated and the blocks are balanced, but not the semantics, see Validate.
+func Parse(data []byte) (Config, error) {
+	tokens, err := tokenize(data)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	config, err := p.parseDirectives(false)
+	if err != nil {
+		return nil, err
+	}
+	return Config(config), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parseDirectives parses the directives until the end of the tokens, or the '}' closing the block.
+func (p *parser) parseDirectives(inBlock bool) ([]Directive, error) {
+	var directives []Directive
+	for p.pos < len(p.tokens) {
+		t := p.tokens[p.pos]
+		switch t.kind {
+		case closeBraceToken:
+			if !inBlock {
+				return nil, fmt.Errorf("line %d: unexpected \"}\"", t.line)
+			}
+			p.pos++
+			return directives, nil
+		case semicolonToken, openBraceToken:
+			return nil, fmt.Errorf("line %d: unexpected %q", t.line, t.text)
+		}
+
+		directive := Directive{Name: t.text, Line: t.line}
+		for p.pos++; ; p.pos++ {
+			if p.pos == len(p.tokens) {
+				return nil, fmt.Errorf("line %d: directive %q is not terminated by \";\"", t.line, t.text)
+			}
+			next := p.tokens[p.pos]
+			if next.kind == wordToken {
+				directive.Params = append(directive.Params, next.text)
+				continue
+			}
+			if next.kind == closeBraceToken {
+				return nil, fmt.Errorf("line %d: directive %q is not terminated by \";\"", t.line, t.text)
+			}
+			p.pos++
+			if next.kind == openBraceToken {
+				children, err := p.parseDirectives(true)
+				if err != nil {
+					return nil, err
+				}
+				directive.Block = true
+				directive.Children = children
+			}
+			break
+		}
+		directives = append(directives, directive)
+	}
+	if inBlock {
+		return nil, fmt.Errorf("unexpected end of file, expecting \"}\"")
+	}
+	return directives, nil
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nginx
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		name   string
+		config string
+		valid  bool
+	}{
+		{"valid", "events {\n    worker_connections 1024;\n}\nstream {\n    server {\n        listen 80;\n        proxy_pass \"up;stream\";\n    }\n}\n", true},
+		{"comment", "# a comment with { and ;\nworker_processes 1;\n", true},
+		{"unterminated directive", "worker_processes 1\n", false},
+		{"unbalanced block", "stream {\n    server {\n    }\n", false},
+		{"extra close", "stream {\n}\n}\n", false},
+		{"unterminated quote", "error_log \"/var/log;\n", false},
+		{"directive before close", "stream {\n    listen 80\n}\n", false},
+		{"block without directive", "{\n}\n", false},
+	}
+	for _, c := range cases {
+		_, err := Parse([]byte(c.config))
+		if c.valid && err != nil {
+			t.Errorf("%s: expected valid, got %v", c.name, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("%s: expected invalid", c.name)
+		}
+	}
+
+	config, err := Parse([]byte("log_format main \"$remote_addr \\\"$request\\\"\"; # the format\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := config[0]; d.Name != "log_format" || len(d.Params) != 2 || d.Params[1] != `$remote_addr "$request"` {
+		t.Errorf("expected the quoted param unescaped, got %v", d)
+	}
+}
+
+// The generated configs are parsed back to the same model, and are valid.
+func TestParseGolden(t *testing.T) {
+	goldens, err := filepath.Glob(filepath.Join("testdata", "*.conf"))
+	if err != nil || len(goldens) == 0 {
+		t.Fatalf("expected golden files, got %v", err)
+	}
+	for _, golden := range goldens {
+		data, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := Parse(data)
+		if err != nil {
+			t.Errorf("%s: %v", golden, err)
+			continue
+		}
+		if printed := config.String(); printed != string(data) {
+			t.Errorf("%s: expected the parsed config printed as it is, got:\n%s", golden, printed)
+		}
+		if err = Validate(config); err != nil {
+			t.Errorf("%s: %v", golden, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"unknown directive", "stream {\n    server {\n        listen 80;\n        proxy_cache on;\n    }\n}\n",
+			`line 4: directive "proxy_cache" is not allowed in stream/server`},
+		{"wrong context", "events {\n    listen 80;\n}\n",
+			`line 2: directive "listen" is not allowed in events`},
+		{"missing block", "stream;\n",
+			`line 1: directive "stream" has no block`},
+		{"parameters", "stream {\n    upstream a b {\n    }\n}\n",
+			`line 2: invalid number of parameters in "upstream"`},
+		{"duplicate listen", "stream {\n    server {\n        listen 80;\n        proxy_pass 127.0.0.1:80;\n    }\n}\n" +
+			"http {\n    server {\n        listen 80;\n    }\n}\n",
+			`line 9: duplicate listen 80/tcp, already listened at line 3`},
+		{"udp in http", "http {\n    server {\n        listen 53 udp;\n    }\n}\n",
+			`line 3: udp is not allowed in http/server`},
+		{"undefined upstream", "stream {\n    server {\n        listen 80;\n        proxy_pass upstream_http;\n    }\n}\n",
+			`line 4: upstream "upstream_http" is not defined`},
+	}
+	for _, c := range cases {
+		config, err := Parse([]byte(c.config))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		err = Validate(config)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected %q, got %v", c.name, c.err, err)
+		}
+	}
+
+	// the same port is allowed for TCP and UDP
+	if err := CheckConfig([]byte("stream {\n    server {\n        listen 53;\n        proxy_pass 127.0.0.1:53;\n    }\n" +
+		"    server {\n        listen 53 udp;\n        proxy_pass 127.0.0.1:53;\n    }\n}\n")); err != nil {
+		t.Errorf("expected valid, got %v", err)
+	}
+}
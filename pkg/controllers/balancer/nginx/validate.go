@@ -0,0 +1,176 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nginx
+
+import (
+	"fmt"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"strconv"
+	"strings"
+)
+
+// directiveSpec describes where a directive is allowed and how many parameters it takes.
+type directiveSpec struct {
+	block     bool
+	minParams int
+	// -1 means unlimited
+	maxParams int
+}
+
+// knownDirectives are the directives generated by NewConfig, by the context they are allowed in.
+// A context is the path of the enclosing block names, e.g., "stream/server".
+var knownDirectives = map[string]map[string]directiveSpec{
+	"main": {
+		"events":           {block: true},
+		"stream":           {block: true},
+		"http":             {block: true},
+		"worker_processes": {minParams: 1, maxParams: 1},
+		"error_log":        {minParams: 1, maxParams: 2},
+		"pid":              {minParams: 1, maxParams: 1},
+	},
+	"events": {
+		"worker_connections": {minParams: 1, maxParams: 1},
+	},
+	"stream": {
+		"server":     {block: true},
+		"upstream":   {block: true, minParams: 1, maxParams: 1},
+		"log_format": {minParams: 2, maxParams: -1},
+		"access_log": {minParams: 1, maxParams: -1},
+	},
+	"stream/server": {
+		"listen":                {minParams: 1, maxParams: -1},
+		"proxy_pass":            {minParams: 1, maxParams: 1},
+		"proxy_timeout":         {minParams: 1, maxParams: 1},
+		"proxy_connect_timeout": {minParams: 1, maxParams: 1},
+	},
+	"stream/upstream": {
+		"server": {minParams: 1, maxParams: -1},
+	},
+	"http": {
+		"server": {block: true},
+	},
+	"http/server": {
+		"listen":   {minParams: 1, maxParams: -1},
+		"location": {block: true, minParams: 1, maxParams: 2},
+	},
+	"http/server/location": {
+		"return":      {minParams: 1, maxParams: 2},
+		"stub_status": {minParams: 0, maxParams: 0},
+		"allow":       {minParams: 1, maxParams: 1},
+		"deny":        {minParams: 1, maxParams: 1},
+	},
+}
+
+// Validate checks the semantics of config against the subset of nginx generated by NewConfig:
+// the directives are known and placed in the right context with the right number of parameters,
+// no port is listened twice, and every proxy_pass refers to a defined upstream.
+func Validate(config Config) error {
+	v := &validator{listens: map[string]int{}, upstreams: map[string]bool{}}
+	v.validateDirectives("main", config)
+	for _, proxyPass := range v.proxyPasses {
+		if !v.upstreams[proxyPass.Params[0]] {
+			v.errs = append(v.errs, fmt.Errorf("line %d: upstream %q is not defined", proxyPass.Line, proxyPass.Params[0]))
+		}
+	}
+	return utilerrors.NewAggregate(v.errs)
+}
+
+// CheckConfig parses and validates the nginx config.
+func CheckConfig(data []byte) error {
+	config, err := Parse(data)
+	if err != nil {
+		return err
+	}
+	return Validate(config)
+}
+
+type validator struct {
+	errs []error
+	// "<port>/<protocol>" -> the line of the first listen
+	listens     map[string]int
+	upstreams   map[string]bool
+	proxyPasses []Directive
+}
+
+func (v *validator) validateDirectives(context string, directives []Directive) {
+	specs := knownDirectives[context]
+	for _, d := range directives {
+		spec, ok := specs[d.Name]
+		if !ok {
+			v.errs = append(v.errs, fmt.Errorf("line %d: directive %q is not allowed in %s", d.Line, d.Name, context))
+			continue
+		}
+		if spec.block != d.Block {
+			if spec.block {
+				v.errs = append(v.errs, fmt.Errorf("line %d: directive %q has no block", d.Line, d.Name))
+			} else {
+				v.errs = append(v.errs, fmt.Errorf("line %d: directive %q does not take a block", d.Line, d.Name))
+			}
+			continue
+		}
+		if len(d.Params) < spec.minParams || (spec.maxParams >= 0 && len(d.Params) > spec.maxParams) {
+			v.errs = append(v.errs, fmt.Errorf("line %d: invalid number of parameters in %q", d.Line, d.Name))
+			continue
+		}
+
+		switch {
+		case d.Name == "listen":
+			v.validateListen(context, d)
+		case context == "stream" && d.Name == "upstream":
+			if v.upstreams[d.Params[0]] {
+				v.errs = append(v.errs, fmt.Errorf("line %d: duplicate upstream %q", d.Line, d.Params[0]))
+			}
+			v.upstreams[d.Params[0]] = true
+		case d.Name == "proxy_pass" && !strings.ContainsAny(d.Params[0], ":$"):
+			// an address or a variable is not an upstream name
+			v.proxyPasses = append(v.proxyPasses, d)
+		}
+
+		if d.Block {
+			v.validateDirectives(strings.TrimPrefix(context+"/"+d.Name, "main/"), d.Children)
+		}
+	}
+}
+
+// validateListen checks the port of a listen directive is a valid port which is not listened yet.
+func (v *validator) validateListen(context string, d Directive) {
+	address := d.Params[0]
+	if i := strings.LastIndex(address, ":"); i >= 0 {
+		address = address[i+1:]
+	}
+	port, err := strconv.Atoi(address)
+	if err != nil || port <= 0 || port > 65535 {
+		v.errs = append(v.errs, fmt.Errorf("line %d: invalid port in %q", d.Line, d.Params[0]))
+		return
+	}
+
+	protocol := "tcp"
+	for _, param := range d.Params[1:] {
+		if param == "udp" {
+			if !strings.HasPrefix(context, "stream") {
+				v.errs = append(v.errs, fmt.Errorf("line %d: udp is not allowed in %s", d.Line, context))
+			}
+			protocol = "udp"
+		}
+	}
+	key := fmt.Sprintf("%d/%s", port, protocol)
+	if line, ok := v.listens[key]; ok {
+		v.errs = append(v.errs, fmt.Errorf("line %d: duplicate listen %s, already listened at line %d", d.Line, key, line))
+		return
+	}
+	v.listens[key] = d.Line
+}
@@ -0,0 +1,257 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"context"
+	"fmt"
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	appv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"testing"
+)
+
+// faultyClient injects the error returned by inject into the requests of the wrapped client.
+type faultyClient struct {
+	client.Client
+	// inject returns the error of a request, e.g., ("apply", *v1.Deployment), or nil to pass it through
+	inject func(verb string, obj runtime.Object) error
+}
+
+func (c *faultyClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if err := c.inject("get", obj); err != nil {
+		return err
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func (c *faultyClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if err := c.inject("list", list); err != nil {
+		return err
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+func (c *faultyClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if err := c.inject("create", obj); err != nil {
+		return err
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c *faultyClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if err := c.inject("update", obj); err != nil {
+		return err
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func (c *faultyClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	verb := "patch"
+	if patch == client.Apply {
+		verb = "apply"
+	}
+	if err := c.inject(verb, obj); err != nil {
+		return err
+	}
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func (c *faultyClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	if err := c.inject("delete", obj); err != nil {
+		return err
+	}
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+func (c *faultyClient) Status() client.StatusWriter {
+	return &faultyStatusWriter{StatusWriter: c.Client.Status(), inject: c.inject}
+}
+
+type faultyStatusWriter struct {
+	client.StatusWriter
+	inject func(verb string, obj runtime.Object) error
+}
+
+func (w *faultyStatusWriter) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if err := w.inject("update-status", obj); err != nil {
+		return err
+	}
+	return w.StatusWriter.Update(ctx, obj, opts...)
+}
+
+// newFaultyReconciler returns the reconciler of balancer whose requests fail with err once they match verb and obj,
+// after the resources of balancer are synced without any fault and balancer is changed if synced is true.
+func newFaultyReconciler(t *testing.T, balancer *exposerv1alpha1.Balancer, synced bool,
+	verb string, obj runtime.Object, err error) *ReconcilerBalancer {
+
+	scheme := newTestScheme(t)
+	faulty := &faultyClient{
+		Client: newTestClient(scheme, balancer),
+		inject: func(string, runtime.Object) error { return nil },
+	}
+	r := &ReconcilerBalancer{client: faulty, scheme: scheme, recorder: record.NewFakeRecorder(100)}
+	if synced {
+		if _, err := r.Reconcile(context.Background(), testRequest(balancer)); err != nil {
+			t.Fatal(err)
+		}
+		// a new port changes every resource, otherwise nothing is applied again
+		found := &exposerv1alpha1.Balancer{}
+		if err := r.client.Get(context.Background(), testRequest(balancer).NamespacedName, found); err != nil {
+			t.Fatal(err)
+		}
+		found.Spec.Ports = append(found.Spec.Ports, exposerv1alpha1.BalancerPort{
+			Name: "https", Protocol: exposerv1alpha1.TCP, Port: 443, TargetPort: intstr.FromInt(8443),
+		})
+		if err := r.client.Update(context.Background(), found); err != nil {
+			t.Fatal(err)
+		}
+	}
+	faulty.inject = func(v string, o runtime.Object) error {
+		if v == verb && fmt.Sprintf("%T", o) == fmt.Sprintf("%T", obj) {
+			return err
+		}
+		return nil
+	}
+	return r
+}
+
+func testRequest(balancer *exposerv1alpha1.Balancer) reconcile.Request {
+	return reconcile.Request{NamespacedName: types.NamespacedName{Namespace: balancer.Namespace, Name: balancer.Name}}
+}
+
+func TestReconcileRequeuesTransientErrors(t *testing.T) {
+	cases := []struct {
+		verb   string
+		obj    runtime.Object
+		synced bool
+	}{
+		{"get", &exposerv1alpha1.Balancer{}, false},
+		{"update-status", &exposerv1alpha1.Balancer{}, false},
+		{"apply", &corev1.Service{}, false},
+		{"apply", &corev1.ConfigMap{}, false},
+		{"apply", &appv1.Deployment{}, false},
+		{"get", &corev1.Service{}, true},
+		{"list", &corev1.ServiceList{}, true},
+		{"apply", &corev1.Service{}, true},
+		{"get", &corev1.ConfigMap{}, true},
+		{"apply", &corev1.ConfigMap{}, true},
+		{"get", &appv1.Deployment{}, true},
+		{"apply", &appv1.Deployment{}, true},
+	}
+	for _, c := range cases {
+		name := fmt.Sprintf("%s %T", c.verb, c.obj)
+		balancer := newTestBalancer()
+		internalErr := errors.NewInternalError(fmt.Errorf("injected"))
+		r := newFaultyReconciler(t, balancer, c.synced, c.verb, c.obj, internalErr)
+
+		if _, err := r.Reconcile(context.Background(), testRequest(balancer)); err == nil {
+			t.Errorf("%s: expected the error returned to be requeued with backoff", name)
+		}
+	}
+}
+
+func TestReconcileRequeuesConflicts(t *testing.T) {
+	balancer := newTestBalancer()
+	conflict := errors.NewConflict(schema.GroupResource{Group: "apps", Resource: "deployments"},
+		DeploymentName(balancer), fmt.Errorf("injected"))
+	r := newFaultyReconciler(t, balancer, true, "apply", &appv1.Deployment{}, conflict)
+
+	result, err := r.Reconcile(context.Background(), testRequest(balancer))
+	if err != nil || !result.Requeue {
+		t.Errorf("expected a conflict to be requeued at once, got %v %v", result, err)
+	}
+	found := &exposerv1alpha1.Balancer{}
+	if err = r.client.Get(context.Background(), types.NamespacedName{Namespace: balancer.Namespace, Name: balancer.Name}, found); err != nil {
+		t.Fatal(err)
+	}
+	condition := meta.FindStatusCondition(found.Status.Conditions, exposerv1alpha1.SyncedCondition)
+	if condition == nil || condition.Reason != exposerv1alpha1.ReasonConflict {
+		t.Errorf("expected the Synced condition to tell the conflict, got %v", condition)
+	}
+}
+
+func TestReconcileSurfacesTerminalErrors(t *testing.T) {
+	balancer := newTestBalancer()
+	invalid := errors.NewInvalid(schema.GroupKind{Group: "apps", Kind: "Deployment"}, DeploymentName(balancer), nil)
+	r := newFaultyReconciler(t, balancer, false, "apply", &appv1.Deployment{}, invalid)
+
+	result, err := r.Reconcile(context.Background(), testRequest(balancer))
+	if err != nil || result.Requeue {
+		t.Errorf("expected a terminal error not to be retried, got %v %v", result, err)
+	}
+	found := &exposerv1alpha1.Balancer{}
+	if err = r.client.Get(context.Background(), types.NamespacedName{Namespace: balancer.Namespace, Name: balancer.Name}, found); err != nil {
+		t.Fatal(err)
+	}
+	condition := meta.FindStatusCondition(found.Status.Conditions, exposerv1alpha1.SyncedCondition)
+	if condition == nil || condition.Status != "False" || condition.Reason != exposerv1alpha1.ReasonTerminalError {
+		t.Errorf("expected the Synced condition to tell the terminal error, got %v", condition)
+	}
+	// the phases which do not depend on the deployment are still synced
+	if err = r.client.Get(context.Background(), types.NamespacedName{Namespace: balancer.Namespace, Name: ConfigMapName(balancer)},
+		&corev1.ConfigMap{}); err != nil {
+		t.Errorf("expected the configmap synced, got %v", err)
+	}
+}
+
+func TestReconcileSynced(t *testing.T) {
+	balancer := newTestBalancer()
+	r := newFaultyReconciler(t, balancer, true, "", nil, nil)
+	// a second reconcile finds every resource, including the deployment
+	if _, err := r.Reconcile(context.Background(), testRequest(balancer)); err != nil {
+		t.Fatal(err)
+	}
+	found := &exposerv1alpha1.Balancer{}
+	if err := r.client.Get(context.Background(), types.NamespacedName{Namespace: balancer.Namespace, Name: balancer.Name}, found); err != nil {
+		t.Fatal(err)
+	}
+	if !meta.IsStatusConditionTrue(found.Status.Conditions, exposerv1alpha1.SyncedCondition) {
+		t.Errorf("expected the Synced condition to be true, got %v", found.Status.Conditions)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	gr := schema.GroupResource{Resource: "services"}
+	cases := []struct {
+		err      error
+		expected errorClass
+	}{
+		{errors.NewInternalError(fmt.Errorf("boom")), errorTransient},
+		{errors.NewServerTimeout(gr, "get", 1), errorTransient},
+		{errors.NewForbidden(gr, "svc", fmt.Errorf("exceeded quota")), errorTransient},
+		{errors.NewConflict(gr, "svc", fmt.Errorf("stale")), errorConflict},
+		{errors.NewAlreadyExists(gr, "svc"), errorConflict},
+		{errors.NewBadRequest("bad"), errorTerminal},
+		{terminal(fmt.Errorf("invalid config")), errorTerminal},
+		{phaseError{phase: phaseConfigMap, err: terminal(fmt.Errorf("invalid config"))}, errorTerminal},
+	}
+	for i, c := range cases {
+		if class := classifyError(c.err); class != c.expected {
+			t.Errorf("%d: expected class %d of %v, got %d", i, c.expected, c.err, class)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/envoy"
+	"github.com/hliangzhao/balancer/pkg/reloader"
+	appv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"net"
+	"net/http"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// proxyStatusPollPeriod is how often the proxy pods are polled until all of them apply the newest config.
+const proxyStatusPollPeriod = 5 * time.Second
+
+// proxyStatusTimeout bounds the time spent on polling all the proxy pods of a Balancer in a reconcile.
+const proxyStatusTimeout = 2 * time.Second
+
+// proxyStatusClient fetches the status of the reloader sidecars.
+var proxyStatusClient = &http.Client{}
+
+// syncProxyStatus records the hash of the rendered proxy config in Balancer.Status.ConfigHash,
+// and the config applied by each proxy pod in Balancer.Status.Proxies when the config is reloaded in place.
+// The envoy proxy pods report the version of the resources served over xDS instead.
+// The returned result requeues the request until every proxy pod applies the newest config.
+func (r *ReconcilerBalancer) syncProxyStatus(balancer *exposerv1alpha1.Balancer) (reconcile.Result, error) {
+	foundCm := &corev1.ConfigMap{}
+	err := r.client.Get(context.Background(), types.NamespacedName{Namespace: balancer.Namespace, Name: ConfigMapName(balancer)}, foundCm)
+	if err != nil && !errors.IsNotFound(err) {
+		return reconcile.Result{}, err
+	}
+	configHash := foundCm.Annotations[exposerv1alpha1.ConfigMapHashKey]
+
+	var proxies []exposerv1alpha1.ProxyStatus
+	isEnvoy := balancer.Spec.DataPlane == exposerv1alpha1.DataPlaneEnvoy
+	if balancer.Spec.ReloadMode == exposerv1alpha1.ReloadModeHotReload || isEnvoy {
+		var podList corev1.PodList
+		if err = r.client.List(context.Background(), &podList, client.InNamespace(balancer.Namespace),
+			client.MatchingLabels(NewPodLabels(balancer))); err != nil {
+			return reconcile.Result{}, err
+		}
+		getStatus := getProxyStatus
+		if isEnvoy {
+			configHash = r.xds.Version(envoy.NodeCluster(balancer))
+			getStatus = r.getNodeStatus(balancer)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), proxyStatusTimeout)
+		proxies = newProxyStatuses(ctx, podList.Items, getStatus)
+		cancel()
+	}
+
+	var result reconcile.Result
+	for _, proxy := range proxies {
+		if proxy.ConfigHash != configHash {
+			result.RequeueAfter = proxyStatusPollPeriod
+			break
+		}
+	}
+
+	if balancer.Status.ConfigHash == configHash && reflect.DeepEqual(balancer.Status.Proxies, proxies) {
+		return result, nil
+	}
+	balancer.Status.ConfigHash = configHash
+	balancer.Status.Proxies = proxies
+	if err = r.client.Status().Update(context.Background(), balancer); err != nil {
+		return reconcile.Result{}, err
+	}
+	log.Info("Sync Proxy Status", balancer.Name, "updated")
+	return result, nil
+}
+
+// proxiesRunConfig tells whether every proxy pod runs the synced proxy configmap cm.
+// The pods reloading the config in place report the hash of the applied config in Balancer.Status.Proxies,
+// which is synced by syncProxyStatus. So do the envoy pods, whose config is the resources served over xDS,
+// of the version in Balancer.Status.ConfigHash. Otherwise, the pods are restarted by the rollout of the proxy
+// deployment, which completes once every pod is created from the pod template with the hash of cm.
+func (r *ReconcilerBalancer) proxiesRunConfig(balancer *exposerv1alpha1.Balancer, cm *corev1.ConfigMap) (bool, error) {
+	isEnvoy := balancer.Spec.DataPlane == exposerv1alpha1.DataPlaneEnvoy
+	if balancer.Spec.ReloadMode == exposerv1alpha1.ReloadModeHotReload || isEnvoy {
+		configHash := cm.Annotations[exposerv1alpha1.ConfigMapHashKey]
+		if isEnvoy {
+			configHash = balancer.Status.ConfigHash
+		}
+		for _, proxy := range balancer.Status.Proxies {
+			if proxy.ConfigHash != configHash {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	foundDp := &appv1.Deployment{}
+	err := r.client.Get(context.Background(), types.NamespacedName{Namespace: balancer.Namespace, Name: DeploymentName(balancer)}, foundDp)
+	if errors.IsNotFound(err) {
+		// no proxy pod forwards any traffic
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return foundDp.Spec.Template.Annotations[exposerv1alpha1.ConfigMapHashKey] == ConfigMapHash(cm) &&
+		foundDp.Status.ObservedGeneration >= foundDp.Generation &&
+		foundDp.Status.UpdatedReplicas == foundDp.Status.Replicas, nil
+}
+
+// newProxyStatuses returns the status of each proxy pod, which is sorted by the pod name.
+// The pods are polled concurrently, a pod which does not answer before ctx is done is reported as unreachable.
+func newProxyStatuses(ctx context.Context, pods []corev1.Pod,
+	getStatus func(ctx context.Context, pod *corev1.Pod) (*reloader.Status, error)) []exposerv1alpha1.ProxyStatus {
+
+	var proxies []exposerv1alpha1.ProxyStatus
+	for i := range pods {
+		if pods[i].DeletionTimestamp == nil {
+			proxies = append(proxies, exposerv1alpha1.ProxyStatus{Pod: pods[i].Name})
+		}
+	}
+	wg := sync.WaitGroup{}
+	j := 0
+	for i := range pods {
+		pod := &pods[i]
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		// each coroutine fills in its own proxy status only
+		proxy := &proxies[j]
+		j++
+		if pod.Status.Phase != corev1.PodRunning || pod.Status.PodIP == "" {
+			proxy.Message = "pod is not running"
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if status, err := getStatus(ctx, pod); err != nil {
+				proxy.Message = err.Error()
+			} else {
+				proxy.ConfigHash = status.ConfigHash
+				proxy.Message = status.Error
+			}
+		}()
+	}
+	wg.Wait()
+	sort.Slice(proxies, func(i, j int) bool {
+		return proxies[i].Pod < proxies[j].Pod
+	})
+	return proxies
+}
+
+// getProxyStatus fetches the status of the reloader sidecar of pod.
+func getProxyStatus(ctx context.Context, pod *corev1.Pod) (*reloader.Status, error) {
+	url := fmt.Sprintf("http://%s%s", net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(int(reloader.Port))), reloader.StatusPath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := proxyStatusClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s from the reloader", resp.Status)
+	}
+	status := &reloader.Status{}
+	if err = json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
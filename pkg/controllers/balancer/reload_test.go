@@ -0,0 +1,95 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"github.com/hliangzhao/balancer/pkg/reloader"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+func TestNewProxyStatuses(t *testing.T) {
+	now := metav1.Now()
+	pods := []corev1.Pod{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "proxy-c"},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.0.0.3"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "proxy-a"},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.0.0.1"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "proxy-b"},
+			Status:     corev1.PodStatus{Phase: corev1.PodPending},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "proxy-d", DeletionTimestamp: &now},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.0.0.4"},
+		},
+	}
+	proxies := newProxyStatuses(context.Background(), pods, func(_ context.Context, pod *corev1.Pod) (*reloader.Status, error) {
+		if pod.Status.PodIP == "10.0.0.3" {
+			return nil, fmt.Errorf("connection refused")
+		}
+		return &reloader.Status{ConfigHash: "abc"}, nil
+	})
+
+	if len(proxies) != 3 {
+		t.Fatalf("expected the terminating pod skipped, got %v", proxies)
+	}
+	if proxies[0].Pod != "proxy-a" || proxies[0].ConfigHash != "abc" || proxies[0].Message != "" {
+		t.Errorf("expected proxy-a to apply abc, got %v", proxies[0])
+	}
+	if proxies[1].Pod != "proxy-b" || proxies[1].ConfigHash != "" || proxies[1].Message == "" {
+		t.Errorf("expected proxy-b not running, got %v", proxies[1])
+	}
+	if proxies[2].Pod != "proxy-c" || proxies[2].Message != "connection refused" {
+		t.Errorf("expected proxy-c unreachable, got %v", proxies[2])
+	}
+}
+
+func TestNewProxyStatusesDeadline(t *testing.T) {
+	var pods []corev1.Pod
+	for i := 0; i < 10; i++ {
+		pods = append(pods, corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("proxy-%d", i)},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIP: fmt.Sprintf("10.0.0.%d", i)},
+		})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// every pod hangs until the deadline, which is shared by all of them rather than spent one after another
+	start := time.Now()
+	proxies := newProxyStatuses(ctx, pods, func(ctx context.Context, pod *corev1.Pod) (*reloader.Status, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the pods to be polled concurrently, took %v", elapsed)
+	}
+	for _, proxy := range proxies {
+		if proxy.Message != context.DeadlineExceeded.Error() {
+			t.Errorf("expected %s unreachable, got %v", proxy.Pod, proxy)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"context"
+	"fmt"
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"hash/fnv"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	randutil "k8s.io/apimachinery/pkg/util/rand"
+	hashutil "k8s.io/kubernetes/pkg/util/hash"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"time"
+)
+
+// syncRollout advances the rollout of Balancer step by step and records the progress in Balancer.Status.Rollout.
+// The returned result requeues the request when the pause of the current step expires.
+func (r *ReconcilerBalancer) syncRollout(balancer *exposerv1alpha1.Balancer) (reconcile.Result, error) {
+	rollout := balancer.Spec.Rollout
+	if rollout == nil {
+		// no rollout (anymore), clear the status
+		if balancer.Status.Rollout == nil {
+			return reconcile.Result{}, nil
+		}
+		balancer.Status.Rollout = nil
+		return reconcile.Result{}, r.client.Status().Update(context.Background(), balancer)
+	}
+
+	now := v1.Now()
+	actualStatus := balancer.Status.Rollout.DeepCopy()
+	if actualStatus == nil || actualStatus.RolloutHash != RolloutHash(rollout) {
+		// a new rollout is started from the first step
+		actualStatus = &exposerv1alpha1.RolloutStatus{
+			Phase:         exposerv1alpha1.RolloutProgressing,
+			CurrentStep:   0,
+			StepStartedAt: &now,
+			RolloutHash:   RolloutHash(rollout),
+		}
+	}
+
+	// the promote and abort annotations are consumed once read,
+	// the merge patch removes them without overwriting the spec changed in the meantime
+	_, promote := balancer.Annotations[exposerv1alpha1.RolloutPromoteKey]
+	_, abort := balancer.Annotations[exposerv1alpha1.RolloutAbortKey]
+	if promote || abort {
+		patch := client.MergeFrom(balancer.DeepCopy())
+		delete(balancer.Annotations, exposerv1alpha1.RolloutPromoteKey)
+		delete(balancer.Annotations, exposerv1alpha1.RolloutAbortKey)
+		if err := r.client.Patch(context.Background(), balancer, patch); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	var requeueAfter time.Duration
+	target := findBackend(balancer, rollout.TargetBackend)
+	switch {
+	case actualStatus.Phase == exposerv1alpha1.RolloutAborted:
+		// nothing to do until the rollout is changed
+	case abort:
+		actualStatus.Phase = exposerv1alpha1.RolloutAborted
+		actualStatus.Message = "aborted manually"
+	case target == nil:
+		actualStatus.Phase = exposerv1alpha1.RolloutAborted
+		actualStatus.Message = fmt.Sprintf("target backend %s not found", rollout.TargetBackend)
+	case target.Weight == 0:
+		actualStatus.Phase = exposerv1alpha1.RolloutAborted
+		actualStatus.Message = fmt.Sprintf("target backend %s is drained", rollout.TargetBackend)
+	case actualStatus.Phase == exposerv1alpha1.RolloutCompleted:
+		// the weights of the last step are kept until the rollout is changed
+	default:
+		requeueAfter = advanceRollout(rollout, actualStatus, promote, now)
+	}
+
+	if reflect.DeepEqual(balancer.Status.Rollout, actualStatus) {
+		return reconcile.Result{RequeueAfter: requeueAfter}, nil
+	}
+	balancer.Status.Rollout = actualStatus
+	if err := r.client.Status().Update(context.Background(), balancer); err != nil {
+		return reconcile.Result{}, err
+	}
+	log.Info("Sync Rollout", balancer.Name, fmt.Sprintf("step %d %s", actualStatus.CurrentStep, actualStatus.Phase))
+	return reconcile.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// advanceRollout moves status forward through the steps of rollout until a step which should be waited on.
+// It returns how long to wait before the current step expires, or zero if no waiting is required.
+func advanceRollout(rollout *exposerv1alpha1.RolloutSpec, status *exposerv1alpha1.RolloutStatus,
+	promote bool, now v1.Time) time.Duration {
+
+	for {
+		step := rollout.Steps[status.CurrentStep]
+		switch {
+		case promote:
+			// promotion skips the (rest of) pause of the current step only
+			promote = false
+		case step.Pause == nil:
+			// no pause, advance to the next step directly
+		case step.Pause.Duration == nil:
+			status.Phase = exposerv1alpha1.RolloutPaused
+			status.Message = "waiting for promotion"
+			return 0
+		default:
+			if remaining := status.StepStartedAt.Add(step.Pause.Duration.Duration).Sub(now.Time); remaining > 0 {
+				status.Phase = exposerv1alpha1.RolloutProgressing
+				status.Message = ""
+				return remaining
+			}
+		}
+
+		if int(status.CurrentStep) == len(rollout.Steps)-1 {
+			status.Phase = exposerv1alpha1.RolloutCompleted
+			status.Message = ""
+			return 0
+		}
+		status.CurrentStep++
+		status.StepStartedAt = &now
+	}
+}
+
+// rolloutWeights returns the backend weights of the current rollout step, or nil if no rollout is in effect.
+// The target backend receives the step weight in percentage,
+// and the rest of the traffic is shared by the other backends in proportion to their own weights.
+func rolloutWeights(balancer *exposerv1alpha1.Balancer) map[string]int32 {
+	rollout, status := balancer.Spec.Rollout, balancer.Status.Rollout
+	if rollout == nil || status == nil || status.RolloutHash != RolloutHash(rollout) ||
+		status.Phase == exposerv1alpha1.RolloutAborted || int(status.CurrentStep) >= len(rollout.Steps) {
+		return nil
+	}
+	// a drained target receives no traffic, the rollout is aborted by syncRollout
+	target := findBackend(balancer, rollout.TargetBackend)
+	if target == nil || target.Weight == 0 {
+		return nil
+	}
+
+	percentage := rollout.Steps[status.CurrentStep].Weight
+	var othersTotal int32
+	for _, backend := range balancer.Spec.Backends {
+		if backend.Name != target.Name {
+			othersTotal += backend.Weight
+		}
+	}
+	if othersTotal == 0 {
+		// the target backend is the only backend
+		return map[string]int32{target.Name: target.Weight}
+	}
+
+	// target : others = percentage : (100 - percentage)
+	weights := map[string]int32{target.Name: percentage * othersTotal}
+	for _, backend := range balancer.Spec.Backends {
+		if backend.Name != target.Name {
+			weights[backend.Name] = (100 - percentage) * backend.Weight
+		}
+	}
+
+	// keep the weights small
+	var divisor int32
+	for _, weight := range weights {
+		divisor = gcd(divisor, weight)
+	}
+	for name := range weights {
+		weights[name] /= divisor
+	}
+	return weights
+}
+
+// RolloutHash returns the hash of rollout, which is used to detect the change of Balancer.Spec.Rollout.
+func RolloutHash(rollout *exposerv1alpha1.RolloutSpec) string {
+	hasher := fnv.New32a()
+	hashutil.DeepHashObject(hasher, rollout)
+	return randutil.SafeEncodeString(fmt.Sprint(hasher.Sum32()))
+}
+
+func findBackend(balancer *exposerv1alpha1.Balancer, name string) *exposerv1alpha1.BackendSpec {
+	for i := range balancer.Spec.Backends {
+		if balancer.Spec.Backends[i].Name == name {
+			return &balancer.Spec.Backends[i]
+		}
+	}
+	return nil
+}
+
+func gcd(a, b int32) int32 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"context"
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"testing"
+	"time"
+)
+
+func newTestRollout() *exposerv1alpha1.RolloutSpec {
+	return &exposerv1alpha1.RolloutSpec{
+		TargetBackend: "v2",
+		Steps: []exposerv1alpha1.RolloutStep{
+			{Weight: 5, Pause: &exposerv1alpha1.RolloutPause{Duration: &metav1.Duration{Duration: time.Minute}}},
+			{Weight: 25, Pause: &exposerv1alpha1.RolloutPause{}},
+			{Weight: 50},
+			{Weight: 100},
+		},
+	}
+}
+
+func TestAdvanceRollout(t *testing.T) {
+	rollout := newTestRollout()
+	start := metav1.NewTime(time.Now())
+	status := &exposerv1alpha1.RolloutStatus{
+		Phase:         exposerv1alpha1.RolloutProgressing,
+		StepStartedAt: &start,
+		RolloutHash:   RolloutHash(rollout),
+	}
+
+	// still pausing on the first step
+	if requeueAfter := advanceRollout(rollout, status, false, metav1.NewTime(start.Add(time.Second))); requeueAfter != 59*time.Second {
+		t.Errorf("expected to requeue after 59s, got %v", requeueAfter)
+	}
+	if status.CurrentStep != 0 || status.Phase != exposerv1alpha1.RolloutProgressing {
+		t.Errorf("expected to stay on step 0, got step %d %s", status.CurrentStep, status.Phase)
+	}
+
+	// the pause expires, and the second step waits for promotion
+	advanceRollout(rollout, status, false, metav1.NewTime(start.Add(time.Minute)))
+	if status.CurrentStep != 1 || status.Phase != exposerv1alpha1.RolloutPaused {
+		t.Errorf("expected to pause on step 1, got step %d %s", status.CurrentStep, status.Phase)
+	}
+
+	// the promotion goes through the steps without pause
+	advanceRollout(rollout, status, true, metav1.NewTime(start.Add(2*time.Minute)))
+	if status.CurrentStep != 3 || status.Phase != exposerv1alpha1.RolloutCompleted {
+		t.Errorf("expected to complete on step 3, got step %d %s", status.CurrentStep, status.Phase)
+	}
+}
+
+func TestRolloutWeights(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.Backends = append(balancer.Spec.Backends, exposerv1alpha1.BackendSpec{Name: "v3", Weight: 20})
+	balancer.Spec.Rollout = newTestRollout()
+	balancer.Status.Rollout = &exposerv1alpha1.RolloutStatus{
+		Phase:       exposerv1alpha1.RolloutPaused,
+		CurrentStep: 1,
+		RolloutHash: RolloutHash(balancer.Spec.Rollout),
+	}
+
+	// v2 gets 25%, v1 and v3 share the rest with 40:20
+	expected := map[string]int32{"v1": 2, "v2": 1, "v3": 1}
+	if weights := rolloutWeights(balancer); !reflect.DeepEqual(weights, expected) {
+		t.Errorf("expected weights %v, got %v", expected, weights)
+	}
+
+	// a drained target receives no traffic
+	balancer.Spec.Backends[1].Weight = 0
+	if weights := rolloutWeights(balancer); weights != nil {
+		t.Errorf("expected no rollout weights for the drained target, got %v", weights)
+	}
+	balancer.Spec.Backends[1].Weight = 60
+
+	// the original weights are restored once aborted
+	balancer.Status.Rollout.Phase = exposerv1alpha1.RolloutAborted
+	if weights := rolloutWeights(balancer); weights != nil {
+		t.Errorf("expected no rollout weights after aborted, got %v", weights)
+	}
+	if effective := EffectiveBalancer(balancer, nil); !reflect.DeepEqual(effective.Spec.Backends, balancer.Spec.Backends) {
+		t.Errorf("expected the original backends, got %v", effective.Spec.Backends)
+	}
+}
+
+func TestSyncRolloutDrainedTarget(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.Backends[1].Weight = 0
+	balancer.Spec.Rollout = newTestRollout()
+	scheme := newTestScheme(t)
+	r := &ReconcilerBalancer{client: newTestClient(scheme, balancer), scheme: scheme, recorder: record.NewFakeRecorder(10)}
+
+	if _, err := r.syncRollout(balancer); err != nil {
+		t.Fatal(err)
+	}
+	if status := balancer.Status.Rollout; status == nil || status.Phase != exposerv1alpha1.RolloutAborted {
+		t.Errorf("expected the rollout to the drained target to be aborted, got %v", status)
+	}
+	if weights := rolloutWeights(balancer); weights != nil {
+		t.Errorf("expected no rollout weights, got %v", weights)
+	}
+}
+
+func TestSyncRolloutConsumesAnnotations(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.Rollout = newTestRollout()
+	balancer.Annotations = map[string]string{exposerv1alpha1.RolloutPromoteKey: "", "kept": "true"}
+	scheme := newTestScheme(t)
+	r := &ReconcilerBalancer{client: newTestClient(scheme, balancer), scheme: scheme, recorder: record.NewFakeRecorder(10)}
+	read := &exposerv1alpha1.Balancer{}
+	if err := r.client.Get(context.Background(), client.ObjectKeyFromObject(balancer), read); err != nil {
+		t.Fatal(err)
+	}
+
+	// the spec is changed after the balancer was read
+	changed := read.DeepCopy()
+	changed.Spec.Backends[0].Weight = 10
+	if err := r.client.Update(context.Background(), changed); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.syncRollout(read); err != nil {
+		t.Fatal(err)
+	}
+	found := &exposerv1alpha1.Balancer{}
+	if err := r.client.Get(context.Background(), client.ObjectKeyFromObject(balancer), found); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := found.Annotations[exposerv1alpha1.RolloutPromoteKey]; ok || found.Annotations["kept"] != "true" {
+		t.Errorf("expected only the promote annotation to be removed, got %v", found.Annotations)
+	}
+	if found.Spec.Backends[0].Weight != 10 {
+		t.Errorf("expected the changed spec to be kept, got weight %d", found.Spec.Backends[0].Weight)
+	}
+}
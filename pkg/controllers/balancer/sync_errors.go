@@ -0,0 +1,152 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	goerrors "errors"
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"strings"
+)
+
+// errorClass decides how a failed sync phase is retried.
+type errorClass int
+
+const (
+	// errorTerminal is not fixed by retrying, e.g., an object refused by the apiserver.
+	// It is only surfaced in the Synced condition, the Balancer is synced again once it (or a child) changes.
+	errorTerminal errorClass = iota
+	// errorConflict is caused by a stale read of the cache, the request is requeued at once (rate limited).
+	errorConflict
+	// errorTransient is returned to controller-runtime, which requeues the request with exponential backoff.
+	errorTransient
+)
+
+// terminalError marks an error as terminal, see errorTerminal.
+type terminalError struct {
+	err error
+}
+
+func (e *terminalError) Error() string {
+	return e.err.Error()
+}
+
+func (e *terminalError) Unwrap() error {
+	return e.err
+}
+
+// terminal marks err as terminal.
+func terminal(err error) error {
+	return &terminalError{err: err}
+}
+
+// classifyError returns the class of err. The errors are transient unless known otherwise,
+// e.g., a Forbidden error may be caused by an exceeded quota, which is released later.
+func classifyError(err error) errorClass {
+	var terminalErr *terminalError
+	switch {
+	case goerrors.As(err, &terminalErr):
+		return errorTerminal
+	case errors.IsConflict(err), errors.IsAlreadyExists(err):
+		return errorConflict
+	case errors.IsInvalid(err), errors.IsBadRequest(err), errors.IsMethodNotSupported(err),
+		errors.IsNotAcceptable(err), errors.IsRequestEntityTooLargeError(err), meta.IsNoMatchError(err):
+		return errorTerminal
+	default:
+		return errorTransient
+	}
+}
+
+// phaseError is the error of a sync phase.
+type phaseError struct {
+	phase string
+	err   error
+}
+
+func (e phaseError) Error() string {
+	return e.phase + ": " + e.err.Error()
+}
+
+func (e phaseError) Unwrap() error {
+	return e.err
+}
+
+// syncErrors aggregates the errors of the sync phases of a reconcile.
+type syncErrors []phaseError
+
+func (errs syncErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// class returns the most retryable class of errs.
+func (errs syncErrors) class() errorClass {
+	class := errorTerminal
+	for _, err := range errs {
+		if c := classifyError(err.err); c > class {
+			class = c
+		}
+	}
+	return class
+}
+
+// finishSync records the result of the sync phases in the Synced condition,
+// and decides how the request is requeued according to the class of errs.
+func (r *ReconcilerBalancer) finishSync(balancer *exposerv1alpha1.Balancer, errs syncErrors,
+	result reconcile.Result) (reconcile.Result, error) {
+
+	condition := v1.Condition{
+		Type:   exposerv1alpha1.SyncedCondition,
+		Status: v1.ConditionTrue,
+		Reason: exposerv1alpha1.ReasonSynced,
+	}
+	if len(errs) > 0 {
+		condition.Status = v1.ConditionFalse
+		condition.Message = errs.Error()
+		switch errs.class() {
+		case errorTransient:
+			condition.Reason = exposerv1alpha1.ReasonTransientError
+		case errorConflict:
+			condition.Reason = exposerv1alpha1.ReasonConflict
+		default:
+			condition.Reason = exposerv1alpha1.ReasonTerminalError
+		}
+	}
+	if err := r.setCondition(balancer, condition); err != nil {
+		errs = append(errs, phaseError{phase: phaseStatus, err: err})
+	}
+
+	if len(errs) == 0 {
+		recordSuccessfulSync(balancer)
+		return result, nil
+	}
+	switch errs.class() {
+	case errorTransient:
+		return reconcile.Result{}, errs
+	case errorConflict:
+		return reconcile.Result{Requeue: true}, nil
+	default:
+		log.Info("Sync Balancer", balancer.Name, "failed", "error", errs.Error())
+		return result, nil
+	}
+}
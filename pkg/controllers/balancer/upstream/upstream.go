@@ -0,0 +1,81 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package upstream describes the pod endpoints which the proxy forwards the traffic of the backends to directly,
+// when Balancer.Spec.UpstreamMode is endpoints.
+package upstream
+
+import (
+	balancerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+)
+
+// Endpoints holds the addresses (ip:port) of the ready pod endpoints of each backend,
+// by the name of the backend and then the name of the balancer port.
+// A nil Endpoints forwards the traffic to the backend services.
+type Endpoints map[string]map[string][]string
+
+// Server is a pod endpoint of a backend rendered into an upstream.
+type Server struct {
+	Backend string
+	Address string
+	Weight  int32
+}
+
+// Servers returns the pod endpoints of the balancer port portName of all the backends of balancer,
+// in the order of the backends. The weight of each backend is split across its endpoints, e.g., a backend of
+// weight 20 with 2 endpoints and another of weight 80 with 4 endpoints get 40 and 80 for each endpoint, which keeps
+// the traffic share of the backends (up to rounding). A drained backend keeps its endpoints with weight 0.
+// A backend without any ready endpoint of the port is left out and receives no traffic of the port, instead of falling
+// back to its backend service, which has no ready endpoint to forward to either, see Unserved.
+// It returns nil if no backend has any endpoint of the port, the proxy forwards the traffic to the backend services then.
+func (e Endpoints) Servers(balancer *balancerv1alpha1.Balancer, portName string) []Server {
+	// every endpoint weighs at least the weight of its backend, thus a non-zero weight never rounds to 0
+	maxEndpoints := 0
+	for _, backend := range balancer.Spec.Backends {
+		if n := len(e[backend.Name][portName]); n > maxEndpoints {
+			maxEndpoints = n
+		}
+	}
+	if maxEndpoints == 0 {
+		return nil
+	}
+
+	var servers []Server
+	for _, backend := range balancer.Spec.Backends {
+		addresses := e[backend.Name][portName]
+		n := int64(len(addresses))
+		for _, address := range addresses {
+			weight := (2*int64(backend.Weight)*int64(maxEndpoints) + n) / (2 * n)
+			servers = append(servers, Server{Backend: backend.Name, Address: address, Weight: int32(weight)})
+		}
+	}
+	return servers
+}
+
+// Unserved returns the names of the backends of balancer which are left out of the Servers of the balancer port
+// portName, i.e., the backends of a non-zero weight without any ready endpoint of the port.
+func (e Endpoints) Unserved(balancer *balancerv1alpha1.Balancer, portName string) []string {
+	if e.Servers(balancer, portName) == nil {
+		return nil
+	}
+	var names []string
+	for _, backend := range balancer.Spec.Backends {
+		if backend.Weight > 0 && len(e[backend.Name][portName]) == 0 {
+			names = append(names, backend.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upstream
+
+import (
+	balancerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"reflect"
+	"testing"
+)
+
+func TestServers(t *testing.T) {
+	balancer := &balancerv1alpha1.Balancer{
+		Spec: balancerv1alpha1.BalancerSpec{
+			Backends: []balancerv1alpha1.BackendSpec{
+				{Name: "v1", Weight: 20},
+				{Name: "v2", Weight: 80},
+				{Name: "v3", Weight: 0},
+			},
+		},
+	}
+	endpoints := Endpoints{
+		"v1": {"http": {"10.0.0.1:5678", "10.0.0.2:5678"}},
+		"v2": {"http": {"10.0.1.1:8080", "10.0.1.2:8080", "10.0.1.3:8080"}},
+		"v3": {"http": {"10.0.2.1:5678"}},
+	}
+
+	expected := []Server{
+		{Backend: "v1", Address: "10.0.0.1:5678", Weight: 30},
+		{Backend: "v1", Address: "10.0.0.2:5678", Weight: 30},
+		{Backend: "v2", Address: "10.0.1.1:8080", Weight: 80},
+		{Backend: "v2", Address: "10.0.1.2:8080", Weight: 80},
+		{Backend: "v2", Address: "10.0.1.3:8080", Weight: 80},
+		{Backend: "v3", Address: "10.0.2.1:5678", Weight: 0},
+	}
+	if servers := endpoints.Servers(balancer, "http"); !reflect.DeepEqual(servers, expected) {
+		t.Errorf("expected %v, got %v", expected, servers)
+	}
+
+	if unserved := endpoints.Unserved(balancer, "http"); unserved != nil {
+		t.Errorf("expected every backend to be served, got %v", unserved)
+	}
+
+	// a backend without any ready endpoint gets no traffic
+	delete(endpoints, "v1")
+	for _, server := range endpoints.Servers(balancer, "http") {
+		if server.Backend == "v1" {
+			t.Errorf("expected no server of v1, got %v", server)
+		}
+	}
+	if unserved := endpoints.Unserved(balancer, "http"); !reflect.DeepEqual(unserved, []string{"v1"}) {
+		t.Errorf("expected v1 to be unserved, got %v", unserved)
+	}
+
+	if servers := endpoints.Servers(balancer, "dns"); servers != nil {
+		t.Errorf("expected no server of a port without endpoints, got %v", servers)
+	}
+	// the port falls back to the backend services as a whole
+	if unserved := endpoints.Unserved(balancer, "dns"); unserved != nil {
+		t.Errorf("expected no unserved backend of a port without endpoints, got %v", unserved)
+	}
+	if servers := Endpoints(nil).Servers(balancer, "http"); servers != nil {
+		t.Errorf("expected no server without endpoints, got %v", servers)
+	}
+}
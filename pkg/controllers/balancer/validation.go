@@ -0,0 +1,230 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"context"
+	"fmt"
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/dataplane"
+	"github.com/hliangzhao/balancer/pkg/exporter"
+	"github.com/hliangzhao/balancer/pkg/reloader"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// ValidateBalancer checks the constraints of Balancer.Spec which cannot be expressed by the CRD schema.
+func ValidateBalancer(balancer *exposerv1alpha1.Balancer) field.ErrorList {
+	var allErrs field.ErrorList
+
+	backendsPath := field.NewPath("spec", "backends")
+	allDrained := true
+	for _, backend := range balancer.Spec.Backends {
+		if backend.Weight > 0 {
+			allDrained = false
+			break
+		}
+	}
+	if allDrained {
+		allErrs = append(allErrs, field.Invalid(backendsPath, len(balancer.Spec.Backends),
+			"at least one backend should have a non-zero weight"))
+	}
+
+	if availability := balancer.Spec.Availability; availability != nil &&
+		availability.MinAvailable != nil && availability.MaxUnavailable != nil {
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "availability", "maxUnavailable"),
+			"minAvailable and maxUnavailable are mutually exclusive"))
+	}
+
+	// a backend service deleted at once may still receive the in-flight connections of the proxy
+	if balancer.Spec.DrainPeriod != nil && balancer.Spec.DrainPeriod.Duration <= 0 {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "drainPeriod"), balancer.Spec.DrainPeriod.Duration.String(),
+			"must be positive"))
+	}
+
+	if autoscaling := balancer.Spec.Autoscaling; autoscaling != nil &&
+		autoscaling.MinReplicas != nil && *autoscaling.MinReplicas > autoscaling.MaxReplicas {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "autoscaling", "minReplicas"),
+			*autoscaling.MinReplicas, "must not be greater than maxReplicas"))
+	}
+
+	// the proxy config changes with the endpoints, i.e., their addresses or the weights derived from their number,
+	// which should not restart the proxy pods each time, while envoy receives the changes over xDS
+	if balancer.Spec.ReloadMode != exposerv1alpha1.ReloadModeHotReload &&
+		balancer.Spec.DataPlane != exposerv1alpha1.DataPlaneEnvoy {
+		reloadModePath := field.NewPath("spec", "reloadMode")
+		if balancer.Spec.UpstreamMode == exposerv1alpha1.UpstreamModeEndpoints {
+			allErrs = append(allErrs, field.Invalid(reloadModePath, balancer.Spec.ReloadMode,
+				"must be HotReload when upstreamMode is endpoints"))
+		} else if balancer.Spec.WeightMode == exposerv1alpha1.WeightModeEndpoints {
+			allErrs = append(allErrs, field.Invalid(reloadModePath, balancer.Spec.ReloadMode,
+				"must be HotReload when weightMode is endpoints"))
+		}
+	}
+
+	dataPlane := dataplane.For(balancer)
+	allErrs = append(allErrs, dataPlane.Validate(balancer)...)
+
+	healthPort, _ := dataPlane.HealthCheck()
+	portNames := map[string]bool{}
+	for _, port := range balancer.Spec.Ports {
+		portNames[port.Name] = true
+	}
+	for i, port := range balancer.Spec.Ports {
+		if int32(port.Port) == healthPort {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "ports").Index(i).Child("port"), port.Port,
+				"the port is reserved by the health listener of the proxy"))
+		}
+		if int32(port.Port) == reloader.Port && balancer.Spec.ReloadMode == exposerv1alpha1.ReloadModeHotReload {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "ports").Index(i).Child("port"), port.Port,
+				"the port is reserved by the reloader sidecar of the proxy"))
+		}
+		if int32(port.Port) == exporter.Port && needsExporter(balancer) {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "ports").Index(i).Child("port"), port.Port,
+				"the port is reserved by the exporter sidecar of the proxy"))
+		}
+	}
+	// an override which matches no balancer port would be ignored silently
+	for i, backend := range balancer.Spec.Backends {
+		for j, override := range backend.Ports {
+			overridePath := backendsPath.Index(i).Child("ports").Index(j).Child("name")
+			switch {
+			case override.Name == "" && len(balancer.Spec.Ports) != 1:
+				allErrs = append(allErrs, field.Required(overridePath,
+					"the name is required unless there is exactly one balancer port"))
+			case override.Name != "" && !portNames[override.Name]:
+				allErrs = append(allErrs, field.NotFound(overridePath, override.Name))
+			}
+		}
+	}
+
+	if balancer.Spec.Frontend != nil {
+		allErrs = append(allErrs, validateFrontend(balancer, field.NewPath("spec", "frontend"), balancer.Spec.Frontend, portNames)...)
+	}
+	frontendNames := map[string]bool{}
+	for i, frontend := range balancer.Spec.Frontends {
+		frontendPath := field.NewPath("spec", "frontends").Index(i)
+		allErrs = append(allErrs, validateFrontend(balancer, frontendPath, &frontend.FrontendSpec, portNames)...)
+		if frontendNames[frontend.Name] {
+			allErrs = append(allErrs, field.Duplicate(frontendPath.Child("name"), frontend.Name))
+		}
+		frontendNames[frontend.Name] = true
+		// the frontend service would be overwritten by the backend service of the same name in turn
+		svcName := FrontendServiceName(balancer, frontend.Name)
+		for _, backend := range balancer.Spec.Backends {
+			if svcName == BackendServiceName(balancer, backend.Name) {
+				allErrs = append(allErrs, field.Invalid(frontendPath.Child("name"), frontend.Name,
+					fmt.Sprintf("the frontend service %s collides with the backend service of backend %s", svcName, backend.Name)))
+			}
+		}
+		for j, portName := range frontend.Ports {
+			if !portNames[portName] {
+				allErrs = append(allErrs, field.NotFound(frontendPath.Child("ports").Index(j), portName))
+			}
+		}
+	}
+
+	return allErrs
+}
+
+// reservedLabelKeys are the label keys by which balancer selects the services it manages.
+var reservedLabelKeys = []string{exposerv1alpha1.BalancerKey, exposerv1alpha1.FrontendKey, exposerv1alpha1.MetricsKey}
+
+// validateFrontend checks the front-end service spec of balancer at path.
+// portNames are the names of the balancer ports.
+func validateFrontend(balancer *exposerv1alpha1.Balancer, path *field.Path, frontend *exposerv1alpha1.FrontendSpec,
+	portNames map[string]bool) field.ErrorList {
+
+	var allErrs field.ErrorList
+	// a node port which matches no balancer port would be ignored silently
+	for i, nodePort := range frontend.NodePorts {
+		nodePortPath := path.Child("nodePorts").Index(i).Child("name")
+		switch {
+		case nodePort.Name == "" && len(balancer.Spec.Ports) != 1:
+			allErrs = append(allErrs, field.Required(nodePortPath,
+				"the name is required unless there is exactly one balancer port"))
+		case nodePort.Name != "" && !portNames[nodePort.Name]:
+			allErrs = append(allErrs, field.NotFound(nodePortPath, nodePort.Name))
+		}
+	}
+	// e.g., a frontend service labeled with BalancerKey is taken as an obsolete backend service and deleted
+	for _, key := range reservedLabelKeys {
+		if _, ok := frontend.Labels[key]; ok {
+			allErrs = append(allErrs, field.Forbidden(path.Child("labels").Key(key),
+				"the label key is reserved by balancer"))
+		}
+	}
+	return allErrs
+}
+
+// syncSpecValidCondition validates balancer and records the result as the SpecValid condition.
+// It returns false if balancer is invalid.
+func (r *ReconcilerBalancer) syncSpecValidCondition(balancer *exposerv1alpha1.Balancer) (bool, error) {
+	condition := v1.Condition{
+		Type:   exposerv1alpha1.SpecValidCondition,
+		Status: v1.ConditionTrue,
+		Reason: exposerv1alpha1.ReasonValid,
+	}
+	errs := ValidateBalancer(balancer)
+	if len(errs) > 0 {
+		condition.Status = v1.ConditionFalse
+		condition.Reason = exposerv1alpha1.ReasonInvalid
+		condition.Message = errs.ToAggregate().Error()
+		r.recorder.Event(balancer, corev1.EventTypeWarning, EventReasonInvalidSpec, condition.Message)
+	}
+	return len(errs) == 0, r.setCondition(balancer, condition)
+}
+
+// syncConfigValidCondition checks the proxy config rendered in cm and records the result as the ConfigValid condition.
+// It returns an error if the config is invalid, which stops cm from being written.
+func (r *ReconcilerBalancer) syncConfigValidCondition(balancer *exposerv1alpha1.Balancer, cm *corev1.ConfigMap) error {
+	condition := v1.Condition{
+		Type:   exposerv1alpha1.ConfigValidCondition,
+		Status: v1.ConditionTrue,
+		Reason: exposerv1alpha1.ReasonValid,
+	}
+	dataPlane := dataplane.For(balancer)
+	checkErr := dataPlane.CheckConfig([]byte(cm.Data[dataPlane.ConfigFile()]))
+	if checkErr != nil {
+		condition.Status = v1.ConditionFalse
+		condition.Reason = exposerv1alpha1.ReasonInvalid
+		condition.Message = checkErr.Error()
+		r.recorder.Event(balancer, corev1.EventTypeWarning, EventReasonInvalidConfig, condition.Message)
+	}
+	if err := r.setCondition(balancer, condition); err != nil {
+		return err
+	}
+	if checkErr != nil {
+		// the config does not change until the Balancer does, do not retry
+		return terminal(fmt.Errorf("refuse to apply invalid proxy config %s: %v", cm.Name, checkErr))
+	}
+	return nil
+}
+
+// setCondition updates the condition of Balancer.Status if changed.
+func (r *ReconcilerBalancer) setCondition(balancer *exposerv1alpha1.Balancer, condition v1.Condition) error {
+	condition.ObservedGeneration = balancer.Generation
+	existing := meta.FindStatusCondition(balancer.Status.Conditions, condition.Type)
+	if existing != nil && existing.Status == condition.Status && existing.Reason == condition.Reason &&
+		existing.Message == condition.Message && existing.ObservedGeneration == condition.ObservedGeneration {
+		return nil
+	}
+	meta.SetStatusCondition(&balancer.Status.Conditions, condition)
+	return r.client.Status().Update(context.Background(), balancer)
+}
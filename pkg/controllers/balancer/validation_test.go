@@ -0,0 +1,239 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"context"
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/tools/record"
+	"testing"
+)
+
+func TestValidateBalancer(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.Backends[0].Weight = 0
+	if errs := ValidateBalancer(balancer); len(errs) != 0 {
+		t.Errorf("expected a drained backend to be valid, got %v", errs)
+	}
+	balancer.Spec.Backends[1].Weight = 0
+	if errs := ValidateBalancer(balancer); len(errs) != 1 {
+		t.Errorf("expected all drained backends to be invalid, got %v", errs)
+	}
+}
+
+func TestValidateBalancerFrontendNames(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.Frontends = []exposerv1alpha1.NamedFrontendSpec{{Name: "v1-backend"}}
+	if errs := ValidateBalancer(balancer); len(errs) != 1 || errs[0].Field != "spec.frontends[0].name" {
+		t.Errorf("expected the frontend colliding with the backend service of v1 to be invalid, got %v", errs)
+	}
+	balancer.Spec.Frontends[0].Name = "v3-backend"
+	if errs := ValidateBalancer(balancer); len(errs) != 0 {
+		t.Errorf("expected the frontend to be valid, got %v", errs)
+	}
+}
+
+func TestValidateBalancerFrontendLabels(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.Frontend = &exposerv1alpha1.FrontendSpec{Labels: map[string]string{"team": "web"}}
+	balancer.Spec.Frontends = []exposerv1alpha1.NamedFrontendSpec{{
+		Name:         "public",
+		FrontendSpec: exposerv1alpha1.FrontendSpec{Labels: map[string]string{exposerv1alpha1.BalancerKey: balancer.Name}},
+	}}
+	if errs := ValidateBalancer(balancer); len(errs) != 1 ||
+		errs[0].Field != "spec.frontends[0].labels["+exposerv1alpha1.BalancerKey+"]" {
+		t.Errorf("expected the reserved label key to be invalid, got %v", errs)
+	}
+	balancer.Spec.Frontends = nil
+	balancer.Spec.Frontend.Labels[exposerv1alpha1.FrontendKey] = "other"
+	if errs := ValidateBalancer(balancer); len(errs) != 1 || errs[0].Type != field.ErrorTypeForbidden {
+		t.Errorf("expected the reserved label key to be forbidden, got %v", errs)
+	}
+}
+
+func TestValidateBalancerFrontendNodePorts(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.Frontend = &exposerv1alpha1.FrontendSpec{
+		Type:      corev1.ServiceTypeNodePort,
+		NodePorts: []exposerv1alpha1.FrontendNodePort{{Name: "http", NodePort: 30080}},
+	}
+	balancer.Spec.Frontends = []exposerv1alpha1.NamedFrontendSpec{{
+		Name: "public",
+		FrontendSpec: exposerv1alpha1.FrontendSpec{
+			Type:      corev1.ServiceTypeNodePort,
+			NodePorts: []exposerv1alpha1.FrontendNodePort{{Name: "web", NodePort: 30081}},
+		},
+	}}
+	if errs := ValidateBalancer(balancer); len(errs) != 1 || errs[0].Field != "spec.frontends[0].nodePorts[0].name" ||
+		errs[0].Type != field.ErrorTypeNotFound {
+		t.Errorf("expected the node port of an unknown port to be invalid, got %v", errs)
+	}
+
+	// an unnamed node port is ambiguous with more than one balancer port
+	balancer.Spec.Frontends = nil
+	balancer.Spec.Frontend.NodePorts[0].Name = ""
+	if errs := ValidateBalancer(balancer); len(errs) != 1 || errs[0].Field != "spec.frontend.nodePorts[0].name" {
+		t.Errorf("expected the unnamed node port to be invalid, got %v", errs)
+	}
+	balancer.Spec.Ports = balancer.Spec.Ports[:1]
+	balancer.Spec.Backends[1].Ports = nil
+	if errs := ValidateBalancer(balancer); len(errs) != 0 {
+		t.Errorf("expected the unnamed node port of the only port to be valid, got %v", errs)
+	}
+}
+
+func TestValidateBalancerDrainPeriod(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.DrainPeriod = &metav1.Duration{}
+	if errs := ValidateBalancer(balancer); len(errs) != 1 || errs[0].Field != "spec.drainPeriod" {
+		t.Errorf("expected the zero drain period to be invalid, got %v", errs)
+	}
+}
+
+func TestValidateBalancerPortOverrides(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.Backends[0].Ports = []exposerv1alpha1.BackendPort{{Name: "web", TargetPort: intstr.FromInt(8080)}}
+	if errs := ValidateBalancer(balancer); len(errs) != 1 || errs[0].Field != "spec.backends[0].ports[0].name" {
+		t.Errorf("expected the override of an unknown port to be invalid, got %v", errs)
+	}
+
+	// an unnamed override is ambiguous with more than one balancer port
+	balancer.Spec.Backends[0].Ports[0].Name = ""
+	if errs := ValidateBalancer(balancer); len(errs) != 1 || errs[0].Field != "spec.backends[0].ports[0].name" {
+		t.Errorf("expected the unnamed override to be invalid, got %v", errs)
+	}
+	balancer.Spec.Ports = balancer.Spec.Ports[:1]
+	balancer.Spec.Backends[1].Ports = nil
+	if errs := ValidateBalancer(balancer); len(errs) != 0 {
+		t.Errorf("expected the unnamed override of the only port to be valid, got %v", errs)
+	}
+}
+
+func TestValidateBalancerWithHAProxy(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.DataPlane = exposerv1alpha1.DataPlaneHAProxy
+	// the dns port is UDP, which is not proxied by HAProxy
+	if errs := ValidateBalancer(balancer); len(errs) != 1 || errs[0].Field != "spec.ports[1].protocol" {
+		t.Errorf("expected the UDP port to be invalid, got %v", errs)
+	}
+
+	balancer.Spec.Ports = balancer.Spec.Ports[:1]
+	balancer.Spec.Metrics = &exposerv1alpha1.MetricsSpec{}
+	if errs := ValidateBalancer(balancer); len(errs) != 1 || errs[0].Field != "spec.metrics" {
+		t.Errorf("expected the metrics to be invalid, got %v", errs)
+	}
+}
+
+func TestValidateBalancerWithEndpointsWeight(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.WeightMode = exposerv1alpha1.WeightModeEndpoints
+	if errs := ValidateBalancer(balancer); len(errs) != 1 || errs[0].Field != "spec.reloadMode" {
+		t.Errorf("expected the restart reload mode to be invalid, got %v", errs)
+	}
+
+	balancer.Spec.ReloadMode = exposerv1alpha1.ReloadModeHotReload
+	if errs := ValidateBalancer(balancer); len(errs) != 0 {
+		t.Errorf("expected the hot reload mode to be valid, got %v", errs)
+	}
+
+	// envoy receives the weights over xDS without any reload
+	balancer.Spec.ReloadMode = exposerv1alpha1.ReloadModeRestart
+	balancer.Spec.DataPlane = exposerv1alpha1.DataPlaneEnvoy
+	if errs := ValidateBalancer(balancer); len(errs) != 0 {
+		t.Errorf("expected the endpoints weight of envoy to be valid, got %v", errs)
+	}
+}
+
+func TestValidateBalancerWithEndpointsUpstream(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.UpstreamMode = exposerv1alpha1.UpstreamModeEndpoints
+	if errs := ValidateBalancer(balancer); len(errs) != 1 || errs[0].Field != "spec.reloadMode" {
+		t.Errorf("expected the restart reload mode to be invalid, got %v", errs)
+	}
+
+	balancer.Spec.ReloadMode = exposerv1alpha1.ReloadModeHotReload
+	if errs := ValidateBalancer(balancer); len(errs) != 0 {
+		t.Errorf("expected the hot reload mode to be valid, got %v", errs)
+	}
+	balancer.Spec.Metrics = &exposerv1alpha1.MetricsSpec{}
+	if errs := ValidateBalancer(balancer); len(errs) != 1 || errs[0].Field != "spec.metrics" {
+		t.Errorf("expected the metrics of nginx to be invalid, got %v", errs)
+	}
+	balancer.Spec.DataPlane = exposerv1alpha1.DataPlaneNative
+	if errs := ValidateBalancer(balancer); len(errs) != 0 {
+		t.Errorf("expected the metrics of the native proxy to be valid, got %v", errs)
+	}
+
+	balancer.Spec.Metrics = nil
+	balancer.Spec.Ports = balancer.Spec.Ports[:1]
+	balancer.Spec.DataPlane = exposerv1alpha1.DataPlaneHAProxy
+	if errs := ValidateBalancer(balancer); len(errs) != 1 || errs[0].Field != "spec.upstreamMode" {
+		t.Errorf("expected the endpoints upstream of HAProxy to be invalid, got %v", errs)
+	}
+
+	// envoy receives the endpoints over xDS without any reload
+	balancer.Spec.DataPlane = exposerv1alpha1.DataPlaneEnvoy
+	if errs := ValidateBalancer(balancer); len(errs) != 1 || errs[0].Field != "spec.reloadMode" {
+		t.Errorf("expected the hot reload mode of envoy to be invalid, got %v", errs)
+	}
+	balancer.Spec.ReloadMode = exposerv1alpha1.ReloadModeRestart
+	if errs := ValidateBalancer(balancer); len(errs) != 0 {
+		t.Errorf("expected the endpoints upstream of envoy to be valid, got %v", errs)
+	}
+}
+
+func TestSyncConfigMapRefusesInvalidConfig(t *testing.T) {
+	balancer := newTestBalancer()
+	// two ports on the same TCP port render a config which nginx refuses to load
+	balancer.Spec.Ports = append(balancer.Spec.Ports, exposerv1alpha1.BalancerPort{
+		Name: "web", Protocol: exposerv1alpha1.TCP, Port: 80,
+	})
+	scheme := newTestScheme(t)
+	r := &ReconcilerBalancer{
+		client:   newTestClient(scheme, balancer),
+		scheme:   scheme,
+		recorder: record.NewFakeRecorder(100),
+	}
+
+	if _, err := r.syncConfigMap(balancer); err == nil {
+		t.Fatalf("expected the invalid config refused")
+	}
+	condition := meta.FindStatusCondition(balancer.Status.Conditions, exposerv1alpha1.ConfigValidCondition)
+	if condition == nil || condition.Status != "False" || condition.Message == "" {
+		t.Errorf("expected the ConfigValid condition to be false, got %v", condition)
+	}
+	err := r.client.Get(context.Background(), types.NamespacedName{Namespace: balancer.Namespace, Name: ConfigMapName(balancer)},
+		&corev1.ConfigMap{})
+	if !errors.IsNotFound(err) {
+		t.Errorf("expected no configmap written, got %v", err)
+	}
+
+	balancer.Spec.Ports = balancer.Spec.Ports[:2]
+	if _, err = r.syncConfigMap(balancer); err != nil {
+		t.Fatal(err)
+	}
+	if !meta.IsStatusConditionTrue(balancer.Status.Conditions, exposerv1alpha1.ConfigValidCondition) {
+		t.Errorf("expected the ConfigValid condition to be true, got %v", balancer.Status.Conditions)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"context"
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// balancerChanged filters the updates of Balancer which are worth a reconcile, i.e., the changes of its spec,
+// and the annotations which promote or abort the rollout. The status updates made by the controller itself are dropped.
+var balancerChanged = predicate.Or(predicate.GenerationChangedPredicate{}, predicate.AnnotationChangedPredicate{})
+
+// ownedObjectChanged filters the updates of the resources managed by Balancer which change nothing but the status,
+// e.g., the ready replicas of the proxy deployment. A change of the labels or annotations passes,
+// since it may be a drift or a manual override. The objects without a generation (e.g., ConfigMaps) always pass.
+var ownedObjectChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		if e.ObjectOld == nil || e.ObjectNew == nil || e.ObjectNew.GetGeneration() == 0 {
+			return true
+		}
+		return e.ObjectOld.GetGeneration() != e.ObjectNew.GetGeneration() ||
+			!reflect.DeepEqual(e.ObjectOld.GetLabels(), e.ObjectNew.GetLabels()) ||
+			!reflect.DeepEqual(e.ObjectOld.GetAnnotations(), e.ObjectNew.GetAnnotations())
+	},
+}
+
+// endpointsChanged filters the EndpointSlices of the backend services of Balancers (i.e., the ones labeled with
+// BalancerKey), and drops the updates which change neither the endpoints nor the ports of a slice.
+var endpointsChanged = predicate.And(
+	predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		_, ok := obj.GetLabels()[exposerv1alpha1.BalancerKey]
+		return ok
+	}),
+	predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldSlice, ok := e.ObjectOld.(*discoveryv1.EndpointSlice)
+			if !ok {
+				return true
+			}
+			newSlice, ok := e.ObjectNew.(*discoveryv1.EndpointSlice)
+			if !ok {
+				return true
+			}
+			return !reflect.DeepEqual(oldSlice.Endpoints, newSlice.Endpoints) ||
+				!reflect.DeepEqual(oldSlice.Ports, newSlice.Ports)
+		},
+	},
+)
+
+// newSecretMetadata returns an empty Secret of which only the metadata is read or watched,
+// so that the data of the Secrets in the cluster is never cached by the controller.
+func newSecretMetadata() *metav1.PartialObjectMetadata {
+	secret := &metav1.PartialObjectMetadata{}
+	secret.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Secret"))
+	return secret
+}
+
+// secretReferenced filters the Secrets referred by some Balancer, of which only the creations and the deletions
+// pass. The Balancers referring to a Secret are listed from the cache, see secretToBalancers.
+func secretReferenced(c client.Client) predicate.Funcs {
+	referenced := func(obj client.Object) bool {
+		return len(secretToBalancers(c)(obj)) > 0
+	}
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return referenced(e.Object)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return referenced(e.Object)
+		},
+		// the proxy pods are pulled with the current data of a Secret anyway
+		UpdateFunc: func(event.UpdateEvent) bool {
+			return false
+		},
+		GenericFunc: func(event.GenericEvent) bool {
+			return false
+		},
+	}
+}
+
+// secretToBalancers returns the map func which maps a Secret to the Balancers referring to it
+// as an image pull secret of the proxy pods.
+func secretToBalancers(c client.Client) handler.MapFunc {
+	return func(obj client.Object) []reconcile.Request {
+		var balancerList exposerv1alpha1.BalancerList
+		if err := c.List(context.Background(), &balancerList, client.InNamespace(obj.GetNamespace())); err != nil {
+			log.Error(err, "Failed to list Balancers referring to Secret", "Secret", client.ObjectKeyFromObject(obj))
+			return nil
+		}
+		var requests []reconcile.Request
+		for i := range balancerList.Items {
+			if referencesSecret(&balancerList.Items[i], obj.GetName()) {
+				requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&balancerList.Items[i])})
+			}
+		}
+		return requests
+	}
+}
+
+// referencedSecrets returns the names of the Secrets referred by balancer.
+func referencedSecrets(balancer *exposerv1alpha1.Balancer) []string {
+	if balancer.Spec.ProxyTemplate == nil {
+		return nil
+	}
+	var names []string
+	for _, ref := range balancer.Spec.ProxyTemplate.ImagePullSecrets {
+		if ref.Name != "" {
+			names = append(names, ref.Name)
+		}
+	}
+	return names
+}
+
+func referencesSecret(balancer *exposerv1alpha1.Balancer, name string) bool {
+	for _, secret := range referencedSecrets(balancer) {
+		if secret == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSecrets records a Warning event for each Secret referred by balancer which does not exist.
+// The proxy pods are still synced, they are pulled once the Secret is created.
+func (r *ReconcilerBalancer) checkSecrets(balancer *exposerv1alpha1.Balancer) error {
+	for _, name := range referencedSecrets(balancer) {
+		err := r.client.Get(context.Background(), client.ObjectKey{Namespace: balancer.Namespace, Name: name}, newSecretMetadata())
+		if errors.IsNotFound(err) {
+			r.recorder.Eventf(balancer, corev1.EventTypeWarning, EventReasonSecretNotFound,
+				"Secret %s referred by spec.proxyTemplate.imagePullSecrets is not found", name)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
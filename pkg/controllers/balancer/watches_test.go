@@ -0,0 +1,164 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	appv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"strings"
+	"testing"
+)
+
+func TestOwnedObjectChanged(t *testing.T) {
+	dp := &appv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "proxy", Generation: 1}}
+
+	statusOnly := dp.DeepCopy()
+	statusOnly.Status.ReadyReplicas = 1
+	if ownedObjectChanged.Update(event.UpdateEvent{ObjectOld: dp, ObjectNew: statusOnly}) {
+		t.Error("expected the status update of the deployment to be dropped")
+	}
+
+	scaled := dp.DeepCopy()
+	scaled.Generation = 2
+	if !ownedObjectChanged.Update(event.UpdateEvent{ObjectOld: dp, ObjectNew: scaled}) {
+		t.Error("expected the spec update of the deployment to pass")
+	}
+
+	overridden := dp.DeepCopy()
+	overridden.Annotations = map[string]string{exposerv1alpha1.ManualOverrideKey: "true"}
+	if !ownedObjectChanged.Update(event.UpdateEvent{ObjectOld: dp, ObjectNew: overridden}) {
+		t.Error("expected the annotation update of the deployment to pass")
+	}
+
+	// configmaps have no generation
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "proxy"}}
+	edited := cm.DeepCopy()
+	edited.Data = map[string]string{"nginx.conf": ""}
+	if !ownedObjectChanged.Update(event.UpdateEvent{ObjectOld: cm, ObjectNew: edited}) {
+		t.Error("expected the update of the configmap to pass")
+	}
+}
+
+func TestEndpointsChanged(t *testing.T) {
+	ready, notReady := true, false
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "example-balancer-v1-backend-abcde",
+			Labels: map[string]string{exposerv1alpha1.BalancerKey: "example-balancer"},
+		},
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"10.0.0.1"}, Conditions: discoveryv1.EndpointConditions{Ready: &ready}},
+		},
+	}
+	if !endpointsChanged.Create(event.CreateEvent{Object: slice}) {
+		t.Error("expected the creation of a backend slice to pass")
+	}
+	unrelated := slice.DeepCopy()
+	unrelated.Labels = nil
+	if endpointsChanged.Create(event.CreateEvent{Object: unrelated}) {
+		t.Error("expected the slice of a service not managed by balancer to be dropped")
+	}
+
+	relabeled := slice.DeepCopy()
+	relabeled.Labels["extra"] = "label"
+	if endpointsChanged.Update(event.UpdateEvent{ObjectOld: slice, ObjectNew: relabeled}) {
+		t.Error("expected the update which keeps the endpoints to be dropped")
+	}
+	unready := slice.DeepCopy()
+	unready.Endpoints[0].Conditions.Ready = &notReady
+	if !endpointsChanged.Update(event.UpdateEvent{ObjectOld: slice, ObjectNew: unready}) {
+		t.Error("expected the readiness change of an endpoint to pass")
+	}
+}
+
+func TestSecretToBalancers(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.ProxyTemplate = &exposerv1alpha1.ProxyTemplate{
+		ImagePullSecrets: []corev1.LocalObjectReference{{Name: "registry"}},
+	}
+	other := newTestBalancer()
+	other.Name = "other-balancer"
+	c := newTestClient(newTestScheme(t), balancer, other)
+
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "registry", Namespace: "default"}}
+	requests := secretToBalancers(c)(secret)
+	if len(requests) != 1 || requests[0].Name != balancer.Name {
+		t.Errorf("expected only %s to be enqueued, got %v", balancer.Name, requests)
+	}
+
+	secret.Namespace = "other"
+	if requests = secretToBalancers(c)(secret); len(requests) != 0 {
+		t.Errorf("expected no Balancer to be enqueued for a secret of another namespace, got %v", requests)
+	}
+}
+
+func TestSecretReferenced(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.ProxyTemplate = &exposerv1alpha1.ProxyTemplate{
+		ImagePullSecrets: []corev1.LocalObjectReference{{Name: "registry"}},
+	}
+	predicate := secretReferenced(newTestClient(newTestScheme(t), balancer))
+
+	secret := newSecretMetadata()
+	secret.SetNamespace("default")
+	secret.SetName("registry")
+	if !predicate.Create(event.CreateEvent{Object: secret}) || !predicate.Delete(event.DeleteEvent{Object: secret}) {
+		t.Errorf("expected the creation and the deletion of a referred secret to pass")
+	}
+	if predicate.Update(event.UpdateEvent{ObjectOld: secret, ObjectNew: secret}) {
+		t.Errorf("expected the update of a secret to be dropped")
+	}
+
+	other := newSecretMetadata()
+	other.SetNamespace("default")
+	other.SetName("other")
+	if predicate.Create(event.CreateEvent{Object: other}) {
+		t.Errorf("expected a secret referred by no Balancer to be dropped")
+	}
+}
+
+func TestCheckSecrets(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.ProxyTemplate = &exposerv1alpha1.ProxyTemplate{
+		ImagePullSecrets: []corev1.LocalObjectReference{{Name: "registry"}},
+	}
+	scheme := newTestScheme(t)
+	recorder := record.NewFakeRecorder(10)
+	r := &ReconcilerBalancer{client: newTestClient(scheme, balancer), scheme: scheme, recorder: recorder}
+
+	if err := r.checkSecrets(balancer); err != nil {
+		t.Fatal(err)
+	}
+	events := drainEvents(recorder)
+	if len(events) != 1 || !strings.HasPrefix(events[0], "Warning SecretNotFound Secret registry") {
+		t.Errorf("expected the missing secret to be reported, got %v", events)
+	}
+
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "registry", Namespace: "default"}}
+	r.client = newTestClient(scheme, balancer, secret)
+	if err := r.checkSecrets(balancer); err != nil {
+		t.Fatal(err)
+	}
+	if events = drainEvents(recorder); len(events) != 0 {
+		t.Errorf("expected no event once the secret exists, got %v", events)
+	}
+}
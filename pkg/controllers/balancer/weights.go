@@ -0,0 +1,71 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+)
+
+// EffectiveBalancer returns a copy of balancer whose backend weights are the ones which should be
+// rendered into the proxy config right now. The weights are decided in order by:
+// (1) Spec.WeightMode, with readyEndpoints holding the number of ready endpoints of each backend;
+// (2) the current step of the rollout, which shifts traffic among the weights of (1).
+// The input balancer is never modified.
+func EffectiveBalancer(balancer *exposerv1alpha1.Balancer, readyEndpoints map[string]int32) *exposerv1alpha1.Balancer {
+	effective := balancer.DeepCopy()
+	if weights := endpointsWeights(balancer, readyEndpoints); weights != nil {
+		setWeights(effective, weights)
+	}
+	if weights := rolloutWeights(effective); weights != nil {
+		setWeights(effective, weights)
+	}
+	return effective
+}
+
+// endpointsWeights returns the backend weights derived from readyEndpoints,
+// or nil if Spec.WeightMode is not endpoints or no backend has any ready endpoint.
+// A drained backend (of weight 0) keeps weight 0 regardless of its endpoints.
+func endpointsWeights(balancer *exposerv1alpha1.Balancer, readyEndpoints map[string]int32) map[string]int32 {
+	if balancer.Spec.WeightMode != exposerv1alpha1.WeightModeEndpoints {
+		return nil
+	}
+	weights := map[string]int32{}
+	var total int32
+	for _, backend := range balancer.Spec.Backends {
+		if backend.Weight == 0 {
+			weights[backend.Name] = 0
+			continue
+		}
+		factor := int32(1)
+		if backend.WeightFactor != nil {
+			factor = *backend.WeightFactor
+		}
+		weights[backend.Name] = readyEndpoints[backend.Name] * factor
+		total += weights[backend.Name]
+	}
+	if total == 0 {
+		// nothing is ready, fall back to the static weights rather than an upstream without any server
+		return nil
+	}
+	return weights
+}
+
+func setWeights(balancer *exposerv1alpha1.Balancer, weights map[string]int32) {
+	for i := range balancer.Spec.Backends {
+		balancer.Spec.Backends[i].Weight = weights[balancer.Spec.Backends[i].Name]
+	}
+}
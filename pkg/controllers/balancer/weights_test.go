@@ -0,0 +1,99 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/client-go/tools/record"
+	"testing"
+)
+
+func TestEffectiveBalancerWithEndpoints(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.WeightMode = exposerv1alpha1.WeightModeEndpoints
+	factor := int32(3)
+	balancer.Spec.Backends[1].WeightFactor = &factor
+
+	cases := []struct {
+		readyEndpoints map[string]int32
+		expected       map[string]int32
+	}{
+		// v1: 20 pods, v2: 2 pods with factor 3
+		{readyEndpoints: map[string]int32{"v1": 20, "v2": 2}, expected: map[string]int32{"v1": 20, "v2": 6}},
+		// v2 has no ready pods
+		{readyEndpoints: map[string]int32{"v1": 2}, expected: map[string]int32{"v1": 2, "v2": 0}},
+		// nothing is ready, the static weights are used
+		{readyEndpoints: map[string]int32{}, expected: map[string]int32{"v1": 40, "v2": 60}},
+	}
+	for _, c := range cases {
+		effective := EffectiveBalancer(balancer, c.readyEndpoints)
+		for _, backend := range effective.Spec.Backends {
+			if backend.Weight != c.expected[backend.Name] {
+				t.Errorf("%v: expected weight %d for %s, got %d",
+					c.readyEndpoints, c.expected[backend.Name], backend.Name, backend.Weight)
+			}
+		}
+	}
+	if balancer.Spec.Backends[0].Weight != 40 {
+		t.Errorf("expected the input balancer unchanged, got weight %d", balancer.Spec.Backends[0].Weight)
+	}
+}
+
+func TestEffectiveBalancerWithEndpointsKeepsDrained(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.WeightMode = exposerv1alpha1.WeightModeEndpoints
+	balancer.Spec.Backends[0].Weight = 0
+
+	effective := EffectiveBalancer(balancer, map[string]int32{"v1": 5, "v2": 2})
+	if v1, v2 := effective.Spec.Backends[0].Weight, effective.Spec.Backends[1].Weight; v1 != 0 || v2 != 2 {
+		t.Errorf("expected the drained v1 to keep weight 0 and v2 to get 2, got %d and %d", v1, v2)
+	}
+	// only the drained backend is ready, the static weights are used
+	effective = EffectiveBalancer(balancer, map[string]int32{"v1": 5})
+	if v1, v2 := effective.Spec.Backends[0].Weight, effective.Spec.Backends[1].Weight; v1 != 0 || v2 != 60 {
+		t.Errorf("expected the static weights 0 and 60, got %d and %d", v1, v2)
+	}
+}
+
+func TestSyncBalancerStatusDrainedWithEndpoints(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.WeightMode = exposerv1alpha1.WeightModeEndpoints
+	balancer.Spec.Backends[0].Weight = 0
+	scheme := newTestScheme(t)
+	r := &ReconcilerBalancer{
+		client: newTestClient(scheme, balancer,
+			newTestEndpointSlice("v1", BackendServiceName(balancer, "v1"), discoveryv1.AddressTypeIPv4, 5678, true, "10.0.0.1"),
+		),
+		scheme:   scheme,
+		recorder: record.NewFakeRecorder(100),
+	}
+
+	if err := r.syncBalancerStatus(balancer); err != nil {
+		t.Fatal(err)
+	}
+	// v1 is drained by the spec although it is ready, v2 is active although it has no ready endpoints
+	expected := map[string]exposerv1alpha1.BackendStatus{
+		"v1": {Name: "v1", Phase: exposerv1alpha1.BackendDrained, Weight: 0, ReadyEndpoints: 1},
+		"v2": {Name: "v2", Phase: exposerv1alpha1.BackendActive, Weight: 60, ReadyEndpoints: 0},
+	}
+	for _, backend := range balancer.Status.Backends {
+		if backend != expected[backend.Name] {
+			t.Errorf("expected %v, got %v", expected[backend.Name], backend)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/envoy"
+	"github.com/hliangzhao/balancer/pkg/reloader"
+	"github.com/hliangzhao/balancer/pkg/xds"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// XDSBindAddress is the address the xDS server of the envoy data plane listens on, which is disabled if empty.
+var XDSBindAddress = xds.DefaultAddress
+
+// XDSLeaderLabel labels the pod of the balancer-controller replica serving xDS, i.e., the leader,
+// thus the xDS service selects the leader only (see config/manager/xds_service.yaml).
+const XDSLeaderLabel = "balancer.exposer.hliangzhao.io/xds-leader"
+
+// xdsLeaderLabeler labels the pod of the replica by XDSLeaderLabel once it is elected as the leader,
+// and unlabels it before then, since the label survives the restart of a replica which lost its leadership.
+// The pod is given by the POD_NAME and the POD_NAMESPACE environment variables (see config/manager/manager.yaml),
+// without which, e.g., when running out of the cluster, nothing is labeled.
+type xdsLeaderLabeler struct {
+	client    client.Client
+	elected   <-chan struct{}
+	name      string
+	namespace string
+}
+
+func newXDSLeaderLabeler(manager manager.Manager) *xdsLeaderLabeler {
+	return &xdsLeaderLabeler{
+		client:    manager.GetClient(),
+		elected:   manager.Elected(),
+		name:      os.Getenv("POD_NAME"),
+		namespace: os.Getenv("POD_NAMESPACE"),
+	}
+}
+
+// Start unlabels the pod of the replica, and labels it once elected, which implements manager.Runnable.
+func (l *xdsLeaderLabeler) Start(ctx context.Context) error {
+	if l.name == "" || l.namespace == "" {
+		return nil
+	}
+	if err := l.label(ctx, nil); err != nil {
+		return err
+	}
+	select {
+	case <-l.elected:
+		value := "true"
+		return l.label(ctx, &value)
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// NeedLeaderElection runs the labeler on every replica, so that the stale label is removed from the non-leaders.
+func (l *xdsLeaderLabeler) NeedLeaderElection() bool {
+	return false
+}
+
+// label sets XDSLeaderLabel of the pod to value, or removes it if value is nil.
+func (l *xdsLeaderLabeler) label(ctx context.Context, value *string) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": map[string]*string{XDSLeaderLabel: value}},
+	})
+	if err != nil {
+		return err
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: l.name, Namespace: l.namespace}}
+	return l.client.Patch(ctx, pod, client.RawPatch(types.MergePatchType, data))
+}
+
+// syncXDS serves the listeners and the weighted clusters of balancer to its envoy proxy pods over xDS,
+// which apply the changed weights and endpoints without any restart.
+// The resources of a Balancer not using the envoy data plane (any longer) are cleared.
+func (r *ReconcilerBalancer) syncXDS(balancer *exposerv1alpha1.Balancer) error {
+	if balancer.Spec.DataPlane != exposerv1alpha1.DataPlaneEnvoy {
+		if r.xds != nil {
+			r.xds.ClearResources(envoy.NodeCluster(balancer))
+		}
+		return nil
+	}
+	if r.xds == nil {
+		return fmt.Errorf("the xDS server required by the envoy data plane is disabled")
+	}
+
+	readyEndpoints, err := r.readyEndpoints(balancer)
+	if err != nil {
+		return err
+	}
+	endpoints, err := r.upstreamEndpoints(balancer)
+	if err != nil {
+		return err
+	}
+	effective := EffectiveBalancer(balancer, readyEndpoints)
+	cluster := envoy.NodeCluster(balancer)
+	previous := r.xds.Version(cluster)
+	version, err := r.xds.SetResources(cluster, envoy.NewResources(effective, endpoints))
+	if err != nil {
+		return err
+	}
+	if version != previous {
+		r.recordUnservedBackends(balancer, effective, endpoints)
+	}
+	return nil
+}
+
+// getNodeStatus returns the status of the envoy node of a proxy pod of balancer, as acknowledged to the xDS server.
+func (r *ReconcilerBalancer) getNodeStatus(balancer *exposerv1alpha1.Balancer) func(context.Context, *corev1.Pod) (*reloader.Status, error) {
+	return func(_ context.Context, pod *corev1.Pod) (*reloader.Status, error) {
+		status, connected := r.xds.NodeStatus(envoy.NodeCluster(balancer), pod.Name)
+		if !connected {
+			return nil, fmt.Errorf("the proxy is not connected to the xDS server")
+		}
+		return &reloader.Status{ConfigHash: status.ConfigHash, Error: status.Error}, nil
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"context"
+	exposerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/envoy"
+	"github.com/hliangzhao/balancer/pkg/xds"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"testing"
+)
+
+func TestSyncXDS(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.DataPlane = exposerv1alpha1.DataPlaneEnvoy
+	scheme := newTestScheme(t)
+	r := &ReconcilerBalancer{
+		client:   newTestClient(scheme, balancer),
+		scheme:   scheme,
+		recorder: record.NewFakeRecorder(10),
+		xds:      xds.NewServer(""),
+	}
+	cluster := envoy.NodeCluster(balancer)
+
+	if err := r.syncXDS(balancer); err != nil {
+		t.Fatal(err)
+	}
+	version := r.xds.Version(cluster)
+	if version == "" {
+		t.Fatalf("expected the resources of %s to be served", cluster)
+	}
+
+	// a weight change is served as a new version
+	balancer.Spec.Backends[0].Weight = 50
+	if err := r.syncXDS(balancer); err != nil {
+		t.Fatal(err)
+	}
+	if r.xds.Version(cluster) == version {
+		t.Errorf("expected a new version for the changed weights")
+	}
+
+	// the resources are cleared once the Balancer switches to another data plane
+	balancer.Spec.DataPlane = exposerv1alpha1.DataPlaneNginx
+	if err := r.syncXDS(balancer); err != nil {
+		t.Fatal(err)
+	}
+	if r.xds.Version(cluster) != "" {
+		t.Errorf("expected the resources of %s to be cleared", cluster)
+	}
+
+	// the envoy data plane is not served without the xDS server
+	balancer.Spec.DataPlane = exposerv1alpha1.DataPlaneEnvoy
+	r.xds = nil
+	if err := r.syncXDS(balancer); err == nil {
+		t.Errorf("expected an error without the xDS server")
+	}
+}
+
+func TestXDSLeaderLabeler(t *testing.T) {
+	// the pod of a replica restarted after losing its leadership keeps the label
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:      "balancer-controller-manager-0",
+		Namespace: "balancer-system",
+		Labels:    map[string]string{"control-plane": "controller-manager", XDSLeaderLabel: "true"},
+	}}
+	c := newTestClient(newTestScheme(t), pod)
+	elected := make(chan struct{})
+	l := &xdsLeaderLabeler{client: c, elected: elected, name: pod.Name, namespace: pod.Namespace}
+	getLabels := func() map[string]string {
+		current := &corev1.Pod{}
+		if err := c.Get(context.Background(), client.ObjectKeyFromObject(pod), current); err != nil {
+			t.Fatal(err)
+		}
+		return current.Labels
+	}
+
+	// the stale label is removed until the replica is elected
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if labels := getLabels(); labels[XDSLeaderLabel] != "" || labels["control-plane"] != "controller-manager" {
+		t.Errorf("expected only the label %s to be removed, got %v", XDSLeaderLabel, labels)
+	}
+
+	close(elected)
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if labels := getLabels(); labels[XDSLeaderLabel] != "true" {
+		t.Errorf("expected the pod of the leader to be labeled, got %v", labels)
+	}
+}
+
+func TestProxiesRunConfigEnvoy(t *testing.T) {
+	balancer := newTestBalancer()
+	balancer.Spec.DataPlane = exposerv1alpha1.DataPlaneEnvoy
+	balancer.Status.ConfigHash = "new"
+	balancer.Status.Proxies = []exposerv1alpha1.ProxyStatus{
+		{Pod: "example-balancer-proxy-0", ConfigHash: "new"},
+		{Pod: "example-balancer-proxy-1", ConfigHash: "old"},
+	}
+	scheme := newTestScheme(t)
+	r := &ReconcilerBalancer{client: newTestClient(scheme, balancer), scheme: scheme, xds: xds.NewServer("")}
+	// the configmap holds the bootstrap config only, which does not tell the served resources
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		exposerv1alpha1.ConfigMapHashKey: "bootstrap",
+	}}}
+
+	if ok, err := r.proxiesRunConfig(balancer, cm); err != nil || ok {
+		t.Errorf("expected a proxy pod running the old resources, got %v (%v)", ok, err)
+	}
+	balancer.Status.Proxies[1].ConfigHash = "new"
+	if ok, err := r.proxiesRunConfig(balancer, cm); err != nil || !ok {
+		t.Errorf("expected every proxy pod to run the new resources, got %v (%v)", ok, err)
+	}
+
+	// a proxy pod which is not connected to the xDS server reports no config
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "example-balancer-proxy-0"}}
+	if _, err := r.getNodeStatus(balancer)(context.Background(), pod); err == nil {
+		t.Errorf("expected an error for a proxy pod not connected to the xDS server")
+	}
+}
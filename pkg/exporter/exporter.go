@@ -0,0 +1,237 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package exporter implements the sidecar which exports the traffic metrics of an nginx proxy of a Balancer.
+// It reads the per-session json access log sent by nginx over syslog and the nginx stub_status,
+// and labels the metrics with the names of the Balancer, the listener (the balancer port) and the backend.
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/nginx"
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Port is the port the exporter serves the metrics on.
+	Port int32 = 9113
+	// MetricsPath is the path of the metrics of the exporter.
+	MetricsPath = "/metrics"
+	// unknownBackend labels the sessions whose upstream is not in the config, e.g., no upstream is tried.
+	unknownBackend = "unknown"
+)
+
+// AccessLogEntry is a stream session logged in nginx.AccessLogFormat.
+type AccessLogEntry struct {
+	Port          string `json:"port"`
+	Protocol      string `json:"protocol"`
+	Status        string `json:"status"`
+	Upstream      string `json:"upstream"`
+	BytesSent     string `json:"bytes_sent"`
+	BytesReceived string `json:"bytes_received"`
+	SessionTime   string `json:"session_time"`
+}
+
+// Exporter turns the access log of an nginx proxy into the per backend metrics.
+type Exporter struct {
+	// Balancer is the name of the Balancer the proxy belongs to.
+	Balancer string
+	// LookupHost resolves the host of an upstream server, which is the backend service.
+	LookupHost func(ctx context.Context, host string) ([]string, error)
+
+	mu sync.RWMutex
+	// listen port -> listener name
+	listeners map[string]string
+	// upstream address (ip:port) -> backend name
+	backends map[string]string
+
+	sessions *prometheus.CounterVec
+	bytes    *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// New returns an exporter of the given Balancer whose metrics are registered with registerer.
+func New(balancer string, registerer prometheus.Registerer) *Exporter {
+	e := &Exporter{
+		Balancer:   balancer,
+		LookupHost: net.DefaultResolver.LookupHost,
+		listeners:  map[string]string{},
+		backends:   map[string]string{},
+		sessions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "balancer_proxy_sessions_total",
+			Help: "Total number of sessions (TCP connections or UDP sessions) forwarded to a backend, by nginx status.",
+		}, []string{"balancer", "listener", "backend", "status"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "balancer_proxy_bytes_total",
+			Help: "Total number of bytes forwarded, direction is either upstream or downstream.",
+		}, []string{"balancer", "listener", "backend", "direction"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "balancer_proxy_errors_total",
+			Help: "Total number of sessions which are not completed successfully.",
+		}, []string{"balancer", "listener", "backend"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "balancer_proxy_session_duration_seconds",
+			Help:    "Duration of the sessions forwarded to a backend.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"balancer", "listener", "backend"}),
+	}
+	registerer.MustRegister(e.sessions, e.bytes, e.errors, e.duration)
+	return e
+}
+
+// Load reads the listeners and the backends from the nginx config rendered by nginx.NewConfig.
+// The upstream servers are the backend services, which are resolved since nginx logs their addresses.
+func (e *Exporter) Load(ctx context.Context, data []byte) error {
+	config, err := nginx.Parse(data)
+	if err != nil {
+		return err
+	}
+	listeners := map[string]string{}
+	backends := map[string]string{}
+	for _, block := range config {
+		if block.Name != "stream" {
+			continue
+		}
+		for _, d := range block.Children {
+			switch d.Name {
+			case "server":
+				port, listener := e.parseServer(d)
+				if port != "" {
+					listeners[port] = listener
+				}
+			case "upstream":
+				for _, server := range d.Children {
+					if server.Name != "server" || len(server.Params) == 0 {
+						continue
+					}
+					host, port, err := net.SplitHostPort(server.Params[0])
+					if err != nil {
+						return fmt.Errorf("line %d: %v", server.Line, err)
+					}
+					backend := e.backendName(host)
+					addrs, err := e.LookupHost(ctx, host)
+					if err != nil {
+						return err
+					}
+					for _, addr := range addrs {
+						backends[net.JoinHostPort(addr, port)] = backend
+					}
+				}
+			}
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.listeners, e.backends = listeners, backends
+	return nil
+}
+
+// parseServer returns the listen port and the listener name of a stream server.
+func (e *Exporter) parseServer(server nginx.Directive) (string, string) {
+	var port, listener string
+	for _, d := range server.Children {
+		switch {
+		case d.Name == "listen" && len(d.Params) > 0:
+			port = d.Params[0]
+		case d.Name == "proxy_pass" && len(d.Params) > 0:
+			listener = strings.TrimPrefix(d.Params[0], "upstream_")
+		}
+	}
+	return port, listener
+}
+
+// backendName returns the name of the backend of a backend service, i.e., `<balancer>-<backend>-backend`.
+func (e *Exporter) backendName(host string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(host, e.Balancer+"-"), "-backend")
+}
+
+// Observe records a session of the access log.
+func (e *Exporter) Observe(entry AccessLogEntry) {
+	e.mu.RLock()
+	listener, ok := e.listeners[entry.Port]
+	if !ok {
+		listener = entry.Port
+	}
+	// $upstream_addr lists all the tried upstreams, the session is served by the last one
+	addrs := strings.Split(entry.Upstream, ",")
+	backend, ok := e.backends[strings.TrimSpace(addrs[len(addrs)-1])]
+	if !ok {
+		backend = unknownBackend
+	}
+	e.mu.RUnlock()
+
+	e.sessions.WithLabelValues(e.Balancer, listener, backend, entry.Status).Inc()
+	if entry.Status != "200" {
+		e.errors.WithLabelValues(e.Balancer, listener, backend).Inc()
+	}
+	// $bytes_received is read from the client, which is sent to the upstream
+	if n, err := strconv.ParseFloat(entry.BytesReceived, 64); err == nil {
+		e.bytes.WithLabelValues(e.Balancer, listener, backend, "upstream").Add(n)
+	}
+	if n, err := strconv.ParseFloat(entry.BytesSent, 64); err == nil {
+		e.bytes.WithLabelValues(e.Balancer, listener, backend, "downstream").Add(n)
+	}
+	if seconds, err := strconv.ParseFloat(entry.SessionTime, 64); err == nil {
+		e.duration.WithLabelValues(e.Balancer, listener, backend).Observe(seconds)
+	}
+}
+
+// ParseSyslogMessage returns the access log entry of a syslog message sent by nginx,
+// e.g., `<190>Oct 19 12:00:00 host balancer: {"port":"80",...}`.
+func ParseSyslogMessage(msg []byte) (AccessLogEntry, error) {
+	var entry AccessLogEntry
+	i := strings.IndexByte(string(msg), '{')
+	if i < 0 {
+		return entry, fmt.Errorf("no access log in syslog message %q", msg)
+	}
+	if err := json.Unmarshal(msg[i:], &entry); err != nil {
+		return entry, err
+	}
+	return entry, nil
+}
+
+// ServeSyslog observes the access log received on conn until ctx is done.
+// onError is called with the messages which are not access logs.
+func (e *Exporter) ServeSyslog(ctx context.Context, conn net.PacketConn, onError func(error)) error {
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		entry, err := ParseSyslogMessage(buf[:n])
+		if err != nil {
+			onError(err)
+			continue
+		}
+		e.Observe(entry)
+	}
+}
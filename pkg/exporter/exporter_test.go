@@ -0,0 +1,118 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exporter
+
+import (
+	"context"
+	"fmt"
+	balancerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/nginx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"testing"
+)
+
+func TestExporterObserve(t *testing.T) {
+	balancer := &balancerv1alpha1.Balancer{
+		ObjectMeta: metav1.ObjectMeta{Name: "example-balancer", Namespace: "default"},
+		Spec: balancerv1alpha1.BalancerSpec{
+			Ports: []balancerv1alpha1.BalancerPort{
+				{Name: "http", Protocol: balancerv1alpha1.TCP, Port: 80},
+				{Name: "dns", Protocol: balancerv1alpha1.UDP, Port: 53},
+			},
+			Backends: []balancerv1alpha1.BackendSpec{
+				{Name: "v1", Weight: 40},
+				{Name: "v2", Weight: 60},
+			},
+			Metrics: &balancerv1alpha1.MetricsSpec{},
+		},
+	}
+	clusterIPs := map[string]string{
+		"example-balancer-v1-backend": "10.96.0.10",
+		"example-balancer-v2-backend": "10.96.0.11",
+	}
+	e := New(balancer.Name, prometheus.NewRegistry())
+	e.LookupHost = func(_ context.Context, host string) ([]string, error) {
+		ip, ok := clusterIPs[host]
+		if !ok {
+			return nil, fmt.Errorf("no such host %s", host)
+		}
+		return []string{ip}, nil
+	}
+	if err := e.Load(context.Background(), []byte(nginx.NewConfig(balancer, nil))); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []string{
+		`<190>Oct 19 12:00:00 proxy balancer: {"port":"80","protocol":"TCP","status":"200","upstream":"10.96.0.10:80",` +
+			`"bytes_sent":"1024","bytes_received":"128","session_time":"0.120"}`,
+		`<190>Oct 19 12:00:01 proxy balancer: {"port":"80","protocol":"TCP","status":"502","upstream":"10.96.0.10:80, 10.96.0.11:80",` +
+			`"bytes_sent":"0","bytes_received":"0","session_time":"0.002"}`,
+		`<190>Oct 19 12:00:02 proxy balancer: {"port":"53","protocol":"UDP","status":"200","upstream":"10.96.0.11:53",` +
+			`"bytes_sent":"64","bytes_received":"32","session_time":"0.001"}`,
+	} {
+		entry, err := ParseSyslogMessage([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Observe(entry)
+	}
+
+	expected := []struct {
+		metric   prometheus.Collector
+		expected float64
+	}{
+		{e.sessions.WithLabelValues("example-balancer", "http", "v1", "200"), 1},
+		{e.sessions.WithLabelValues("example-balancer", "http", "v2", "502"), 1},
+		{e.errors.WithLabelValues("example-balancer", "http", "v2"), 1},
+		{e.bytes.WithLabelValues("example-balancer", "http", "v1", "downstream"), 1024},
+		{e.bytes.WithLabelValues("example-balancer", "http", "v1", "upstream"), 128},
+		{e.bytes.WithLabelValues("example-balancer", "dns", "v2", "downstream"), 64},
+	}
+	for i, c := range expected {
+		if got := testutil.ToFloat64(c.metric); got != c.expected {
+			t.Errorf("%d: expected %v, got %v", i, c.expected, got)
+		}
+	}
+	if got := testutil.CollectAndCount(e.errors); got != 1 {
+		t.Errorf("expected errors of a single backend, got %d", got)
+	}
+}
+
+func TestParseSyslogMessage(t *testing.T) {
+	if _, err := ParseSyslogMessage([]byte("<190>Oct 19 12:00:00 proxy balancer: not json")); err == nil {
+		t.Error("expected a message without access log to be rejected")
+	}
+}
+
+func TestParseStubStatus(t *testing.T) {
+	s, err := ParseStubStatus(strings.NewReader("Active connections: 3 \nserver accepts handled requests\n" +
+		" 10 9 20 \nReading: 0 Writing: 1 Waiting: 2 \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := StubStatus{Active: 3, Accepted: 10, Handled: 9, Reading: 0, Writing: 1, Waiting: 2}
+	if s != expected {
+		t.Errorf("expected %+v, got %+v", expected, s)
+	}
+
+	if _, err = ParseStubStatus(strings.NewReader("Active connections: 3\n")); err == nil {
+		t.Error("expected a truncated stub_status to be rejected")
+	}
+}
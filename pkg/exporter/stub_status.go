@@ -0,0 +1,152 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exporter
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StubStatus is the state of the connections reported by the nginx stub_status.
+type StubStatus struct {
+	Active   int64
+	Accepted int64
+	Handled  int64
+	Reading  int64
+	Writing  int64
+	Waiting  int64
+}
+
+// ParseStubStatus parses the nginx stub_status, which consists of the active connections,
+// the accepted, handled and requests counters, and the reading, writing and waiting connections.
+func ParseStubStatus(r io.Reader) (StubStatus, error) {
+	var s StubStatus
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimSpace(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		return s, err
+	}
+	if len(lines) < 4 {
+		return s, fmt.Errorf("invalid stub_status: expected 4 lines, got %d", len(lines))
+	}
+
+	var err error
+	if s.Active, err = parseField(strings.TrimPrefix(lines[0], "Active connections:")); err != nil {
+		return s, err
+	}
+	counters := strings.Fields(lines[2])
+	if len(counters) != 3 {
+		return s, fmt.Errorf("invalid stub_status counters %q", lines[2])
+	}
+	if s.Accepted, err = parseField(counters[0]); err != nil {
+		return s, err
+	}
+	if s.Handled, err = parseField(counters[1]); err != nil {
+		return s, err
+	}
+	states := strings.Fields(lines[3])
+	if len(states) != 6 {
+		return s, fmt.Errorf("invalid stub_status states %q", lines[3])
+	}
+	for i, v := range []*int64{&s.Reading, &s.Writing, &s.Waiting} {
+		if *v, err = parseField(states[2*i+1]); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+func parseField(s string) (int64, error) {
+	v, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid stub_status: %v", err)
+	}
+	return v, nil
+}
+
+// StubStatusCollector scrapes the nginx stub_status whenever it is collected.
+type StubStatusCollector struct {
+	balancer string
+	url      string
+	client   *http.Client
+
+	up          *prometheus.Desc
+	connections *prometheus.Desc
+	accepted    *prometheus.Desc
+	handled     *prometheus.Desc
+}
+
+// NewStubStatusCollector returns the collector of the stub_status served on url.
+func NewStubStatusCollector(balancer, url string) *StubStatusCollector {
+	labels := prometheus.Labels{"balancer": balancer}
+	return &StubStatusCollector{
+		balancer: balancer,
+		url:      url,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		up: prometheus.NewDesc("balancer_proxy_nginx_up",
+			"Whether the nginx stub_status is scraped successfully.", nil, labels),
+		connections: prometheus.NewDesc("balancer_proxy_nginx_connections",
+			"Number of the client connections of nginx, by state.", []string{"state"}, labels),
+		accepted: prometheus.NewDesc("balancer_proxy_nginx_connections_accepted_total",
+			"Total number of the client connections accepted by nginx.", nil, labels),
+		handled: prometheus.NewDesc("balancer_proxy_nginx_connections_handled_total",
+			"Total number of the client connections handled by nginx.", nil, labels),
+	}
+}
+
+func (c *StubStatusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.up
+	ch <- c.connections
+	ch <- c.accepted
+	ch <- c.handled
+}
+
+func (c *StubStatusCollector) Collect(ch chan<- prometheus.Metric) {
+	s, err := c.scrape()
+	if err != nil {
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 1)
+	ch <- prometheus.MustNewConstMetric(c.connections, prometheus.GaugeValue, float64(s.Active), "active")
+	ch <- prometheus.MustNewConstMetric(c.connections, prometheus.GaugeValue, float64(s.Reading), "reading")
+	ch <- prometheus.MustNewConstMetric(c.connections, prometheus.GaugeValue, float64(s.Writing), "writing")
+	ch <- prometheus.MustNewConstMetric(c.connections, prometheus.GaugeValue, float64(s.Waiting), "waiting")
+	ch <- prometheus.MustNewConstMetric(c.accepted, prometheus.CounterValue, float64(s.Accepted))
+	ch <- prometheus.MustNewConstMetric(c.handled, prometheus.CounterValue, float64(s.Handled))
+}
+
+func (c *StubStatusCollector) scrape() (StubStatus, error) {
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return StubStatus{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return StubStatus{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return ParseStubStatus(resp.Body)
+}
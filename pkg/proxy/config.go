@@ -0,0 +1,102 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package proxy implements the native L4 proxy of Balancer, which forwards TCP and UDP traffic
+// to the backend services with smooth weighted round-robin.
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	// HealthPort is the port of the health listener, which also serves the metrics.
+	HealthPort int32 = 8099
+	// HealthPath is the path of the health endpoint.
+	HealthPath = "/healthz"
+	// MetricsPath is the path of the prometheus metrics.
+	MetricsPath = "/metrics"
+)
+
+// Config is the config of the proxy, which is rendered into the proxy configmap in json.
+type Config struct {
+	Listeners []Listener `json:"listeners"`
+}
+
+// Listener accepts the traffic on a port and forwards it to the backends.
+type Listener struct {
+	Name string `json:"name"`
+	// TCP or UDP
+	Protocol string `json:"protocol"`
+	Port     int32  `json:"port"`
+	// a backend with weight 0 receives no new connections
+	Backends []Backend `json:"backends"`
+}
+
+// Backend is a backend service of a Listener.
+type Backend struct {
+	Name string `json:"name"`
+	// host:port of the backend service
+	Address string `json:"address"`
+	Weight  int32  `json:"weight"`
+}
+
+// key identifies the socket of the listener.
+func (l *Listener) key() string {
+	return fmt.Sprintf("%s/%d", l.Protocol, l.Port)
+}
+
+// ParseConfig parses and validates the proxy config.
+func ParseConfig(data []byte) (*Config, error) {
+	config := &Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]bool{}
+	for i := range config.Listeners {
+		listener := &config.Listeners[i]
+		listener.Protocol = strings.ToUpper(listener.Protocol)
+		if listener.Protocol != "TCP" && listener.Protocol != "UDP" {
+			return nil, fmt.Errorf("listener %s: unsupported protocol %q", listener.Name, listener.Protocol)
+		}
+		if listener.Port <= 0 || listener.Port > 65535 || listener.Port == HealthPort {
+			return nil, fmt.Errorf("listener %s: invalid port %d", listener.Name, listener.Port)
+		}
+		if keys[listener.key()] {
+			return nil, fmt.Errorf("listener %s: duplicate port %s", listener.Name, listener.key())
+		}
+		keys[listener.key()] = true
+		for _, backend := range listener.Backends {
+			if backend.Address == "" || backend.Weight < 0 {
+				return nil, fmt.Errorf("listener %s: invalid backend %s", listener.Name, backend.Name)
+			}
+		}
+	}
+	return config, nil
+}
+
+// LoadConfig reads and parses the proxy config file.
+func LoadConfig(file string) (*Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
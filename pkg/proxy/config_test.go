@@ -0,0 +1,43 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig([]byte(`{"listeners": [{"name": "dns", "protocol": "udp", "port": 53,
+		"backends": [{"name": "v1", "address": "example-balancer-v1-backend:53", "weight": 1}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Listeners[0].Protocol != "UDP" {
+		t.Errorf("expected the protocol normalized, got %s", config.Listeners[0].Protocol)
+	}
+
+	for _, invalid := range []string{
+		`{"listeners": [`,
+		`{"listeners": [{"name": "http", "protocol": "SCTP", "port": 80}]}`,
+		`{"listeners": [{"name": "http", "protocol": "TCP", "port": 80}, {"name": "web", "protocol": "TCP", "port": 80}]}`,
+		`{"listeners": [{"name": "http", "protocol": "TCP", "port": 80, "backends": [{"name": "v1", "weight": 1}]}]}`,
+	} {
+		if _, err := ParseConfig([]byte(invalid)); err == nil {
+			t.Errorf("expected %s to be invalid", invalid)
+		}
+	}
+}
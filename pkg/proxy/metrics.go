@@ -0,0 +1,57 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics are the prometheus metrics of the proxy.
+type metrics struct {
+	connections       *prometheus.CounterVec
+	activeConnections *prometheus.GaugeVec
+	bytes             *prometheus.CounterVec
+	dialErrors        *prometheus.CounterVec
+	configReloads     *prometheus.CounterVec
+}
+
+func newMetrics(registerer prometheus.Registerer) *metrics {
+	m := &metrics{
+		connections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "balancer_proxy_connections_total",
+			Help: "Total number of connections (or UDP sessions) forwarded to a backend.",
+		}, []string{"listener", "backend"}),
+		activeConnections: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "balancer_proxy_active_connections",
+			Help: "Number of connections (or UDP sessions) being forwarded to a backend.",
+		}, []string{"listener", "backend"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "balancer_proxy_bytes_total",
+			Help: "Total number of bytes forwarded, direction is either upstream or downstream.",
+		}, []string{"listener", "backend", "direction"}),
+		dialErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "balancer_proxy_dial_errors_total",
+			Help: "Total number of failures to connect to a backend.",
+		}, []string{"listener", "backend"}),
+		configReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "balancer_proxy_config_reloads_total",
+			Help: "Total number of config reloads, result is either success or failure.",
+		}, []string{"result"}),
+	}
+	registerer.MustRegister(m.connections, m.activeConnections, m.bytes, m.dialErrors, m.configReloads)
+	return m
+}
@@ -0,0 +1,366 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Proxy forwards the traffic of the listeners in its config.
+// The config is swapped by Apply without dropping the established connections.
+type Proxy struct {
+	// DialTimeout is the timeout to connect to a backend.
+	DialTimeout time.Duration
+	// UDPIdleTimeout is how long a UDP session is kept without any packet.
+	UDPIdleTimeout time.Duration
+
+	mu        sync.Mutex
+	listeners map[string]*listener
+	applied   bool
+	registry  *prometheus.Registry
+	metrics   *metrics
+	// the active connections and sessions of all the listeners, including the closed ones
+	active sync.WaitGroup
+}
+
+// New creates a Proxy without any listener.
+func New() *Proxy {
+	registry := prometheus.NewRegistry()
+	return &Proxy{
+		DialTimeout:    5 * time.Second,
+		UDPIdleTimeout: time.Minute,
+		listeners:      map[string]*listener{},
+		registry:       registry,
+		metrics:        newMetrics(registry),
+	}
+}
+
+// listener is a running Listener.
+type listener struct {
+	proxy *Proxy
+
+	mu   sync.RWMutex
+	name string
+	pool *weightedRoundRobin
+
+	// closes the socket, which stops accepting new connections
+	closer io.Closer
+}
+
+func (l *listener) current() (string, *weightedRoundRobin) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.name, l.pool
+}
+
+func (l *listener) update(config Listener) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.name = config.Name
+	l.pool = newWeightedRoundRobin(config.Backends)
+}
+
+// Apply swaps the config of the proxy.
+// The listeners whose port is kept switch to the new backends for the new connections only,
+// the removed listeners stop accepting, and their established connections are kept until they finish.
+// If any new port cannot be bound, the config is not applied at all.
+func (p *Proxy) Apply(config *Config) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// bind the new ports firstly, so that a failure leaves the running listeners untouched
+	started := map[string]*listener{}
+	for _, lc := range config.Listeners {
+		if _, ok := p.listeners[lc.key()]; ok {
+			continue
+		}
+		l, err := p.listen(lc)
+		if err != nil {
+			for _, s := range started {
+				_ = s.closer.Close()
+			}
+			p.metrics.configReloads.WithLabelValues("failure").Inc()
+			return err
+		}
+		started[lc.key()] = l
+	}
+
+	desired := map[string]*listener{}
+	for _, lc := range config.Listeners {
+		l, ok := p.listeners[lc.key()]
+		if !ok {
+			l = started[lc.key()]
+		}
+		l.update(lc)
+		desired[lc.key()] = l
+	}
+	for key, l := range p.listeners {
+		if _, ok := desired[key]; !ok {
+			_ = l.closer.Close()
+		}
+	}
+	for key, l := range started {
+		go l.serve(key)
+	}
+
+	p.listeners = desired
+	p.applied = true
+	p.metrics.configReloads.WithLabelValues("success").Inc()
+	return nil
+}
+
+// listen binds the socket of config.
+func (p *Proxy) listen(config Listener) (*listener, error) {
+	l := &listener{proxy: p}
+	addr := fmt.Sprintf(":%d", config.Port)
+	switch config.Protocol {
+	case "TCP":
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		l.closer = ln
+	case "UDP":
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		l.closer = conn
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q", config.Protocol)
+	}
+	return l, nil
+}
+
+func (l *listener) serve(key string) {
+	switch closer := l.closer.(type) {
+	case net.Listener:
+		l.serveTCP(closer)
+	case net.PacketConn:
+		l.serveUDP(closer)
+	}
+}
+
+// dial connects to the next backend, and falls back to the others if it fails.
+func (l *listener) dial(network string) (net.Conn, string, string, error) {
+	name, pool := l.current()
+	for i := 0; i < len(pool.peers); i++ {
+		backend, ok := pool.next()
+		if !ok {
+			break
+		}
+		conn, err := net.DialTimeout(network, backend.Address, l.proxy.DialTimeout)
+		if err == nil {
+			return conn, name, backend.Name, nil
+		}
+		l.proxy.metrics.dialErrors.WithLabelValues(name, backend.Name).Inc()
+	}
+	return nil, name, "", fmt.Errorf("listener %s: no backend available", name)
+}
+
+func (l *listener) serveTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			// closed
+			return
+		}
+		l.proxy.active.Add(1)
+		go func() {
+			defer l.proxy.active.Done()
+			l.forwardTCP(conn)
+		}()
+	}
+}
+
+func (l *listener) forwardTCP(downstream net.Conn) {
+	defer downstream.Close()
+	upstream, name, backend, err := l.dial("tcp")
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+
+	m := l.proxy.metrics
+	m.connections.WithLabelValues(name, backend).Inc()
+	m.activeConnections.WithLabelValues(name, backend).Inc()
+	defer m.activeConnections.WithLabelValues(name, backend).Dec()
+
+	// each direction is half-closed once its source is drained
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(upstream, downstream)
+		m.bytes.WithLabelValues(name, backend, "upstream").Add(float64(n))
+		closeWrite(upstream)
+	}()
+	n, _ := io.Copy(downstream, upstream)
+	m.bytes.WithLabelValues(name, backend, "downstream").Add(float64(n))
+	closeWrite(downstream)
+	wg.Wait()
+}
+
+func closeWrite(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.CloseWrite()
+	}
+}
+
+// udpSession forwards the packets of a client to the backend picked by its first packet.
+type udpSession struct {
+	upstream net.Conn
+	backend  string
+	mu       sync.Mutex
+	lastSeen time.Time
+}
+
+func (s *udpSession) touch() {
+	s.mu.Lock()
+	s.lastSeen = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *udpSession) idle() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastSeen)
+}
+
+func (l *listener) serveUDP(conn net.PacketConn) {
+	var mu sync.Mutex
+	sessions := map[string]*udpSession{}
+	buf := make([]byte, 64*1024)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			// closed, the sessions expire by themselves
+			return
+		}
+
+		mu.Lock()
+		session, ok := sessions[client.String()]
+		if !ok {
+			upstream, name, backend, err := l.dial("udp")
+			if err != nil {
+				mu.Unlock()
+				continue
+			}
+			session = &udpSession{upstream: upstream, backend: backend}
+			sessions[client.String()] = session
+			l.proxy.active.Add(1)
+			go func() {
+				defer l.proxy.active.Done()
+				l.replyUDP(conn, client, name, session)
+				mu.Lock()
+				delete(sessions, client.String())
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+
+		session.touch()
+		name, _ := l.current()
+		if written, err := session.upstream.Write(buf[:n]); err == nil {
+			l.proxy.metrics.bytes.WithLabelValues(name, session.backend, "upstream").Add(float64(written))
+		}
+	}
+}
+
+// replyUDP forwards the replies of the backend to the client until the session is idle for UDPIdleTimeout.
+func (l *listener) replyUDP(conn net.PacketConn, client net.Addr, name string, session *udpSession) {
+	defer session.upstream.Close()
+	m := l.proxy.metrics
+	m.connections.WithLabelValues(name, session.backend).Inc()
+	m.activeConnections.WithLabelValues(name, session.backend).Inc()
+	defer m.activeConnections.WithLabelValues(name, session.backend).Dec()
+
+	session.touch()
+	buf := make([]byte, 64*1024)
+	for {
+		_ = session.upstream.SetReadDeadline(time.Now().Add(l.proxy.UDPIdleTimeout))
+		n, err := session.upstream.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && session.idle() < l.proxy.UDPIdleTimeout {
+				continue
+			}
+			return
+		}
+		session.touch()
+		if written, err := conn.WriteTo(buf[:n], client); err == nil {
+			m.bytes.WithLabelValues(name, session.backend, "downstream").Add(float64(written))
+		}
+	}
+}
+
+// Close stops accepting on all the listeners.
+func (p *Proxy) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, l := range p.listeners {
+		_ = l.closer.Close()
+	}
+	p.listeners = map[string]*listener{}
+}
+
+// Wait waits for the active connections and sessions to finish, or the timeout to expire.
+// It returns false if the timeout expires.
+func (p *Proxy) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		p.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Handler serves the health and the metrics of the proxy.
+// The proxy is healthy once a config is applied.
+func (p *Proxy) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(HealthPath, func(w http.ResponseWriter, _ *http.Request) {
+		p.mu.Lock()
+		applied := p.applied
+		p.mu.Unlock()
+		if !applied {
+			http.Error(w, "no config applied", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.Handle(MetricsPath, promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{}))
+	return mux
+}
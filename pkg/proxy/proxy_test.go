@@ -0,0 +1,130 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// startEchoBackend starts a TCP backend which replies every line with its name.
+func startEchoBackend(t *testing.T, name string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					_, _ = fmt.Fprintf(conn, "%s\n", name)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// freePort returns a TCP port which is free currently.
+func freePort(t *testing.T) int32 {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return int32(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// ask sends a line over conn and returns the name of the backend which replies.
+func ask(t *testing.T, conn net.Conn, reader *bufio.Reader) string {
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintln(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return line[:len(line)-1]
+}
+
+func TestProxyApplyKeepsConnections(t *testing.T) {
+	v1 := startEchoBackend(t, "v1")
+	v2 := startEchoBackend(t, "v2")
+	port := freePort(t)
+
+	p := New()
+	defer p.Close()
+	config := &Config{Listeners: []Listener{{
+		Name: "http", Protocol: "TCP", Port: port,
+		Backends: []Backend{{Name: "v1", Address: v1, Weight: 1}, {Name: "v2", Address: v2, Weight: 0}},
+	}}}
+	if err := p.Apply(config); err != nil {
+		t.Fatal(err)
+	}
+
+	established, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer established.Close()
+	establishedReader := bufio.NewReader(established)
+	if backend := ask(t, established, establishedReader); backend != "v1" {
+		t.Fatalf("expected v1, got %s", backend)
+	}
+
+	// shift all the traffic to v2
+	config.Listeners[0].Backends[0].Weight = 0
+	config.Listeners[0].Backends[1].Weight = 1
+	if err = p.Apply(config); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	if backend := ask(t, fresh, bufio.NewReader(fresh)); backend != "v2" {
+		t.Errorf("expected a new connection to v2, got %s", backend)
+	}
+	if backend := ask(t, established, establishedReader); backend != "v1" {
+		t.Errorf("expected the established connection kept on v1, got %s", backend)
+	}
+
+	// removing the listener stops accepting, but keeps the established connection
+	if err = p.Apply(&Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+		conn.Close()
+		t.Errorf("expected the removed listener closed")
+	}
+	if backend := ask(t, established, establishedReader); backend != "v1" {
+		t.Errorf("expected the established connection kept after the listener removed, got %s", backend)
+	}
+}
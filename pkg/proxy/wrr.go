@@ -0,0 +1,66 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"sync"
+)
+
+// peer is a backend picked by the weighted round-robin.
+type peer struct {
+	backend       Backend
+	currentWeight int64
+}
+
+// weightedRoundRobin picks the backends with the smooth weighted round-robin of nginx,
+// e.g., the weights {a: 5, b: 1, c: 1} produce the sequence a a b a c a a, rather than a a a a a b c.
+type weightedRoundRobin struct {
+	mu    sync.Mutex
+	peers []*peer
+	total int64
+}
+
+func newWeightedRoundRobin(backends []Backend) *weightedRoundRobin {
+	wrr := &weightedRoundRobin{}
+	for _, backend := range backends {
+		if backend.Weight <= 0 {
+			continue
+		}
+		wrr.peers = append(wrr.peers, &peer{backend: backend})
+		wrr.total += int64(backend.Weight)
+	}
+	return wrr
+}
+
+// next returns the next backend, or false if no backend has a non-zero weight.
+func (wrr *weightedRoundRobin) next() (Backend, bool) {
+	wrr.mu.Lock()
+	defer wrr.mu.Unlock()
+
+	var best *peer
+	for _, p := range wrr.peers {
+		p.currentWeight += int64(p.backend.Weight)
+		if best == nil || p.currentWeight > best.currentWeight {
+			best = p
+		}
+	}
+	if best == nil {
+		return Backend{}, false
+	}
+	best.currentWeight -= wrr.total
+	return best.backend, true
+}
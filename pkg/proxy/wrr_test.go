@@ -0,0 +1,47 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWeightedRoundRobin(t *testing.T) {
+	wrr := newWeightedRoundRobin([]Backend{
+		{Name: "a", Weight: 5},
+		{Name: "b", Weight: 1},
+		{Name: "c", Weight: 1},
+		{Name: "d", Weight: 0},
+	})
+	var picked []string
+	for i := 0; i < 14; i++ {
+		backend, ok := wrr.next()
+		if !ok {
+			t.Fatalf("expected a backend")
+		}
+		picked = append(picked, backend.Name)
+	}
+	// smooth: the heavy backend is interleaved with the others, and the drained one is never picked
+	if sequence := strings.Join(picked, ""); sequence != "aabacaaaabacaa" {
+		t.Errorf("expected sequence aabacaaaabacaa, got %s", sequence)
+	}
+
+	if _, ok := newWeightedRoundRobin([]Backend{{Name: "a", Weight: 0}}).next(); ok {
+		t.Errorf("expected no backend if all the weights are zero")
+	}
+}
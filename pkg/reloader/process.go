@@ -0,0 +1,108 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reloader
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SignalProcess sends sig to the processes whose command line starts with cmdlinePrefix,
+// except the ones forked by such a process (e.g., the workers of a master-worker proxy).
+// The proxy and the reloader share the process namespace of the pod, so the processes are found in /proc.
+func SignalProcess(cmdlinePrefix string, sig syscall.Signal) error {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return err
+	}
+
+	// pid -> ppid of the matched processes
+	matched := map[int]int{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		cmdline, err := ioutil.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		if err != nil {
+			// the process exited
+			continue
+		}
+		// the arguments are separated by NUL
+		if !strings.HasPrefix(string(bytes.ReplaceAll(cmdline, []byte{0}, []byte{' '})), cmdlinePrefix) {
+			continue
+		}
+		ppid, err := parentPid(entry.Name())
+		if err != nil {
+			continue
+		}
+		matched[pid] = ppid
+	}
+
+	signaled := 0
+	for pid, ppid := range matched {
+		if _, forked := matched[ppid]; forked {
+			continue
+		}
+		process, err := os.FindProcess(pid)
+		if err != nil {
+			return err
+		}
+		if err = process.Signal(sig); err != nil {
+			return err
+		}
+		signaled++
+	}
+	if signaled == 0 {
+		return fmt.Errorf("no process found with %q", cmdlinePrefix)
+	}
+	return nil
+}
+
+// parentPid reads the parent pid of the process from /proc/<pid>/stat.
+func parentPid(pid string) (int, error) {
+	stat, err := ioutil.ReadFile(filepath.Join("/proc", pid, "stat"))
+	if err != nil {
+		return 0, err
+	}
+	// the command name in parentheses may contain spaces, the fields after it are "state ppid ..."
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("malformed stat of process %s", pid)
+	}
+	return strconv.Atoi(fields[1])
+}
+
+// ParseSignal parses the name of a signal which may be used to reload a proxy.
+func ParseSignal(name string) (syscall.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(name), "SIG") {
+	case "HUP":
+		return syscall.SIGHUP, nil
+	case "USR1":
+		return syscall.SIGUSR1, nil
+	case "USR2":
+		return syscall.SIGUSR2, nil
+	default:
+		return 0, fmt.Errorf("unsupported signal %q", name)
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package reloader implements the sidecar which reloads the proxy config of a Balancer in place.
+// It watches the mounted proxy config, validates it, signals the proxy to reload it,
+// and reports the hash of the applied config to the balancer-controller.
+package reloader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"hash/fnv"
+	"io/ioutil"
+	randutil "k8s.io/apimachinery/pkg/util/rand"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Port is the port the reloader serves its status on.
+	Port int32 = 8098
+	// StatusPath is the path of the status of the reloader.
+	StatusPath = "/status"
+)
+
+// Status is the state of the reloader, which is served on StatusPath in json.
+type Status struct {
+	// the hash of the config applied by the proxy
+	ConfigHash string `json:"configHash"`
+	// why the newest config is not applied, empty if it is
+	Error string `json:"error,omitempty"`
+}
+
+// Reloader reloads the proxy once the config file changes.
+type Reloader struct {
+	// ConfigFile is the path of the config file read by the proxy.
+	ConfigFile string
+	// Validate checks the config before it is applied.
+	Validate func(config []byte) error
+	// Reload signals the proxy to reload the config file.
+	Reload func() error
+
+	mu     sync.Mutex
+	status Status
+}
+
+// New creates a Reloader of configFile.
+// The current content of configFile is considered as applied, since the proxy reads it on start.
+func New(configFile string, validate func([]byte) error, reload func() error) (*Reloader, error) {
+	config, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Reloader{
+		ConfigFile: configFile,
+		Validate:   validate,
+		Reload:     reload,
+		status:     Status{ConfigHash: ConfigHash(config)},
+	}, nil
+}
+
+// Sync reloads the proxy if the config file differs from the applied one.
+// An invalid config is not applied, the proxy keeps serving the last applied one.
+func (r *Reloader) Sync() error {
+	config, err := ioutil.ReadFile(r.ConfigFile)
+	if err != nil {
+		return r.fail(err)
+	}
+	hash := ConfigHash(config)
+
+	r.mu.Lock()
+	applied := r.status.ConfigHash == hash
+	r.mu.Unlock()
+	if applied {
+		return r.fail(nil)
+	}
+
+	if err = r.Validate(config); err != nil {
+		return r.fail(fmt.Errorf("invalid config %s: %v", hash, err))
+	}
+	if err = r.Reload(); err != nil {
+		return r.fail(fmt.Errorf("failed to reload config %s: %v", hash, err))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = Status{ConfigHash: hash}
+	return nil
+}
+
+// fail records err in the status and returns it.
+func (r *Reloader) fail(err error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.Error = ""
+	if err != nil {
+		r.status.Error = err.Error()
+	}
+	return err
+}
+
+// Status returns the current status of the reloader.
+func (r *Reloader) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+// ServeHTTP serves the status of the reloader in json.
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(r.Status())
+}
+
+// Run syncs the config file whenever its directory changes, and every resyncPeriod in case an event is missed.
+// The directory is watched rather than the file, since a mounted configmap is updated by swapping a symlink.
+// Errors of Sync are passed to onError, Run only returns when ctx is done or the watcher fails.
+func (r *Reloader) Run(ctx context.Context, resyncPeriod time.Duration, onError func(error)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err = watcher.Add(filepath.Dir(r.ConfigFile)); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(resyncPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err = <-watcher.Errors:
+			return err
+		case <-watcher.Events:
+		case <-ticker.C:
+		}
+		if err = r.Sync(); err != nil {
+			onError(err)
+		}
+	}
+}
+
+// ConfigHash returns the hash of the proxy config, which is used to tell whether a proxy applies the newest config.
+func ConfigHash(config []byte) string {
+	hasher := fnv.New32a()
+	_, _ = hasher.Write(config)
+	return randutil.SafeEncodeString(fmt.Sprint(hasher.Sum32()))
+}
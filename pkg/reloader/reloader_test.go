@@ -0,0 +1,72 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reloader
+
+import (
+	"fmt"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/nginx"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloaderSync(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "nginx.conf")
+	if err := ioutil.WriteFile(configFile, []byte("worker_processes 1;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloads := 0
+	var reloadErr error
+	r, err := New(configFile, nginx.CheckConfig, func() error {
+		reloads++
+		return reloadErr
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the config read on start is applied already
+	if err = r.Sync(); err != nil || reloads != 0 {
+		t.Fatalf("expected no reload, got %d reloads and %v", reloads, err)
+	}
+
+	// an invalid config is not applied
+	applied := r.Status().ConfigHash
+	if err = ioutil.WriteFile(configFile, []byte("worker_processes 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Sync(); err == nil || reloads != 0 || r.Status().ConfigHash != applied || r.Status().Error == "" {
+		t.Fatalf("expected the invalid config rejected, got %d reloads and %v", reloads, r.Status())
+	}
+
+	// a failed reload is retried
+	config := []byte("worker_processes 2;\n")
+	if err = ioutil.WriteFile(configFile, config, 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloadErr = fmt.Errorf("no process found")
+	if err = r.Sync(); err == nil || r.Status().ConfigHash != applied {
+		t.Fatalf("expected the reload failed, got %v", r.Status())
+	}
+	reloadErr = nil
+	if err = r.Sync(); err != nil || reloads != 2 {
+		t.Fatalf("expected the config reloaded, got %d reloads and %v", reloads, err)
+	}
+	if status := r.Status(); status.ConfigHash != ConfigHash(config) || status.Error != "" {
+		t.Errorf("expected the new config applied, got %v", status)
+	}
+}
@@ -0,0 +1,30 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reloader
+
+import (
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/haproxy"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/native"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/nginx"
+)
+
+// Validators are the config validators by the format of the proxy config.
+var Validators = map[string]func(config []byte) error{
+	"nginx":   nginx.CheckConfig,
+	"haproxy": haproxy.CheckConfig,
+	"native":  native.CheckConfig,
+}
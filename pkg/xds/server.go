@@ -0,0 +1,224 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package xds implements the xDS server of the envoy data plane, which is hosted by the balancer-controller.
+// The resources translated from a Balancer are served over ADS to the envoy nodes of its proxy pods,
+// and the config acknowledged by each node is reported back to the balancer-controller.
+package xds
+
+import (
+	"context"
+	"fmt"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"github.com/hliangzhao/balancer/pkg/reloader"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"net"
+	"sort"
+	"sync"
+)
+
+// DefaultAddress is the address the xDS server listens on.
+const DefaultAddress = ":18000"
+
+// Status is the config applied by an envoy node.
+type Status struct {
+	// the version of the resources acknowledged by the node, which is the hash returned by SetResources
+	ConfigHash string
+	// why the node rejected the newest resources, empty if it did not
+	Error string
+}
+
+// node identifies an envoy node by its cluster, which selects the served resources, and its ID.
+type node struct {
+	cluster string
+	id      string
+}
+
+// Server serves the resources of each node cluster over ADS, and tracks the resources acknowledged by each node.
+type Server struct {
+	address string
+	cache   cachev3.SnapshotCache
+	server  serverv3.Server
+
+	mu sync.Mutex
+	// the node of each open stream
+	streams map[int64]node
+	// the acknowledged version of each resource type and the last rejection of each connected node
+	versions map[node]map[string]string
+	errors   map[node]string
+}
+
+// NewServer creates a Server listening on address.
+func NewServer(address string) *Server {
+	s := &Server{
+		address:  address,
+		cache:    cachev3.NewSnapshotCache(true, clusterHash{}, nil),
+		streams:  map[int64]node{},
+		versions: map[node]map[string]string{},
+		errors:   map[node]string{},
+	}
+	s.server = serverv3.NewServer(context.Background(), s.cache, serverv3.CallbackFuncs{
+		StreamRequestFunc: s.onStreamRequest,
+		StreamClosedFunc:  s.onStreamClosed,
+	})
+	return s
+}
+
+// clusterHash serves the same resources to all the nodes of a cluster.
+type clusterHash struct{}
+
+func (clusterHash) ID(node *corev3.Node) string {
+	return node.GetCluster()
+}
+
+// SetResources serves resources, by their type URL, to the nodes of cluster.
+// It returns the version of resources, which changes only with the resources.
+func (s *Server) SetResources(cluster string, resources map[resource.Type][]types.Resource) (string, error) {
+	version, err := resourcesHash(resources)
+	if err != nil {
+		return "", err
+	}
+	if current, err := s.cache.GetSnapshot(cluster); err == nil && current.GetVersion(resource.ClusterType) == version {
+		return version, nil
+	}
+	snapshot, err := cachev3.NewSnapshot(version, resources)
+	if err != nil {
+		return "", err
+	}
+	if err = snapshot.Consistent(); err != nil {
+		return "", err
+	}
+	return version, s.cache.SetSnapshot(context.Background(), cluster, snapshot)
+}
+
+// Version returns the version of the resources served to cluster, which is empty if none is served.
+func (s *Server) Version(cluster string) string {
+	snapshot, err := s.cache.GetSnapshot(cluster)
+	if err != nil {
+		return ""
+	}
+	return snapshot.GetVersion(resource.ClusterType)
+}
+
+// ClearResources stops serving the resources of cluster, e.g., when its Balancer is deleted.
+func (s *Server) ClearResources(cluster string) {
+	s.cache.ClearSnapshot(cluster)
+}
+
+// NodeStatus returns the config applied by the node id of cluster, which is false if the node is not connected.
+// A node applies a version once it acknowledges the resources of every type of the version.
+func (s *Server) NodeStatus(cluster, id string) (Status, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := node{cluster: cluster, id: id}
+	versions, ok := s.versions[n]
+	if !ok {
+		return Status{}, false
+	}
+	status := Status{Error: s.errors[n]}
+	if versions[resource.ClusterType] == versions[resource.ListenerType] {
+		status.ConfigHash = versions[resource.ClusterType]
+	}
+	return status, true
+}
+
+// onStreamRequest records the version acknowledged by the request, or the error detail of a rejection,
+// in which case the version is the last one accepted by the node.
+func (s *Server) onStreamRequest(streamID int64, request *discoveryv3.DiscoveryRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.streams[streamID]
+	if !ok {
+		if request.GetNode() == nil {
+			return fmt.Errorf("the first request of stream %d does not identify the node", streamID)
+		}
+		n = node{cluster: request.GetNode().GetCluster(), id: request.GetNode().GetId()}
+		s.streams[streamID] = n
+		s.versions[n] = map[string]string{}
+	}
+	s.versions[n][request.GetTypeUrl()] = request.GetVersionInfo()
+	if request.GetErrorDetail() != nil {
+		s.errors[n] = request.GetErrorDetail().GetMessage()
+	} else if request.GetResponseNonce() != "" {
+		delete(s.errors, n)
+	}
+	return nil
+}
+
+// onStreamClosed forgets the node of the stream, which is disconnected.
+func (s *Server) onStreamClosed(streamID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n, ok := s.streams[streamID]; ok {
+		delete(s.streams, streamID)
+		delete(s.versions, n)
+		delete(s.errors, n)
+	}
+}
+
+// Register registers the ADS service on grpcServer.
+func (s *Server) Register(grpcServer *grpc.Server) {
+	discoveryv3.RegisterAggregatedDiscoveryServiceServer(grpcServer, s.server)
+}
+
+// Start serves ADS on the address of s until ctx is done, which implements manager.Runnable.
+func (s *Server) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return err
+	}
+	grpcServer := grpc.NewServer()
+	s.Register(grpcServer)
+	go func() {
+		<-ctx.Done()
+		// the ADS streams never end by themselves, which are closed rather than waited for
+		grpcServer.Stop()
+	}()
+	return grpcServer.Serve(listener)
+}
+
+// NeedLeaderElection serves ADS on the leader only, which is the one syncing the resources of the Balancers
+// and tracking the config applied by the envoy nodes, thus the envoy nodes must connect to the leader only.
+func (s *Server) NeedLeaderElection() bool {
+	return true
+}
+
+// resourcesHash hashes the deterministic encoding of resources, in the order of their type URLs.
+func resourcesHash(resources map[resource.Type][]types.Resource) (string, error) {
+	var typeURLs []string
+	for typeURL := range resources {
+		typeURLs = append(typeURLs, typeURL)
+	}
+	sort.Strings(typeURLs)
+	var data []byte
+	for _, typeURL := range typeURLs {
+		data = append(data, typeURL...)
+		for _, r := range resources[typeURL] {
+			encoded, err := proto.MarshalOptions{Deterministic: true}.Marshal(r)
+			if err != nil {
+				return "", err
+			}
+			data = append(data, encoded...)
+		}
+	}
+	return reloader.ConfigHash(data), nil
+}
@@ -0,0 +1,266 @@
+/*
+Copyright 2021 hliangzhao.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package xds
+
+import (
+	"context"
+	"fmt"
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	balancerv1alpha1 "github.com/hliangzhao/balancer/pkg/apis/balancer/v1alpha1"
+	"github.com/hliangzhao/balancer/pkg/controllers/balancer/envoy"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestBalancer() *balancerv1alpha1.Balancer {
+	return &balancerv1alpha1.Balancer{
+		ObjectMeta: v1.ObjectMeta{Name: "example-balancer", Namespace: "default"},
+		Spec: balancerv1alpha1.BalancerSpec{
+			Ports: []balancerv1alpha1.BalancerPort{{Name: "http", Protocol: balancerv1alpha1.TCP, Port: 80}},
+			Backends: []balancerv1alpha1.BackendSpec{
+				{Name: "v1", Weight: 20},
+				{Name: "v2", Weight: 80},
+			},
+			DataPlane: balancerv1alpha1.DataPlaneEnvoy,
+		},
+	}
+}
+
+// adsClient is an in-process envoy node, which fetches the resources from the xDS server over ADS.
+type adsClient struct {
+	t      *testing.T
+	node   *corev3.Node
+	stream discoveryv3.AggregatedDiscoveryService_StreamAggregatedResourcesClient
+	cancel context.CancelFunc
+	// the latest response of each resource type
+	responses map[string]*discoveryv3.DiscoveryResponse
+}
+
+// newTestServer serves s over an in-memory connection, and connects the node id of cluster to it.
+func newTestServer(t *testing.T, cluster, id string) (*Server, *adsClient) {
+	s := NewServer("")
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	s.Register(grpcServer)
+	go func() {
+		_ = grpcServer.Serve(listener)
+	}()
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial("bufconn", grpc.WithInsecure(), grpc.WithContextDialer(
+		func(context.Context, string) (net.Conn, error) {
+			return listener.Dial()
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	stream, err := discoveryv3.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, &adsClient{
+		t:         t,
+		node:      &corev3.Node{Id: id, Cluster: cluster},
+		stream:    stream,
+		cancel:    cancel,
+		responses: map[string]*discoveryv3.DiscoveryResponse{},
+	}
+}
+
+// request subscribes to the resources of typeURL, or acknowledges the latest response of it.
+// The latest response is rejected with errorDetail if it is not nil.
+func (c *adsClient) request(typeURL string, errorDetail *status.Status) {
+	request := &discoveryv3.DiscoveryRequest{Node: c.node, TypeUrl: typeURL, ErrorDetail: errorDetail}
+	if response, ok := c.responses[typeURL]; ok {
+		request.ResponseNonce = response.Nonce
+		request.VersionInfo = response.VersionInfo
+	}
+	if err := c.stream.Send(request); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// receive waits for a response, which is recorded as the latest one of its type.
+func (c *adsClient) receive() *discoveryv3.DiscoveryResponse {
+	received := make(chan *discoveryv3.DiscoveryResponse, 1)
+	go func() {
+		response, err := c.stream.Recv()
+		if err != nil {
+			c.t.Error(err)
+		}
+		received <- response
+	}()
+	select {
+	case response := <-received:
+		if response == nil {
+			c.t.FailNow()
+		}
+		c.responses[response.TypeUrl] = response
+		return response
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("timed out waiting for a response from the xDS server")
+		return nil
+	}
+}
+
+// clusterWeights returns the weight of each endpoint of each cluster in the latest response.
+func (c *adsClient) clusterWeights() map[string]map[string]uint32 {
+	weights := map[string]map[string]uint32{}
+	for _, any := range c.responses[resource.ClusterType].Resources {
+		cluster := &clusterv3.Cluster{}
+		if err := any.UnmarshalTo(cluster); err != nil {
+			c.t.Fatal(err)
+		}
+		weights[cluster.Name] = map[string]uint32{}
+		for _, locality := range cluster.LoadAssignment.Endpoints {
+			for _, lbEndpoint := range locality.LbEndpoints {
+				address := lbEndpoint.GetEndpoint().GetAddress().GetSocketAddress()
+				endpoint := fmt.Sprintf("%s:%d", address.Address, address.GetPortValue())
+				weights[cluster.Name][endpoint] = lbEndpoint.LoadBalancingWeight.GetValue()
+			}
+		}
+	}
+	return weights
+}
+
+// waitForStatus waits until the node of c reports the expected status to s.
+func waitForStatus(t *testing.T, s *Server, c *adsClient, expected Status, connected bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, ok := s.NodeStatus(c.node.Cluster, c.node.Id)
+		if status == expected && ok == connected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the status %+v (connected: %v), got %+v (connected: %v)", expected, connected, status, ok)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer(t *testing.T) {
+	balancer := newTestBalancer()
+	cluster := envoy.NodeCluster(balancer)
+	s, client := newTestServer(t, cluster, "example-balancer-proxy-0")
+	version, err := s.SetResources(cluster, envoy.NewResources(balancer, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Version(cluster) != version {
+		t.Errorf("expected version %s, got %s", version, s.Version(cluster))
+	}
+
+	// the node fetches the clusters and the listeners translated from the Balancer
+	client.request(resource.ClusterType, nil)
+	if response := client.receive(); response.TypeUrl != resource.ClusterType || response.VersionInfo != version {
+		t.Fatalf("expected the clusters of version %s, got %v", version, response)
+	}
+	expected := map[string]map[string]uint32{
+		"tcp-80": {"example-balancer-v1-backend:80": 20, "example-balancer-v2-backend:80": 80},
+	}
+	if weights := client.clusterWeights(); !reflect.DeepEqual(weights, expected) {
+		t.Errorf("expected weights %v, got %v", expected, weights)
+	}
+	client.request(resource.ListenerType, nil)
+	response := client.receive()
+	listener := &listenerv3.Listener{}
+	if len(response.Resources) != 1 {
+		t.Fatalf("expected a listener, got %v", response)
+	}
+	if err = response.Resources[0].UnmarshalTo(listener); err != nil || listener.Name != "tcp-80" {
+		t.Errorf("expected the listener tcp-80, got %v (%v)", listener, err)
+	}
+	// the config is applied once the resources of every type are acknowledged
+	waitForStatus(t, s, client, Status{}, true)
+	client.request(resource.ClusterType, nil)
+	client.request(resource.ListenerType, nil)
+	waitForStatus(t, s, client, Status{ConfigHash: version}, true)
+
+	// the same resources keep the version, which pushes nothing
+	if unchanged, _ := s.SetResources(cluster, envoy.NewResources(balancer, nil)); unchanged != version {
+		t.Errorf("expected the version %s for the same resources, got %s", version, unchanged)
+	}
+
+	// a weight change is pushed to the node without any request
+	balancer.Spec.Backends[0].Weight = 50
+	updated, err := s.SetResources(cluster, envoy.NewResources(balancer, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated == version {
+		t.Fatalf("expected a new version for the changed weights")
+	}
+	for i := 0; i < 2; i++ {
+		if response := client.receive(); response.VersionInfo != updated {
+			t.Errorf("expected the resources of version %s, got %v", updated, response)
+		}
+	}
+	expected["tcp-80"]["example-balancer-v1-backend:80"] = 50
+	if weights := client.clusterWeights(); !reflect.DeepEqual(weights, expected) {
+		t.Errorf("expected weights %v, got %v", expected, weights)
+	}
+
+	// the node rejecting the clusters keeps the last version it accepted
+	client.responses[resource.ClusterType].VersionInfo = version
+	client.request(resource.ClusterType, &status.Status{Message: "rejected"})
+	waitForStatus(t, s, client, Status{ConfigHash: version, Error: "rejected"}, true)
+	client.request(resource.ListenerType, nil)
+	client.responses[resource.ClusterType].VersionInfo = updated
+	client.request(resource.ClusterType, nil)
+	waitForStatus(t, s, client, Status{ConfigHash: updated}, true)
+
+	// a disconnected node is forgotten
+	client.cancel()
+	waitForStatus(t, s, client, Status{}, false)
+}
+
+func TestServerClearResources(t *testing.T) {
+	balancer := newTestBalancer()
+	cluster := envoy.NodeCluster(balancer)
+	s, client := newTestServer(t, cluster, "example-balancer-proxy-0")
+	if _, err := s.SetResources(cluster, envoy.NewResources(balancer, nil)); err != nil {
+		t.Fatal(err)
+	}
+	s.ClearResources(cluster)
+	if s.Version(cluster) != "" {
+		t.Errorf("expected no version of the cleared resources, got %s", s.Version(cluster))
+	}
+
+	// the resources of a node are served once they are set
+	client.request(resource.ClusterType, nil)
+	if _, err := s.SetResources(cluster, envoy.NewResources(balancer, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if response := client.receive(); response.VersionInfo != s.Version(cluster) {
+		t.Errorf("expected the resources of version %s, got %v", s.Version(cluster), response)
+	}
+}
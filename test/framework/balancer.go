@@ -74,8 +74,8 @@ func (f *Framework) WaitForBalancerReady(balancer *balancerv1alpha1.Balancer, ti
 				return false, err
 			}
 		}
-		if actualBalancer.Status.ActiveBackendsNum != int32(len(balancer.Spec.Backends)) ||
-			actualBalancer.Status.ObsoleteBackendsNum != 0 {
+		// the obsolete backends are kept until their drain period expires, which does not block the readiness
+		if actualBalancer.Status.ActiveBackendsNum != int32(len(balancer.Spec.Backends)) {
 			return false, nil
 		}
 		// TODO: check the balancer expected backends with current backends